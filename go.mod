@@ -1,6 +1,6 @@
 module github.com/infra-whizz/wzcmslib
 
-go 1.13
+go 1.16
 
 require (
 	github.com/antonfisher/nested-logrus-formatter v1.0.3
@@ -21,6 +21,7 @@ require (
 	golang.org/x/sys v0.0.0-20200302150141-5c8b2ff67527
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f
 	gopkg.in/yaml.v2 v2.2.8 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 replace github.com/infra-whizz/wzlib => ../wzlib
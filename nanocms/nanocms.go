@@ -79,9 +79,14 @@ func (n *NanoCms) LoadNstFile(statepath string) *nanocms_state.Nanostate {
 		panic(err)
 	}
 
+	tree, err := cpr.Tree()
+	if err != nil {
+		panic(err)
+	}
+
 	// Load compiled tree
 	nst := nanocms_state.NewNanostate()
-	err = nst.Load(cpr.Tree())
+	err = nst.Load(tree)
 	if err != nil {
 		panic(err)
 	}
@@ -1,9 +1,11 @@
 package nanocms_runners
 
 import (
+	"fmt"
 	"strings"
 
 	nanocms_state "github.com/infra-whizz/wzcmslib/nanostate"
+	nanocms_compiler "github.com/infra-whizz/wzcmslib/nanostate/compiler"
 	wzlib_logger "github.com/infra-whizz/wzlib/logger"
 )
 
@@ -35,12 +37,22 @@ func (br *BaseRunner) Run(state *nanocms_state.Nanostate) bool {
 	br._response.Id = state.Id
 	br._response.Description = state.Descr
 	groups := make([]RunnerResponseGroup, 0)
+	performed := make(map[string]*RunnerResponseGroup)
 
 	for _, group := range state.OrderedGroups() { // At this point groups are anyway already ordered at .Groups
 		resp := &RunnerResponseGroup{
 			GroupId: group.Id,
 			Errcode: -1,
 		}
+		if reason := br.checkRequisites(group, performed); reason != "" {
+			br.GetLogger().Debugf("Skipping group '%s': %s", group.Id, reason)
+			resp.Errcode = ERR_SKIPPED
+			resp.Skipped = true
+			resp.Reason = reason
+			groups = append(groups, *resp)
+			continue
+		}
+
 		br.GetLogger().Debugf("Processing group '%s'", group.Id)
 		response, err := br.runGroup(group.Group)
 		if err != nil {
@@ -51,6 +63,7 @@ func (br *BaseRunner) Run(state *nanocms_state.Nanostate) bool {
 			resp.Response = response
 		}
 		groups = append(groups, *resp)
+		performed[group.Id] = resp
 	}
 	br._response.Groups = groups
 
@@ -65,6 +78,59 @@ func (br *BaseRunner) Run(state *nanocms_state.Nanostate) bool {
 	return errors == 0
 }
 
+// Check run time requisites of the group against the groups, that are already performed.
+// Returns the reason why the group should be skipped or an empty string.
+func (br *BaseRunner) checkRequisites(group *nanocms_state.StateGroup, performed map[string]*RunnerResponseGroup) string {
+	if ids, ex := group.Requisites[nanocms_compiler.CDL_R_REQUIRE]; ex {
+		for _, id := range ids {
+			resp, ex := performed[id]
+			if !ex {
+				return fmt.Sprintf("required group '%s' was not performed", id)
+			}
+			if resp.Failed() {
+				return fmt.Sprintf("required group '%s' failed", id)
+			}
+		}
+	}
+
+	if ids, ex := group.Requisites[nanocms_compiler.CDL_R_ONCHANGES]; ex {
+		changed := false
+		for _, id := range ids {
+			if resp, ex := performed[id]; ex && resp.Changed() {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return fmt.Sprintf("no changes in groups %s", strings.Join(quoteIds(ids), ", "))
+		}
+	}
+
+	if ids, ex := group.Requisites[nanocms_compiler.CDL_R_ONFAIL]; ex {
+		failed := false
+		for _, id := range ids {
+			if resp, ex := performed[id]; ex && resp.Failed() {
+				failed = true
+				break
+			}
+		}
+		if !failed {
+			return fmt.Sprintf("no failures in groups %s", strings.Join(quoteIds(ids), ", "))
+		}
+	}
+
+	return ""
+}
+
+// Quote IDs of the groups for the messages
+func quoteIds(ids []string) []string {
+	quoted := make([]string, 0, len(ids))
+	for _, id := range ids {
+		quoted = append(quoted, "'"+id+"'")
+	}
+	return quoted
+}
+
 func (br *BaseRunner) setGroupResponse(cycle *RunnerResponseModule, response []RunnerHostResult, err error) {
 	if err != nil {
 		cycle.Errcode = ERR_FAILED
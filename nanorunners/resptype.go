@@ -27,9 +27,55 @@ type RunnerResponseGroup struct {
 	GroupId  string
 	Errcode  int
 	Errmsg   string
+	Skipped  bool
+	Reason   string // Why the group was skipped
 	Response []RunnerResponseModule
 }
 
+// Failed returns true if the group or any of its modules failed on any host.
+// Ansible modules are also failed, if they say so.
+func (rrg *RunnerResponseGroup) Failed() bool {
+	if rrg.Errcode == ERR_FAILED {
+		return true
+	}
+	for _, module := range rrg.Response {
+		if module.Errcode != ERR_OK {
+			return true
+		}
+		for _, host := range module.Response {
+			for _, result := range host.Response {
+				if result.Errcode != ERR_OK {
+					return true
+				}
+				if failed, ok := result.Json["failed"].(bool); ok && failed {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Changed returns true if any module of the group changed something on any host.
+// Ansible modules say that with the "changed" flag, while shell commands
+// are always considered as changes, once they are successfully performed.
+func (rrg *RunnerResponseGroup) Changed() bool {
+	for _, module := range rrg.Response {
+		for _, host := range module.Response {
+			for _, result := range host.Response {
+				if result.Json == nil {
+					if module.Module == "shell" && result.Errcode == ERR_OK {
+						return true
+					}
+				} else if changed, ok := result.Json["changed"].(bool); ok && changed {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
 type RunnerResponse struct {
 	Id          string
 	Description string
@@ -8,6 +8,7 @@ const (
 	ERR_OK      = 0
 	ERR_FAILED  = 1
 	ERR_TIMEOUT = 2 // Prepared, but unprocessed
+	ERR_SKIPPED = 3 // Requisites are not met
 	ERR_INIT    = 255
 )
 
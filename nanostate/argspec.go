@@ -0,0 +1,333 @@
+/*
+Argument specs of the Ansible modules.
+
+Spec of a Python module is taken from its DOCUMENTATION block, which is YAML
+with the "options" section:
+
+	DOCUMENTATION = r'''
+	module: user
+	options:
+	    name:
+	        type: str
+	        required: true
+	        aliases: [ user ]
+	    state:
+	        type: str
+	        choices: [ absent, present ]
+	'''
+
+Binary modules, or modules without the documentation, can have a sidecar
+YAML file next to them, named as "<module>.argument_spec.yml", such as
+"modules/system/user.argument_spec.yml". It has the same options as
+AnsibleModule(argument_spec=...) in the "argument_spec" section:
+
+	argument_spec:
+	  name:
+	    type: str
+	    required: true
+
+Nested options are "suboptions" in the documentation and "options" in the spec.
+*/
+
+package nanocms_state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Suffixes of the argument spec sidecars
+var argSpecSuffixes = []string{".argument_spec.yml", ".argument_spec.yaml"}
+
+// ModuleArgument is an option of the module
+type ModuleArgument struct {
+	Name     string
+	Type     string // Ansible type, such as "str", "int" or "list"
+	Required bool
+	Choices  []interface{}
+	Aliases  []string
+	Elements string            // Type of the list elements
+	Options  []*ModuleArgument // Options of a dict or of list elements
+}
+
+// ModuleArgSpec is a set of the options of the module
+type ModuleArgSpec struct {
+	Module  string
+	Options []*ModuleArgument
+}
+
+// ModuleArgProblem is an argument, that does not match the spec
+type ModuleArgProblem struct {
+	Kind     LintKind
+	Argument string // Path to the argument, such as "groups" or "ports.proto"
+	Message  string
+}
+
+// Module argument as it is written in YAML
+type moduleArgumentDef struct {
+	Type       string                        `yaml:"type"`
+	Required   bool                          `yaml:"required"`
+	Choices    []interface{}                 `yaml:"choices"`
+	Aliases    []string                      `yaml:"aliases"`
+	Elements   string                        `yaml:"elements"`
+	Options    map[string]*moduleArgumentDef `yaml:"options"`
+	Suboptions map[string]*moduleArgumentDef `yaml:"suboptions"`
+}
+
+// ParseModuleDocumentation reads argument spec from the DOCUMENTATION block of the Python module
+func ParseModuleDocumentation(module string, src []byte) (*ModuleArgSpec, error) {
+	doc, err := pyDocString(string(src), "DOCUMENTATION")
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Options map[string]*moduleArgumentDef `yaml:"options"`
+	}
+	if err := yaml.Unmarshal([]byte(doc), &data); err != nil {
+		return nil, fmt.Errorf("Invalid DOCUMENTATION of module '%s': %s", module, err.Error())
+	}
+	return newModuleArgSpec(module, data.Options), nil
+}
+
+// ParseModuleArgSpec reads argument spec from the sidecar YAML
+func ParseModuleArgSpec(module string, src []byte) (*ModuleArgSpec, error) {
+	var data struct {
+		ArgumentSpec map[string]*moduleArgumentDef `yaml:"argument_spec"`
+		Options      map[string]*moduleArgumentDef `yaml:"options"`
+	}
+	if err := yaml.Unmarshal(src, &data); err != nil {
+		return nil, fmt.Errorf("Invalid argument spec of module '%s': %s", module, err.Error())
+	}
+	if data.ArgumentSpec == nil {
+		data.ArgumentSpec = data.Options
+	}
+	return newModuleArgSpec(module, data.ArgumentSpec), nil
+}
+
+func newModuleArgSpec(module string, options map[string]*moduleArgumentDef) *ModuleArgSpec {
+	return &ModuleArgSpec{Module: module, Options: newModuleArguments(options)}
+}
+
+// Module arguments, sorted by their name
+func newModuleArguments(options map[string]*moduleArgumentDef) []*ModuleArgument {
+	args := make([]*ModuleArgument, 0, len(options))
+	for name, def := range options {
+		if def == nil {
+			def = &moduleArgumentDef{}
+		}
+		arg := &ModuleArgument{
+			Name:     name,
+			Type:     def.Type,
+			Required: def.Required,
+			Choices:  def.Choices,
+			Aliases:  def.Aliases,
+			Elements: def.Elements,
+		}
+		if arg.Type == "" {
+			arg.Type = "str"
+		}
+		if def.Options != nil {
+			arg.Options = newModuleArguments(def.Options)
+		} else if def.Suboptions != nil {
+			arg.Options = newModuleArguments(def.Suboptions)
+		}
+		args = append(args, arg)
+	}
+	sort.Slice(args, func(i, j int) bool { return args[i].Name < args[j].Name })
+	return args
+}
+
+// Content of the Python triple-quoted string, assigned to the variable
+func pyDocString(src string, name string) (string, error) {
+	start := regexp.MustCompile(`(?m)^` + name + `\s*=\s*[rRuU]?('''|""")`).FindStringSubmatchIndex(src)
+	if start == nil {
+		return "", fmt.Errorf("Module has no %s", name)
+	}
+	quote := src[start[2]:start[3]]
+	end := strings.Index(src[start[1]:], quote)
+	if end < 0 {
+		return "", fmt.Errorf("%s is not terminated", name)
+	}
+	return src[start[1] : start[1]+end], nil
+}
+
+// Check arguments of the module call
+func (spec *ModuleArgSpec) Check(args map[string]interface{}) []*ModuleArgProblem {
+	return checkModuleArguments(spec.Options, args, "")
+}
+
+func checkModuleArguments(options []*ModuleArgument, args map[string]interface{}, prefix string) []*ModuleArgProblem {
+	problems := make([]*ModuleArgProblem, 0)
+	known := make(map[string]*ModuleArgument)
+	for _, option := range options {
+		known[option.Name] = option
+		for _, alias := range option.Aliases {
+			known[alias] = option
+		}
+	}
+
+	for _, option := range options {
+		if !option.Required {
+			continue
+		}
+		found := false
+		for _, name := range append([]string{option.Name}, option.Aliases...) {
+			if _, ex := args[name]; ex {
+				found = true
+			}
+		}
+		if !found {
+			problems = append(problems, &ModuleArgProblem{Kind: LINT_MISSING_ARGUMENT, Argument: prefix + option.Name,
+				Message: fmt.Sprintf("Missing required argument '%s'", prefix+option.Name)})
+		}
+	}
+
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		option, ex := known[name]
+		switch {
+		case strings.HasPrefix(name, "_ansible_"):
+		case !ex:
+			problems = append(problems, &ModuleArgProblem{Kind: LINT_UNKNOWN_ARGUMENT, Argument: prefix + name,
+				Message: fmt.Sprintf("Unknown argument '%s'", prefix+name)})
+		default:
+			problems = append(problems, checkModuleArgument(option, args[name], prefix+name)...)
+		}
+	}
+	return problems
+}
+
+// Check value of the argument
+func checkModuleArgument(option *ModuleArgument, value interface{}, name string) []*ModuleArgProblem {
+	problems := make([]*ModuleArgProblem, 0)
+	if value == nil {
+		return problems
+	}
+	if err := checkArgumentType(option.Type, value); err != nil {
+		return append(problems, &ModuleArgProblem{Kind: LINT_ARGUMENT_TYPE, Argument: name,
+			Message: fmt.Sprintf("Argument '%s' should be %s: %s", name, option.Type, err.Error())})
+	}
+
+	values := []interface{}{value}
+	if list, ok := value.([]interface{}); ok && option.Type == "list" {
+		values = list
+		for idx, elem := range list {
+			if option.Elements == "" || elem == nil {
+				continue
+			}
+			if err := checkArgumentType(option.Elements, elem); err != nil {
+				problems = append(problems, &ModuleArgProblem{Kind: LINT_ARGUMENT_TYPE, Argument: name,
+					Message: fmt.Sprintf("Element %d of the argument '%s' should be %s: %s", idx, name, option.Elements, err.Error())})
+			}
+		}
+	}
+
+	if len(option.Choices) > 0 {
+		for _, elem := range values {
+			if !argumentChoice(option.Choices, elem) {
+				choices := make([]string, 0, len(option.Choices))
+				for _, choice := range option.Choices {
+					choices = append(choices, fmt.Sprint(choice))
+				}
+				problems = append(problems, &ModuleArgProblem{Kind: LINT_ARGUMENT_CHOICE, Argument: name,
+					Message: fmt.Sprintf("Argument '%s' should be one of %s, but got '%v'", name, strings.Join(choices, ", "), elem)})
+			}
+		}
+	}
+
+	if len(option.Options) > 0 {
+		for _, elem := range values {
+			if dict, ok := elem.(map[string]interface{}); ok {
+				problems = append(problems, checkModuleArguments(option.Options, dict, name+".")...)
+			}
+		}
+	}
+	return problems
+}
+
+// Value is one of the choices. YAML scalars are compared as strings.
+func argumentChoice(choices []interface{}, value interface{}) bool {
+	for _, choice := range choices {
+		if fmt.Sprint(choice) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the value can be converted to the Ansible type, the same way as Ansible does
+func checkArgumentType(kind string, value interface{}) error {
+	switch kind {
+	case "str", "path":
+		switch value.(type) {
+		case []interface{}, map[string]interface{}:
+			return errors.New("got a collection")
+		}
+	case "int":
+		switch v := value.(type) {
+		case int, int64, uint64:
+		case float64:
+			if v != float64(int64(v)) {
+				return fmt.Errorf("got %v", v)
+			}
+		case string:
+			if _, err := strconv.ParseInt(strings.TrimSpace(v), 0, 64); err != nil {
+				return fmt.Errorf("got '%s'", v)
+			}
+		default:
+			return fmt.Errorf("got %v", v)
+		}
+	case "float":
+		switch v := value.(type) {
+		case int, int64, uint64, float64:
+		case string:
+			if _, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				return fmt.Errorf("got '%s'", v)
+			}
+		default:
+			return fmt.Errorf("got %v", v)
+		}
+	case "bool":
+		switch v := value.(type) {
+		case bool:
+		case int, int64, uint64, float64:
+			if s := fmt.Sprint(v); s != "0" && s != "1" {
+				return fmt.Errorf("got %s", s)
+			}
+		case string:
+			switch strings.ToLower(v) {
+			case "y", "yes", "on", "1", "true", "t", "n", "no", "off", "0", "false", "f":
+			default:
+				return fmt.Errorf("got '%s'", v)
+			}
+		default:
+			return fmt.Errorf("got %v", v)
+		}
+	case "list":
+		if _, ok := value.(map[string]interface{}); ok {
+			return errors.New("got a dict")
+		}
+	case "dict":
+		switch v := value.(type) {
+		case map[string]interface{}:
+		case string:
+			if !json.Valid([]byte(v)) && !strings.Contains(v, "=") {
+				return fmt.Errorf("got '%s'", v)
+			}
+		default:
+			return fmt.Errorf("got %v", v)
+		}
+	}
+	return nil
+}
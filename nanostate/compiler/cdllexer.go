@@ -0,0 +1,208 @@
+/*
+Lexer of the CDL lines, i.e. block keys and module keys, such as:
+
+	install-postgres &pgsql/install-pgsql ?is_pgsql_needed
+
+Directive sigils are recognised only at the beginning of a whitespace
+separated field, so names like "c++-compiler" are still just names.
+Version of a referred state follows its ID after "@", e.g. ~pgsql@>=12/install.
+Optional inclusion "+" and exclusion "-" are recognised only outside of
+the parentheses, so signed numbers are still arguments of the calls.
+*/
+
+package nanocms_compiler
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	cdl_tok_eof       = iota
+	cdl_tok_word      // Name of a block, module, state or function
+	cdl_tok_include   // ~
+	cdl_tok_optional  // +
+	cdl_tok_depend    // &
+	cdl_tok_cond      // ?
+	cdl_tok_loop      // []
+	cdl_tok_slash     // /
+	cdl_tok_colon     // :
+	cdl_tok_lparen    // (
+	cdl_tok_rparen    // )
+	cdl_tok_and       // and
+	cdl_tok_or        // or
+	cdl_tok_not       // not
+	cdl_tok_comma     // ,
+	cdl_tok_assign    // =
+	cdl_tok_string    // "quoted" or 'quoted'
+	cdl_tok_requisite // @
+	cdl_tok_version   // @13 or @>=12 right after the state ID of a reference
+	cdl_tok_exclude   // -
+)
+
+// Characters that can never be a part of a name
+const cdl_reserved = "~&?[]/:(),=\"'"
+
+// Words that can never be a name
+var cdl_keywords = map[string]int{
+	"and": cdl_tok_and,
+	"or":  cdl_tok_or,
+	"not": cdl_tok_not,
+}
+
+type cdlToken struct {
+	kind   int
+	text   string
+	column int  // Starts from 1
+	spaced bool // Token starts a new whitespace separated field
+}
+
+type cdlLexer struct {
+	line      string
+	runes     []rune
+	offset    int
+	spaced    bool
+	reference bool // Previous token starts a reference to a state
+	versioned bool // Previous token is a state ID of a reference
+	depth     int  // Depth of the parentheses
+}
+
+func newCDLLexer(line string) *cdlLexer {
+	return &cdlLexer{line: line, runes: []rune(line), spaced: true}
+}
+
+// Syntax error at the given column of the line
+func (lx *cdlLexer) errorAt(column int, token string, msg string, args ...interface{}) error {
+	return &CDLSyntaxError{Line: lx.line, Column: column, Token: token, Msg: fmt.Sprintf(msg, args...)}
+}
+
+// Tokens returns all tokens of the line. The last token is always EOF.
+func (lx *cdlLexer) Tokens() ([]*cdlToken, error) {
+	tokens := make([]*cdlToken, 0)
+	for {
+		token, err := lx.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+		if token.kind == cdl_tok_eof {
+			return tokens, nil
+		}
+	}
+}
+
+func (lx *cdlLexer) next() (*cdlToken, error) {
+	for lx.offset < len(lx.runes) && unicode.IsSpace(lx.runes[lx.offset]) {
+		lx.offset++
+		lx.spaced = true
+	}
+
+	token := &cdlToken{column: lx.offset + 1, spaced: lx.spaced}
+	lx.spaced = false
+	reference, versioned := lx.reference, lx.versioned
+	lx.reference, lx.versioned = false, false
+	if lx.offset >= len(lx.runes) {
+		token.kind = cdl_tok_eof
+		return token, nil
+	}
+
+	r := lx.runes[lx.offset]
+	token.text = string(r)
+	lx.offset++
+
+	switch {
+	case r == '~':
+		token.kind = cdl_tok_include
+		lx.reference = true
+	case r == '&':
+		token.kind = cdl_tok_depend
+		lx.reference = true
+	case r == '?':
+		token.kind = cdl_tok_cond
+	case r == '/':
+		token.kind = cdl_tok_slash
+	case r == ':':
+		token.kind = cdl_tok_colon
+	case r == '(':
+		token.kind = cdl_tok_lparen
+		lx.depth++
+	case r == ')':
+		token.kind = cdl_tok_rparen
+		lx.depth--
+	case r == ',':
+		token.kind = cdl_tok_comma
+	case r == '=':
+		token.kind = cdl_tok_assign
+	case r == '"' || r == '\'':
+		return lx.readString(token, r)
+	case r == '+' && token.spaced && lx.depth == 0:
+		token.kind = cdl_tok_optional
+		lx.reference = true
+	case r == '-' && token.spaced && lx.depth == 0:
+		token.kind = cdl_tok_exclude
+		lx.reference = true
+	case r == '@' && versioned && !token.spaced:
+		token.kind = cdl_tok_version
+		for lx.offset < len(lx.runes) && !unicode.IsSpace(lx.runes[lx.offset]) && !strings.ContainsRune("/(", lx.runes[lx.offset]) {
+			lx.offset++
+		}
+		token.text = string(lx.runes[token.column:lx.offset])
+	case r == '@' && token.spaced:
+		token.kind = cdl_tok_requisite
+	case r == '[':
+		if lx.offset >= len(lx.runes) || lx.runes[lx.offset] != ']' {
+			return nil, lx.errorAt(token.column, token.text, "expected '[]' loop directive")
+		}
+		lx.offset++
+		token.kind = cdl_tok_loop
+		token.text = "[]"
+	case r == ']':
+		return nil, lx.errorAt(token.column, token.text, "unexpected ']'")
+	default:
+		token.kind = cdl_tok_word
+		for lx.offset < len(lx.runes) && lx.isNameRune(lx.runes[lx.offset]) && !(reference && lx.runes[lx.offset] == '@') {
+			lx.offset++
+		}
+		lx.versioned = reference
+		token.text = string(lx.runes[token.column-1 : lx.offset])
+		if keyword, ex := cdl_keywords[token.text]; ex {
+			token.kind = keyword
+		}
+	}
+
+	return token, nil
+}
+
+// Read quoted string. Token text is the unquoted value.
+func (lx *cdlLexer) readString(token *cdlToken, quote rune) (*cdlToken, error) {
+	var value strings.Builder
+	token.kind = cdl_tok_string
+	for lx.offset < len(lx.runes) {
+		r := lx.runes[lx.offset]
+		lx.offset++
+		switch {
+		case r == quote:
+			token.text = value.String()
+			return token, nil
+		case r == '\\' && lx.offset < len(lx.runes):
+			escaped := lx.runes[lx.offset]
+			lx.offset++
+			switch escaped {
+			case 'n':
+				value.WriteRune('\n')
+			case 't':
+				value.WriteRune('\t')
+			default:
+				value.WriteRune(escaped)
+			}
+		default:
+			value.WriteRune(r)
+		}
+	}
+	return nil, lx.errorAt(token.column, string(quote), "string is not terminated")
+}
+
+func (lx *cdlLexer) isNameRune(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune(cdl_reserved, r)
+}
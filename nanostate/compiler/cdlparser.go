@@ -0,0 +1,667 @@
+/*
+Parser of the CDL lines into CDLExpr syntax trees.
+
+Grammar of a block key or a module key:
+
+	line       := field*
+	field      := name | inclusion | exclusion | dependency | requisite | condition | loop
+	name       := WORD
+	inclusion  := ("~" | "+") reference
+	exclusion  := "-" WORD "/" WORD (":" WORD)*
+	dependency := "&" reference
+	reference  := WORD ["@" VERSION] ["/" [block (":" block)*]] [params]
+	block      := ["!"] WORD
+	params     := "(" [WORD "=" literal ("," WORD "=" literal)* [","]] ")"
+	requisite  := "@" ("require" | "onchanges" | "onfail") ":" WORD (":" WORD)*
+	condition  := and-expr (["or"] and-expr)*
+	and-expr   := not-expr ("and" not-expr)*
+	not-expr   := "not" not-expr | "?" call | "(" condition ")"
+	loop       := "[]" call
+	call       := WORD ["(" [argument ("," argument)* [","]] ")"]
+	argument   := [WORD "="] literal
+	literal    := STRING | NUMBER | "True" | "False" | "None"
+
+Every field is separated by a whitespace. Arguments of a call should
+follow the function name without a whitespace, e.g. ?has_package("nginx").
+Positional arguments cannot follow keyword arguments. Parameters of a
+reference are only keyword arguments, e.g. ~pgsql/install(port=5433).
+
+Blocks of an inclusion, that start with "!", are excluded from the entire
+state, e.g. ~base-os/!install-firewall is the same as the exclusion of the
+state, included in the same line: ~base-os -base-os/install-firewall.
+
+Only one name and one loop is allowed per line, while there can be
+several dependencies and requisites. A line cannot be an inclusion and
+a dependency at the same time, and a loop cannot be either of them.
+Requisites are allowed only for the named blocks.
+
+Conditions that follow each other without an operator are joined with
+"or". All conditions of one line are one expression, i.e. "and", "or"
+and "not" are reserved words and cannot be used as names.
+*/
+
+package nanocms_compiler
+
+import (
+	"strconv"
+	"strings"
+)
+
+// CDLArgument is a literal argument of a function call
+type CDLArgument struct {
+	Name   string      // Keyword, empty for positional arguments
+	Value  interface{} // string, int64, float64, bool or nil
+	Column int
+}
+
+// CDLCall is a call of a Starlark function from the CDL line
+type CDLCall struct {
+	Function  string
+	Arguments []*CDLArgument
+	Column    int
+}
+
+// Args returns values of the positional arguments
+func (call *CDLCall) Args() []interface{} {
+	args := make([]interface{}, 0)
+	for _, arg := range call.Arguments {
+		if arg.Name == "" {
+			args = append(args, arg.Value)
+		}
+	}
+	return args
+}
+
+// Kwargs returns keyword arguments in the order they appear
+func (call *CDLCall) Kwargs() []*CDLArgument {
+	kwargs := make([]*CDLArgument, 0)
+	for _, arg := range call.Arguments {
+		if arg.Name != "" {
+			kwargs = append(kwargs, arg)
+		}
+	}
+	return kwargs
+}
+
+// String returns the call as it would be written in Starlark
+func (call *CDLCall) String() string {
+	args := make([]string, 0, len(call.Arguments))
+	for _, arg := range call.Arguments {
+		var value string
+		switch v := arg.Value.(type) {
+		case nil:
+			value = "None"
+		case bool:
+			value = "False"
+			if v {
+				value = "True"
+			}
+		case string:
+			value = strconv.Quote(v)
+		case int64:
+			value = strconv.FormatInt(v, 10)
+		case float64:
+			value = strconv.FormatFloat(v, 'g', -1, 64)
+		}
+		if arg.Name != "" {
+			value = arg.Name + "=" + value
+		}
+		args = append(args, value)
+	}
+	return call.Function + "(" + strings.Join(args, ", ") + ")"
+}
+
+const (
+	CDL_C_CALL = iota
+	CDL_C_NOT
+	CDL_C_AND
+	CDL_C_OR
+)
+
+// CDLCondition is a boolean expression over the function calls
+type CDLCondition struct {
+	Op       int
+	Call     *CDLCall        // Function call of CDL_C_CALL
+	Operands []*CDLCondition // Operands of CDL_C_NOT, CDL_C_AND and CDL_C_OR
+	Column   int
+}
+
+// Calls returns all function calls of the condition in the order they appear.
+func (cond *CDLCondition) Calls() []*CDLCall {
+	calls := make([]*CDLCall, 0)
+	if cond == nil {
+		return calls
+	}
+	if cond.Call != nil {
+		calls = append(calls, cond.Call)
+	}
+	for _, operand := range cond.Operands {
+		calls = append(calls, operand.Calls()...)
+	}
+	return calls
+}
+
+// String returns the condition as it would be written in the CDL line
+func (cond *CDLCondition) String() string {
+	if cond == nil {
+		return ""
+	}
+	switch cond.Op {
+	case CDL_C_CALL:
+		return "?" + cond.Call.String()
+	case CDL_C_NOT:
+		return "not " + cond.Operands[0].operand(cond.Op)
+	default:
+		op := " and "
+		if cond.Op == CDL_C_OR {
+			op = " or "
+		}
+		operands := make([]string, 0, len(cond.Operands))
+		for _, operand := range cond.Operands {
+			operands = append(operands, operand.operand(cond.Op))
+		}
+		return strings.Join(operands, op)
+	}
+}
+
+// Operand of the operator, in parentheses if it binds weaker
+func (cond *CDLCondition) operand(op int) string {
+	if cond.Op == CDL_C_CALL || cond.Op == CDL_C_NOT || cond.Op == op || (cond.Op == CDL_C_AND && op == CDL_C_OR) {
+		return cond.String()
+	}
+	return "(" + cond.String() + ")"
+}
+
+// Join conditions with the operator, flattening the same operators
+func joinCDLConditions(op int, left *CDLCondition, right *CDLCondition) *CDLCondition {
+	if left == nil {
+		return right
+	}
+	if left.Op == op {
+		left.Operands = append(left.Operands, right)
+		return left
+	}
+	return &CDLCondition{Op: op, Operands: []*CDLCondition{left, right}, Column: left.Column}
+}
+
+// CDLExpr is a syntax tree of a CDL line
+type CDLExpr struct {
+	Line         string
+	Name         string
+	Inclusions   []*CDLInclusion
+	Exclusions   []*CDLExclusion // Merged into the inclusions of the same states
+	Dependencies []*CDLDependency
+	Requisites   []*CDLRequisite
+	Condition    *CDLCondition // nil if there are no conditions
+	Loop         *CDLCall
+}
+
+// Type returns a type of the line: plain block, inclusion, dependency or a loop
+func (expr *CDLExpr) Type() int {
+	switch {
+	case len(expr.Inclusions) > 0:
+		for _, inclusion := range expr.Inclusions {
+			if !inclusion.Optional {
+				return CDL_T_INCLUSION
+			}
+		}
+		return CDL_T_OPTIONAL_INCLUSION
+	case len(expr.Dependencies) > 0:
+		return CDL_T_DEPENDENCY
+	case expr.Loop != nil:
+		return CDL_T_LOOP
+	default:
+		return CDL_T_BLOCK
+	}
+}
+
+// Reference to a state from an inclusion or a dependency
+type cdlReference struct {
+	stateid string
+	version string
+	blocks  []string
+	exclude []string // Blocks with "!"
+	params  []*CDLArgument
+}
+
+type cdlParser struct {
+	lexer  *cdlLexer
+	tokens []*cdlToken
+	offset int
+}
+
+// ParseCDL parses a block key or a module key into a syntax tree
+func ParseCDL(line string) (*CDLExpr, error) {
+	var err error
+	parser := &cdlParser{lexer: newCDLLexer(line)}
+	if parser.tokens, err = parser.lexer.Tokens(); err != nil {
+		return nil, err
+	}
+
+	return parser.parse()
+}
+
+func (cp *cdlParser) peek() *cdlToken {
+	return cp.tokens[cp.offset]
+}
+
+func (cp *cdlParser) next() *cdlToken {
+	token := cp.tokens[cp.offset]
+	if token.kind != cdl_tok_eof {
+		cp.offset++
+	}
+	return token
+}
+
+// Syntax error at the token
+func (cp *cdlParser) errorAt(token *cdlToken, msg string, args ...interface{}) error {
+	return cp.lexer.errorAt(token.column, token.text, msg, args...)
+}
+
+// Expect a word right after the previous token, within the same field
+func (cp *cdlParser) expectWord(what string) (*cdlToken, error) {
+	token := cp.next()
+	if token.kind != cdl_tok_word || token.spaced {
+		return nil, cp.errorAt(token, "expected %s", what)
+	}
+	return token, nil
+}
+
+func (cp *cdlParser) parse() (*CDLExpr, error) {
+	expr := &CDLExpr{
+		Line:         cp.lexer.line,
+		Inclusions:   make([]*CDLInclusion, 0),
+		Exclusions:   make([]*CDLExclusion, 0),
+		Dependencies: make([]*CDLDependency, 0),
+		Requisites:   make([]*CDLRequisite, 0),
+	}
+
+	for {
+		token := cp.next()
+		if token.kind == cdl_tok_eof {
+			break
+		}
+		if !token.spaced {
+			return nil, cp.errorAt(token, "directives should be separated by a whitespace")
+		}
+
+		switch token.kind {
+		case cdl_tok_word:
+			if expr.Name != "" {
+				return nil, cp.errorAt(token, "name is already defined as '%s'", expr.Name)
+			}
+			expr.Name = token.text
+		case cdl_tok_include, cdl_tok_optional:
+			ref, err := cp.parseReference()
+			if err != nil {
+				return nil, err
+			}
+			if len(ref.blocks) > 0 && len(ref.exclude) > 0 {
+				return nil, cp.errorAt(token, "inclusion cannot have both included and excluded blocks")
+			}
+			expr.Inclusions = append(expr.Inclusions, &CDLInclusion{
+				Stateid:  ref.stateid,
+				Version:  ref.version,
+				Blocks:   ref.blocks,
+				Exclude:  ref.exclude,
+				Params:   ref.params,
+				Optional: token.kind == cdl_tok_optional,
+				Column:   token.column,
+			})
+		case cdl_tok_exclude:
+			ref, err := cp.parseReference()
+			if err != nil {
+				return nil, err
+			}
+			if len(ref.blocks) == 0 || len(ref.exclude) > 0 || ref.version != "" || len(ref.params) > 0 {
+				return nil, cp.errorAt(token, "exclusion should only list the blocks of the state")
+			}
+			expr.Exclusions = append(expr.Exclusions, &CDLExclusion{
+				Stateid: ref.stateid,
+				Blocks:  ref.blocks,
+				Column:  token.column,
+			})
+		case cdl_tok_depend:
+			ref, err := cp.parseReference()
+			if err != nil {
+				return nil, err
+			}
+			if len(ref.blocks) == 0 || len(ref.exclude) > 0 {
+				return nil, cp.errorAt(token, "dependency should not include the entire state")
+			}
+			expr.Dependencies = append(expr.Dependencies, &CDLDependency{
+				Stateid: ref.stateid,
+				Version: ref.version,
+				Blocks:  ref.blocks,
+				Params:  ref.params,
+				Column:  token.column,
+			})
+		case cdl_tok_requisite:
+			requisite, err := cp.parseRequisite(token)
+			if err != nil {
+				return nil, err
+			}
+			expr.Requisites = append(expr.Requisites, requisite)
+		case cdl_tok_cond, cdl_tok_not, cdl_tok_lparen:
+			cp.offset--
+			cond, err := cp.parseCondition()
+			if err != nil {
+				return nil, err
+			}
+			expr.Condition = joinCDLConditions(CDL_C_OR, expr.Condition, cond)
+		case cdl_tok_loop:
+			if expr.Loop != nil {
+				return nil, cp.errorAt(token, "only one loop is allowed")
+			}
+			call, err := cp.parseCall(token)
+			if err != nil {
+				return nil, err
+			}
+			expr.Loop = call
+		default:
+			return nil, cp.errorAt(token, "unexpected '%s'", token.text)
+		}
+	}
+
+	if err := cp.validate(expr); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+// Parse reference to a state, its version, its blocks and the parameters
+func (cp *cdlParser) parseReference() (*cdlReference, error) {
+	stateid, err := cp.expectWord("state ID")
+	if err != nil {
+		return nil, err
+	}
+	ref := &cdlReference{stateid: stateid.text, blocks: make([]string, 0), exclude: make([]string, 0), params: make([]*CDLArgument, 0)}
+
+	if token := cp.peek(); token.kind == cdl_tok_version {
+		cp.next()
+		constraint, err := ParseVersionConstraint(token.text)
+		if err != nil {
+			return nil, cp.errorAt(token, "expected a version, such as @13 or @>=12")
+		}
+		ref.version = constraint.String()
+	}
+
+	if token := cp.peek(); token.kind == cdl_tok_slash && !token.spaced {
+		cp.next()
+
+		// Trailing slash is the entire state
+		if token := cp.peek(); token.kind != cdl_tok_eof && !token.spaced && token.kind != cdl_tok_lparen {
+			for {
+				block, err := cp.expectWord("block name")
+				if err != nil {
+					return nil, err
+				}
+				if name := strings.TrimPrefix(block.text, "!"); name == "" {
+					return nil, cp.errorAt(block, "expected block name after '!'")
+				} else if name != block.text {
+					ref.exclude = append(ref.exclude, name)
+				} else {
+					ref.blocks = append(ref.blocks, name)
+				}
+				if token := cp.peek(); token.kind != cdl_tok_colon || token.spaced {
+					break
+				}
+				cp.next()
+			}
+		}
+	}
+
+	if token := cp.peek(); token.kind == cdl_tok_lparen && !token.spaced {
+		if ref.params, err = cp.parseArguments(cp.next()); err != nil {
+			return nil, err
+		}
+		for _, param := range ref.params {
+			if param.Name == "" {
+				return nil, cp.lexer.errorAt(param.Column, "", "parameters of the state should be keyword arguments")
+			}
+		}
+	}
+
+	return ref, nil
+}
+
+// Parse requisite of the block after the "@" sigil
+func (cp *cdlParser) parseRequisite(sigil *cdlToken) (*CDLRequisite, error) {
+	kind, err := cp.expectWord("requisite kind")
+	if err != nil {
+		return nil, err
+	}
+	switch kind.text {
+	case CDL_R_REQUIRE, CDL_R_ONCHANGES, CDL_R_ONFAIL:
+	default:
+		return nil, cp.errorAt(kind, "unknown requisite, expected %s, %s or %s", CDL_R_REQUIRE, CDL_R_ONCHANGES, CDL_R_ONFAIL)
+	}
+
+	requisite := &CDLRequisite{Kind: kind.text, Blocks: make([]string, 0), Column: sigil.column}
+	for {
+		if token := cp.next(); token.kind != cdl_tok_colon || token.spaced {
+			return nil, cp.errorAt(token, "expected ':' and a block name")
+		}
+		block, err := cp.expectWord("block name")
+		if err != nil {
+			return nil, err
+		}
+		requisite.Blocks = append(requisite.Blocks, block.text)
+		if token := cp.peek(); token.kind != cdl_tok_colon || token.spaced {
+			return requisite, nil
+		}
+	}
+}
+
+// Parse condition, joining its parts with "or"
+func (cp *cdlParser) parseCondition() (*CDLCondition, error) {
+	cond, err := cp.parseAndCondition()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch cp.peek().kind {
+		case cdl_tok_or:
+			cp.next()
+		case cdl_tok_cond, cdl_tok_not, cdl_tok_lparen:
+			// Several conditions in a row are joined with "or"
+		default:
+			return cond, nil
+		}
+		right, err := cp.parseAndCondition()
+		if err != nil {
+			return nil, err
+		}
+		cond = joinCDLConditions(CDL_C_OR, cond, right)
+	}
+}
+
+// Parse conditions, joined with "and"
+func (cp *cdlParser) parseAndCondition() (*CDLCondition, error) {
+	cond, err := cp.parseNotCondition()
+	if err != nil {
+		return nil, err
+	}
+	for cp.peek().kind == cdl_tok_and {
+		cp.next()
+		right, err := cp.parseNotCondition()
+		if err != nil {
+			return nil, err
+		}
+		cond = joinCDLConditions(CDL_C_AND, cond, right)
+	}
+	return cond, nil
+}
+
+// Parse negation, a function call or a condition in parentheses
+func (cp *cdlParser) parseNotCondition() (*CDLCondition, error) {
+	token := cp.next()
+	switch token.kind {
+	case cdl_tok_not:
+		operand, err := cp.parseNotCondition()
+		if err != nil {
+			return nil, err
+		}
+		return &CDLCondition{Op: CDL_C_NOT, Operands: []*CDLCondition{operand}, Column: token.column}, nil
+	case cdl_tok_cond:
+		call, err := cp.parseCall(token)
+		if err != nil {
+			return nil, err
+		}
+		return &CDLCondition{Op: CDL_C_CALL, Call: call, Column: token.column}, nil
+	case cdl_tok_lparen:
+		cond, err := cp.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		if closing := cp.next(); closing.kind != cdl_tok_rparen {
+			return nil, cp.errorAt(closing, "expected ')' to close '(' at column %d", token.column)
+		}
+		return cond, nil
+	default:
+		return nil, cp.errorAt(token, "expected a condition")
+	}
+}
+
+// Parse function call after the "?" or "[]" sigil
+func (cp *cdlParser) parseCall(sigil *cdlToken) (*CDLCall, error) {
+	fn, err := cp.expectWord("function name")
+	if err != nil {
+		return nil, err
+	}
+	call := &CDLCall{Function: fn.text, Arguments: make([]*CDLArgument, 0), Column: sigil.column}
+	if token := cp.peek(); token.kind != cdl_tok_lparen || token.spaced {
+		return call, nil
+	}
+	if call.Arguments, err = cp.parseArguments(cp.next()); err != nil {
+		return nil, err
+	}
+
+	return call, nil
+}
+
+// Parse arguments after the opening parenthesis up to the closing one
+func (cp *cdlParser) parseArguments(lparen *cdlToken) ([]*CDLArgument, error) {
+	args := make([]*CDLArgument, 0)
+	keywords := make(map[string]bool)
+	for cp.peek().kind != cdl_tok_rparen {
+		arg, err := cp.parseArgument()
+		if err != nil {
+			return nil, err
+		}
+		if arg.Name == "" && len(keywords) > 0 {
+			return nil, cp.lexer.errorAt(arg.Column, "", "positional argument follows keyword argument")
+		}
+		if keywords[arg.Name] {
+			return nil, cp.lexer.errorAt(arg.Column, arg.Name, "keyword argument repeated")
+		}
+		if arg.Name != "" {
+			keywords[arg.Name] = true
+		}
+		args = append(args, arg)
+
+		token := cp.peek()
+		if token.kind == cdl_tok_comma {
+			cp.next()
+		} else if token.kind != cdl_tok_rparen {
+			return nil, cp.errorAt(token, "expected ',' or ')' to close '(' at column %d", lparen.column)
+		}
+	}
+	cp.next()
+
+	return args, nil
+}
+
+// Parse positional or keyword argument of a function call
+func (cp *cdlParser) parseArgument() (*CDLArgument, error) {
+	token := cp.next()
+	arg := &CDLArgument{Column: token.column}
+	if token.kind == cdl_tok_word && cp.peek().kind == cdl_tok_assign {
+		arg.Name = token.text
+		cp.next()
+		token = cp.next()
+	}
+
+	switch token.kind {
+	case cdl_tok_string:
+		arg.Value = token.text
+	case cdl_tok_word:
+		if value, ok := cdlLiteral(token.text); ok {
+			arg.Value = value
+		} else {
+			return nil, cp.errorAt(token, "expected a string, a number, True, False or None")
+		}
+	default:
+		return nil, cp.errorAt(token, "expected an argument")
+	}
+
+	return arg, nil
+}
+
+// Value of a literal word
+func cdlLiteral(word string) (interface{}, bool) {
+	switch word {
+	case "True":
+		return true, true
+	case "False":
+		return false, true
+	case "None":
+		return nil, true
+	}
+	if !strings.ContainsAny(word[:1], "0123456789+-.") {
+		return nil, false
+	}
+	if value, err := strconv.ParseInt(word, 0, 64); err == nil {
+		return value, true
+	}
+	if value, err := strconv.ParseFloat(word, 64); err == nil {
+		return value, true
+	}
+	return nil, false
+}
+
+// Validate combinations of the directives in one line
+func (cp *cdlParser) validate(expr *CDLExpr) error {
+	// Exclusions are blocks of the entire states, included in the same line
+	for _, exclusion := range expr.Exclusions {
+		found := false
+		for _, inclusion := range expr.Inclusions {
+			if inclusion.Stateid != exclusion.Stateid {
+				continue
+			}
+			if len(inclusion.Blocks) > 0 {
+				return cp.lexer.errorAt(exclusion.Column, "-", "exclusion is allowed only for the entire state '%s'", exclusion.Stateid)
+			}
+			inclusion.Exclude = append(inclusion.Exclude, exclusion.Blocks...)
+			found = true
+		}
+		if !found {
+			return cp.lexer.errorAt(exclusion.Column, "-", "exclusion of the state '%s', which is not included", exclusion.Stateid)
+		}
+	}
+
+	if len(expr.Inclusions) > 0 && len(expr.Dependencies) > 0 {
+		return cp.lexer.errorAt(expr.Dependencies[0].Column, "&", "line cannot be both inclusion and dependency")
+	}
+	if expr.Loop != nil && (len(expr.Inclusions) > 0 || len(expr.Dependencies) > 0) {
+		return cp.lexer.errorAt(expr.Loop.Column, "[]", "loop cannot be inclusion or dependency")
+	}
+	if len(expr.Dependencies) > 0 {
+		if expr.Name == "" {
+			return cp.lexer.errorAt(expr.Dependencies[0].Column, "&", "dependency requires a block name to anchor to")
+		}
+		for _, dependency := range expr.Dependencies {
+			dependency.AnchorBlock = expr.Name
+		}
+	}
+	if len(expr.Requisites) > 0 {
+		if len(expr.Inclusions) > 0 || expr.Loop != nil {
+			return cp.lexer.errorAt(expr.Requisites[0].Column, "@", "requisite cannot be inclusion or loop")
+		}
+		if expr.Name == "" {
+			return cp.lexer.errorAt(expr.Requisites[0].Column, "@", "requisite requires a block name")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+Data of the host, such as ports, users or versions, which is kept apart
+from the states. Data is the same for all the states of the compilation
+and is read-only. Functions and templates access it with the "data"
+builtin, by the dotted path, with an optional default:
+
+	def db_port():
+		return data("db.port", 5432)
+
+	configure-db:
+		- system.service:
+			name: postgresql
+			port: "{{ data('db.port') }}"
+			user: "{{ data.db.user }}"
+
+Elements of the lists are accessible by their index, e.g. "users.0.name".
+*/
+
+package nanocms_compiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// StarData is a namespace of the data, which is also callable by the dotted path
+type StarData struct {
+	*StarNamespace
+}
+
+// NewStarData constructor
+func NewStarData(dict *starlark.Dict) *StarData {
+	data := new(StarData)
+	data.StarNamespace = NewStarNamespace("data", dict)
+	return data
+}
+
+func (data *StarData) Name() string { return "data" }
+
+// CallInternal returns value of the dotted path, or the default if the path is not found
+func (data *StarData) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var path string
+	var bydefault starlark.Value
+	if err := starlark.UnpackArgs(data.Name(), args, kwargs, "path", &path, "default?", &bydefault); err != nil {
+		return nil, err
+	}
+	value, found := data.Lookup(path)
+	if !found {
+		if bydefault == nil {
+			return nil, fmt.Errorf("Data '%s' is not found", path)
+		}
+		return bydefault, nil
+	}
+	return value, nil
+}
+
+// Lookup value of the dotted path
+func (data *StarData) Lookup(path string) (starlark.Value, bool) {
+	var value starlark.Value = data.dict
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case *starlark.Dict:
+			elem, found, err := v.Get(starlark.String(part))
+			if err != nil || !found {
+				return nil, false
+			}
+			value = elem
+		case *starlark.List:
+			idx, err := strconv.Atoi(part)
+			if err != nil || idx < 0 || idx >= v.Len() {
+				return nil, false
+			}
+			value = v.Index(idx)
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// SetData of the host for all the states
+func (cdl *CDLFunc) SetData(data *OTree) error {
+	value, err := ToStarlark(data)
+	if err != nil {
+		return fmt.Errorf("Unable to set data: %s", err.Error())
+	}
+	dict := value.(*starlark.Dict)
+	dict.Freeze()
+	cdl.data.StarNamespace = NewStarNamespace("data", dict)
+	return nil
+}
@@ -0,0 +1,90 @@
+package nanocms_compiler
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+CompileError is returned by the compiler for any problem that is caused
+by the state source: broken YAML, unresolved references, failed
+Starlark calls etc. It carries as much context as is known at the place
+where the problem was found.
+*/
+type CompileError struct {
+	StateId   string    // ID of the state, if known
+	Block     string    // Name of the block, if known
+	Source    string    // Path to the state file, if known
+	Position  *Position // Exact place in the source, if known
+	Directive string    // CDL directive that caused the error, if any
+	Cause     error
+}
+
+// Error message, prefixed with the whole known context
+func (ce *CompileError) Error() string {
+	context := make([]string, 0)
+	if ce.Position != nil {
+		context = append(context, ce.Position.String())
+	} else if ce.Source != "" {
+		context = append(context, ce.Source)
+	}
+	if ce.StateId != "" {
+		context = append(context, fmt.Sprintf("state '%s'", ce.StateId))
+	}
+	if ce.Block != "" {
+		context = append(context, fmt.Sprintf("block '%s'", ce.Block))
+	}
+	if ce.Directive != "" && ce.Directive != ce.Block {
+		context = append(context, fmt.Sprintf("directive '%s'", ce.Directive))
+	}
+
+	cause := "unknown error"
+	if ce.Cause != nil {
+		cause = ce.Cause.Error()
+	}
+	if len(context) == 0 {
+		return cause
+	}
+
+	return fmt.Sprintf("%s: %s", strings.Join(context, ", "), cause)
+}
+
+// Unwrap returns the underlying cause
+func (ce *CompileError) Unwrap() error {
+	return ce.Cause
+}
+
+// CycleError is a chain of inclusions or dependencies, which refers back to its beginning
+type CycleError struct {
+	Chain []string // Referring states, as "state/block" or "state", ending with the first one
+}
+
+// Error message with the whole chain
+func (ce *CycleError) Error() string {
+	return fmt.Sprintf("Cycle of references: %s", strings.Join(ce.Chain, " -> "))
+}
+
+// CDLSyntaxError points to the offending token of a CDL line
+type CDLSyntaxError struct {
+	Line   string
+	Column int // Starts from 1
+	Token  string
+	Msg    string
+}
+
+// Error message with the column and the token
+func (se *CDLSyntaxError) Error() string {
+	if se.Token == "" {
+		return fmt.Sprintf("Syntax error in '%s' at column %d: %s", se.Line, se.Column, se.Msg)
+	}
+	return fmt.Sprintf("Syntax error in '%s' at column %d near '%s': %s", se.Line, se.Column, se.Token, se.Msg)
+}
+
+// Position of the error cause within the given position of a CDL line.
+// Syntax errors are pointing exactly to the offending token.
+func causePosition(pos *Position, cause error) *Position {
+	if se, ok := cause.(*CDLSyntaxError); ok && pos != nil {
+		return &Position{File: pos.File, Line: pos.Line, Column: pos.Column + se.Column - 1}
+	}
+	return pos
+}
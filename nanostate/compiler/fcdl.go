@@ -3,8 +3,9 @@ package nanocms_compiler
 import (
 	"fmt"
 	"reflect"
-	"regexp"
 	"strings"
+
+	"go.starlark.net/starlark"
 )
 
 const (
@@ -12,96 +13,237 @@ const (
 	CDL_T_DEPENDENCY
 	CDL_T_LOOP
 	CDL_T_OPTIONAL_INCLUSION
+	CDL_T_BLOCK
+)
+
+// Kinds of the requisites
+const (
+	CDL_R_REQUIRE   = "require"
+	CDL_R_ONCHANGES = "onchanges"
+	CDL_R_ONFAIL    = "onfail"
 )
 
 type CDLLoop struct {
 	StateId string
-	Module  string
+	Module  string // Empty, if the loop feeds a list of modules
 	Params  []map[interface{}]interface{}
 }
 
-type CDLInclusion struct {
-	Stateid string
-	Blocks  []string
-}
-
-type CDLDependency struct {
-	Stateid     string
-	AnchorBlock string
-	Blocks      []string
-}
-
 type CDLFunc struct {
 	threads map[string]*StarlarkProcess
+	vars    map[string]*starlark.Dict
+	params  map[string]*starlark.Dict
+	sources map[string]*cdlSource
+	data    *StarData
+}
+
+// Starlark source of the state functions, which is evaluated again for each instance
+type cdlSource struct {
+	path string
+	src  []byte // nil if the source is read from the path
+	star bool   // Source is the Starlark state, which calls the state builtins
 }
 
 func NewCDLFunc() *CDLFunc {
 	cdl := new(CDLFunc)
 	cdl.threads = make(map[string]*StarlarkProcess)
+	cdl.vars = make(map[string]*starlark.Dict)
+	cdl.params = make(map[string]*starlark.Dict)
+	cdl.sources = make(map[string]*cdlSource)
+	cdl.data = NewStarData(starlark.NewDict(0))
 	return cdl
 }
 
+// SetVars of the state, which are accessible in templates as "vars"
+func (cdl *CDLFunc) SetVars(id string, vars *OTree) error {
+	value, err := ToStarlark(vars)
+	if err != nil {
+		return fmt.Errorf("Unable to set variables for id %s: %s", id, err.Error())
+	}
+	cdl.vars[id] = value.(*starlark.Dict)
+	return nil
+}
+
+// SetParams of the state, which are defaults of the parameters of its instances.
+// State without the parameters accepts any parameters.
+func (cdl *CDLFunc) SetParams(id string, params *OTree) error {
+	value, err := ToStarlark(params)
+	if err != nil {
+		return fmt.Errorf("Unable to set parameters for id %s: %s", id, err.Error())
+	}
+	cdl.params[id] = value.(*starlark.Dict)
+	cdl.params[id].Freeze()
+	return nil
+}
+
 // ImportSource of Starlark script and evaluate it into a running thread.
 // StarlarkProcess has extra-check for the source contains only functions.
-func (cdl *CDLFunc) ImportSource(id string, srcpath string) {
-	sp := NewStarlarkProcess()
-	err := sp.LoadFile(srcpath)
+func (cdl *CDLFunc) ImportSource(id string, srcpath string) error {
+	return cdl.importSource(id, &cdlSource{path: srcpath})
+}
+
+// ImportBytes of Starlark script from the memory, where srcpath names the script in the errors.
+func (cdl *CDLFunc) ImportBytes(id string, srcpath string, src []byte) error {
+	return cdl.importSource(id, &cdlSource{path: srcpath, src: src})
+}
+
+// Evaluate Starlark script with the parameters of the state
+func (cdl *CDLFunc) importSource(id string, source *cdlSource) error {
+	sp := NewStarlarkProcess().SetData(cdl.data)
+	if source.star {
+		sp.SetStateBuilder(NewStarState(source.path))
+	}
+	if params, ex := cdl.params[id]; ex {
+		sp.SetParams(params)
+	}
+	var err error
+	if source.src != nil {
+		err = sp.LoadSource(source.path, source.src)
+	} else {
+		err = sp.LoadFile(source.path)
+	}
 	if err != nil {
-		panic(fmt.Errorf("Unable to import '%s' for id %s: %s", srcpath, id, err.Error()))
+		return fmt.Errorf("Unable to import '%s' for id %s: %s", source.path, id, err.Error())
 	}
 	cdl.threads[id] = sp
+	cdl.sources[id] = source
+	return nil
 }
 
-// Parse incoming line and extract conditions
-func (cdl *CDLFunc) getConditionsFromLine(line string) []string {
-	conditions := make([]string, 0)
-	for _, token := range strings.Split(line, " ") {
-		if strings.HasPrefix(token, "?") {
-			conditions = append(conditions, token[1:])
+// Instance of the state with the given parameters. Instance has the same
+// functions and variables, while its parameters update the defaults.
+func (cdl *CDLFunc) Instance(id string, instance string, args []*CDLArgument) error {
+	params := starlark.NewDict(len(args))
+	defaults, declared := cdl.params[id]
+	if declared {
+		for _, item := range defaults.Items() {
+			if err := params.SetKey(item[0], item[1]); err != nil {
+				return err
+			}
+		}
+	}
+	for _, arg := range args {
+		if _, found, _ := params.Get(starlark.String(arg.Name)); declared && !found {
+			return fmt.Errorf("State '%s' has no parameter '%s'", id, arg.Name)
+		}
+		value, err := ToStarlark(arg.Value)
+		if err != nil {
+			return fmt.Errorf("Invalid parameter '%s' of state '%s': %s", arg.Name, id, err.Error())
+		}
+		if err := params.SetKey(starlark.String(arg.Name), value); err != nil {
+			return err
 		}
 	}
-	return conditions
+	params.Freeze()
+
+	cdl.params[instance] = params
+	if vars, ex := cdl.vars[id]; ex {
+		cdl.vars[instance] = vars
+	}
+	if source, ex := cdl.sources[id]; ex {
+		return cdl.importSource(instance, source)
+	}
+	return nil
 }
 
-// Condition evaluates all possible conditions.
+// Get Starlark thread of the state
+func (cdl *CDLFunc) getThread(stateid string, fn string) (*StarlarkProcess, error) {
+	state, ex := cdl.threads[stateid]
+	if !ex {
+		return nil, fmt.Errorf("State '%s.st' does not have assotiated Python "+
+			"file '%s.fn' where should be a function '%s()'. To resolve this, "+
+			"create a file '%s.fn' in the same directory where the state is, "+
+			"and define that function there.", stateid, stateid, fn, stateid)
+	}
+	return state, nil
+}
+
+// Call Starlark function of the state with the literal arguments from the CDL line
+func (cdl *CDLFunc) call(stateid string, call *CDLCall) (starlark.Value, error) {
+	state, err := cdl.getThread(stateid, call.Function)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make(starlark.Tuple, 0)
+	for _, value := range call.Args() {
+		arg, err := ToStarlark(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid argument of function '%s': %s", call.String(), err.Error())
+		}
+		args = append(args, arg)
+	}
+	kwargs := make([]starlark.Tuple, 0)
+	for _, kwarg := range call.Kwargs() {
+		value, err := ToStarlark(kwarg.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid argument '%s' of function '%s': %s", kwarg.Name, call.String(), err.Error())
+		}
+		kwargs = append(kwargs, starlark.Tuple{starlark.String(kwarg.Name), value})
+	}
+
+	res, err := state.Call(call.Function, args, kwargs)
+	if err != nil {
+		return nil, fmt.Errorf("Error calling function '%s': %s", call.String(), err.Error())
+	}
+	return res, nil
+}
+
+// Condition evaluates the condition expression of the line.
 //
-// Although Wiz CDL supports multiple conditions in one line,
-// yet they are not encouraged and are evaluated with "OR" statement (any).
+// Conditions are calls of the Starlark functions, which can be combined
+// with "and", "or", "not" and parentheses. Evaluation is short-circuit,
+// so functions are called only when their result matters.
 //
 // Example:
 //
-//   something ?one ?two
+//   install-emacs ?is_debian_family and not ?is_container
+//   install-emacs (?is_debian or ?is_ubuntu) and not ?is_container
 //
-// If "one" or "two" results to "true", then "something" will happen.
-// For complex conditions they needs to be combined in Skylark function and
-// expressed in Wiz CDL as a single condition.
+// Several conditions in a row without an operator are evaluated
+// with "or" statement (any):
 //
-// Example:
+//   something ?one ?two
 //
-//   something ?onetwo
+// If "one" or "two" results to "true", then "something" will happen.
+// Functions can be called with literal positional and keyword arguments:
 //
-// def onetwo():
-//     return one() and two()
+//   install-nginx-conf ?has_package("nginx") and not ?has_file(path="/etc/nginx.conf")
 //
-func (cdl *CDLFunc) Condition(stateid string, line string) bool {
-	conditions := cdl.getConditionsFromLine(line)
-	for _, fn := range conditions {
-		state, ex := cdl.threads[stateid]
-		if !ex {
-			panic(fmt.Errorf("State '%s.st' does not have assotiated Python "+
-				"file '%s.fn' where should be a function '%s()'. To resolve this, "+
-				"create a file '%s.fn' in the same directory where the state is, "+
-				"and define that function there.", stateid, stateid, fn, stateid))
-		}
-		res, err := state.Call(fn, nil, nil)
+// Line without conditions is always "true".
+func (cdl *CDLFunc) Condition(stateid string, expr *CDLExpr) (bool, error) {
+	if expr.Condition == nil {
+		return true, nil
+	}
+	return cdl.evalCondition(stateid, expr.Condition)
+}
+
+// Evaluate condition expression
+func (cdl *CDLFunc) evalCondition(stateid string, cond *CDLCondition) (bool, error) {
+	switch cond.Op {
+	case CDL_C_CALL:
+		res, err := cdl.call(stateid, cond.Call)
 		if err != nil {
-			panic(fmt.Errorf("Error calling state '%s': %s", stateid, err.Error()))
+			return false, err
 		}
-		if res.Truth() {
-			return true
+		return bool(res.Truth()), nil
+	case CDL_C_NOT:
+		res, err := cdl.evalCondition(stateid, cond.Operands[0])
+		return !res, err
+	case CDL_C_AND, CDL_C_OR:
+		for _, operand := range cond.Operands {
+			res, err := cdl.evalCondition(stateid, operand)
+			if err != nil {
+				return false, err
+			}
+			if res == (cond.Op == CDL_C_OR) {
+				return res, nil
+			}
 		}
+		return cond.Op == CDL_C_AND, nil
+	default:
+		return false, fmt.Errorf("Unknown condition operator: %d", cond.Op)
 	}
-	return len(conditions) == 0
 }
 
 /*
@@ -136,33 +278,152 @@ func (cdl *CDLFunc) Condition(stateid string, line string) bool {
 			- my_module:
 				name: something
 				other: something-else
+
+	The function can be called with literal arguments as well:
+
+		my-job:
+			- my_module []users_in_group("admins", shell="/bin/bash")
+
+	Arguments of the module are defaults for each iteration. Loop without
+	a module name feeds every module of its list, in the order they are
+	listed, and leaves other modules of the block in place:
+
+		my-job:
+			- system.group:
+				name: staff
+			- "[]more_users":
+				- system.user:
+					shell: /bin/bash
+				- mail.alias:
+
+	Such loop should be quoted, as YAML takes "[" as a start of a list.
+	It compiles to "system.group", then "system.user" and "mail.alias"
+	for the first user, then for the second user etc.
 */
-func (cdl *CDLFunc) Loop(stateid string, line string) (*CDLLoop, error) {
-	line = regexp.MustCompile(`\s+`).ReplaceAllString(line, " ")
-	tokens := strings.Split(line, " ")
-	if len(tokens) != 2 || !strings.HasPrefix(tokens[1], "[]") {
-		return nil, fmt.Errorf("Loop directive '%s' has invalid syntax at '%s'", line, stateid)
-	}
-	fn := tokens[1][2:]
-	res, err := cdl.threads[stateid].Call(fn, nil, nil)
+func (cdl *CDLFunc) Loop(stateid string, expr *CDLExpr) (*CDLLoop, error) {
+	if expr.Loop == nil {
+		return nil, fmt.Errorf("Loop directive '%s' has invalid syntax at '%s'", expr.Line, stateid)
+	}
+	fn := expr.Loop.Function
+	res, err := cdl.call(stateid, expr.Loop)
 	if err != nil {
-		panic(fmt.Errorf("Error calling state '%s': %s", stateid, err.Error()))
+		return nil, err
 	}
 
 	res_type := res.Type()
 	if res_type != "list" {
-		panic(fmt.Errorf("Function '%s' returns '%s', but is expected to return a list of dicts.", fn, res_type))
+		return nil, fmt.Errorf("Function '%s' returns '%s', but is expected to return a list of dicts.", fn, res_type)
 	}
 
 	params := make([]map[interface{}]interface{}, 0)
 	for _, pset := range NewStarType(res).Interface().([]interface{}) {
-		if reflect.TypeOf(pset).Kind() != reflect.Map {
-			panic(fmt.Errorf("Function '%s' is expected to return a list of dicts.", fn))
+		if pset == nil || reflect.TypeOf(pset).Kind() != reflect.Map {
+			return nil, fmt.Errorf("Function '%s' is expected to return a list of dicts.", fn)
 		}
 		params = append(params, pset.(map[interface{}]interface{}))
 	}
 
-	return &CDLLoop{StateId: stateid, Params: params, Module: tokens[0]}, nil
+	return &CDLLoop{StateId: stateid, Params: params, Module: expr.Name}, nil
+}
+
+/*
+	Generate returns blocks, generated by the function of the block-level loop:
+
+		state:
+		  "[]vhosts ?is_web":
+
+	The function returns a list of pairs of the block ID and its modules:
+
+		def vhosts():
+			return [
+				("configure-vhost-" + site, [
+					{"system.file": {"path": "/etc/nginx/sites/" + site}},
+					{"system.service": {"name": "nginx", "state": "reloaded"}},
+				])
+				for site in ["example.com", "example.org"]
+			]
+
+	Block ID is a CDL line, so it can have its own conditions, inclusions
+	and dependencies, which are handled the same way as of the blocks,
+	written in the state. Generated blocks go in place of the generator.
+	States, they refer to, are loaded as soon as the functions of the state
+	are imported, by running the generator with the default parameters.
+*/
+func (cdl *CDLFunc) Generate(stateid string, expr *CDLExpr) ([]*CDLGeneratedBlock, error) {
+	fn := expr.Loop.Function
+	res, err := cdl.call(stateid, expr.Loop)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := res.(*starlark.List)
+	if !ok {
+		return nil, fmt.Errorf("Function '%s' returns '%s', but is expected to return a list of (block-id, modules) pairs.", fn, res.Type())
+	}
+
+	blocks := make([]*CDLGeneratedBlock, 0, list.Len())
+	for idx := 0; idx < list.Len(); idx++ {
+		pair, ok := list.Index(idx).(starlark.Indexable)
+		if !ok || pair.Len() != 2 || (pair.Type() != "tuple" && pair.Type() != "list") {
+			return nil, fmt.Errorf("Function '%s' returns '%s' as element %d, but is expected to return (block-id, modules) pairs.",
+				fn, list.Index(idx).Type(), idx)
+		}
+		id, ok := pair.Index(0).(starlark.String)
+		if !ok || id.GoString() == "" {
+			return nil, fmt.Errorf("Function '%s' returns '%s' as block ID of element %d, but is expected to return a string.",
+				fn, pair.Index(0), idx)
+		}
+
+		block := &CDLGeneratedBlock{Id: id.GoString()}
+		if pair.Index(1) != starlark.None {
+			modules, ok := pair.Index(1).(*starlark.List)
+			if !ok {
+				return nil, fmt.Errorf("Function '%s' returns '%s' as modules of block '%s', but is expected to return a list.",
+					fn, pair.Index(1).Type(), block.Id)
+			}
+			block.Modules = make([]interface{}, 0, modules.Len())
+			for midx := 0; midx < modules.Len(); midx++ {
+				if _, ok := modules.Index(midx).(*starlark.Dict); !ok {
+					return nil, fmt.Errorf("Function '%s' returns '%s' as module %d of block '%s', but is expected to return a dict.",
+						fn, modules.Index(midx).Type(), midx, block.Id)
+				}
+				block.Modules = append(block.Modules, fromStarlarkOrdered(modules.Index(midx)))
+			}
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// CDLGeneratedBlock is a block, generated by the function
+type CDLGeneratedBlock struct {
+	Id      string        // CDL line of the block
+	Modules []interface{} // Module calls as trees, nil if the block has no modules
+}
+
+// Value of Starlark, where dicts are trees in the order of their keys
+func fromStarlarkOrdered(value starlark.Value) interface{} {
+	switch v := value.(type) {
+	case *starlark.Dict:
+		tree := NewOTree()
+		for _, item := range v.Items() {
+			tree.Set(NewStarType(item[0]).Interface(), fromStarlarkOrdered(item[1]))
+		}
+		return tree
+	case *starlark.List:
+		out := make([]interface{}, 0, v.Len())
+		for idx := 0; idx < v.Len(); idx++ {
+			out = append(out, fromStarlarkOrdered(v.Index(idx)))
+		}
+		return out
+	case starlark.Tuple:
+		out := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			out = append(out, fromStarlarkOrdered(elem))
+		}
+		return out
+	default:
+		return NewStarType(value).Interface()
+	}
 }
 
 /*
@@ -184,37 +445,61 @@ func (cdl *CDLFunc) Loop(stateid string, line string) (*CDLLoop, error) {
 
 		~my-state/my-block:my-other-block
 
-	All jobs from that block will be included.
+	All jobs from that block will be included. Inclusion with "+" instead of
+	"~" is optional and is skipped if the state is not found.
+
+	Version of the state can be pinned after its ID, otherwise the highest
+	version is included:
+
+		~my-state@2/my-block
+		~my-state@>=1.2
+
+	State can be included with parameters, which its functions and templates
+	read as "params", updating the defaults from its "params" section:
+
+		~pgsql/install(version="13", port=5433)
+		~pgsql(port=5434)
+
+	Each set of the parameters is a separate instance of the state, and its
+	blocks are identified as "pgsql(port=5434)/install". The same parameters
+	are the same instance, regardless of their order.
+
+	Blocks of the entire state can be excluded with "!", or with the
+	exclusion "-" of the blocks of the state, included in the same line:
+
+		~base-os/!install-firewall:!install-selinux
+		~base-os -base-os/install-firewall:install-selinux
+
+	Excluded blocks are neither compiled nor required by the other blocks.
 */
-func (cdl *CDLFunc) GetInclusion(stateid string, line string) (*CDLInclusion, error) {
-	// XXX: Should check if there is only one inclusion
-	incl := &CDLInclusion{
-		Blocks: make([]string, 0),
-	}
-	if strings.Contains(line, "~") || strings.Contains(line, "+") {
-		for _, token := range strings.Split(line, " ") {
-			if token == "" {
-				continue
-			}
-			token = strings.TrimSpace(strings.TrimSuffix(token, "/"))
-
-			if strings.HasPrefix(token, "~") || strings.HasPrefix(token, "+") {
-				var incOp string
-				if strings.HasPrefix(token, "~") {
-					incOp = "~"
-				} else {
-					incOp = "+"
-				}
-				inclPath := append(strings.Split(strings.ReplaceAll(token, incOp, ""), "/"), "")[:2]
-				incl.Stateid = inclPath[0]
-				if inclPath[1] != "" {
-					incl.Blocks = strings.Split(inclPath[1], ":")
-				}
-			}
-		}
+type CDLInclusion struct {
+	Stateid  string
+	Version  string // Version constraint, empty if not pinned
+	Blocks   []string
+	Exclude  []string       // Blocks, excluded from the entire state
+	Params   []*CDLArgument // Parameters of the instance, empty if there are none
+	Optional bool           // Included with "+" and ignored if not found
+	Column   int            // Where the directive starts in the CDL line
+}
+
+// String returns the inclusion as it is written in the CDL line
+func (inclusion *CDLInclusion) String() string {
+	sigil := "~"
+	if inclusion.Optional {
+		sigil = "+"
+	}
+	blocks := append([]string{}, inclusion.Blocks...)
+	for _, block := range inclusion.Exclude {
+		blocks = append(blocks, "!"+block)
 	}
+	return sigil + cdlReferenceString(inclusion.Stateid, inclusion.Version, blocks, inclusion.Params)
+}
 
-	return incl, nil
+// CDLExclusion of the blocks of the state, which is included in the same line
+type CDLExclusion struct {
+	Stateid string
+	Blocks  []string
+	Column  int // Where the directive starts in the CDL line
 }
 
 /*
@@ -230,60 +515,122 @@ func (cdl *CDLFunc) GetInclusion(stateid string, line string) (*CDLInclusion, er
 	To add few blocks from that state:
 
 		do-something &my-state/my-block:my-other-block
+
+	Block can depend on several states:
+
+		deploy-app &pgsql/install &redis/install:configure
+
+	Every block of the dependencies is added only once, in the order they
+	are declared, and all of them go before the jobs of the block itself.
+	Version of the state is pinned and parameters are passed the same way
+	as for the inclusions:
+
+		deploy-app &pgsql@>=12/install
+		deploy-app &pgsql/install:configure(port=5433)
 */
-func (cdl *CDLFunc) GetDependency(stateid, line string) (*CDLDependency, error) {
-	var err error
-	expr := strings.Split(strings.ReplaceAll(regexp.MustCompile(`\s+`).ReplaceAllString(line, " "), "&", ""), " ")
-	if len(expr) != 2 {
-		return nil, fmt.Errorf("Dependency directive '%s' has invalid syntax at '%s'", line, stateid)
+type CDLDependency struct {
+	Stateid     string
+	Version     string // Version constraint, empty if not pinned
+	AnchorBlock string
+	Blocks      []string
+	Params      []*CDLArgument // Parameters of the instance, empty if there are none
+	Column      int            // Where the directive starts in the CDL line
+}
+
+// String returns the dependency as it is written in the CDL line
+func (dependency *CDLDependency) String() string {
+	return "&" + cdlReferenceString(dependency.Stateid, dependency.Version, dependency.Blocks, dependency.Params)
+}
+
+// Reference to the state as it is written in the CDL line
+func cdlReferenceString(stateid string, version string, blocks []string, params []*CDLArgument) string {
+	ref := StateRef(stateid, version)
+	if len(blocks) > 0 {
+		ref += "/" + strings.Join(blocks, ":")
 	}
-	refJobs := strings.Split(expr[1], "/")
-	if len(refJobs) < 2 {
-		return nil, fmt.Errorf("Dependency directive '%s' has invalid syntax at '%s'", line, stateid)
+	if len(params) > 0 {
+		ref = (&CDLCall{Function: ref, Arguments: params}).String()
 	}
+	return ref
+}
 
-	dep := &CDLDependency{
-		Stateid:     refJobs[0],
-		AnchorBlock: expr[0],
-		Blocks:      strings.Split(strings.Trim(refJobs[1], ":"), ":"),
-	}
+/*
+	Requisite is a condition of the block, which is evaluated at run time
+	on the outcome of the blocks, that were performed before it:
+
+		<BLOCK-ID> @<KIND>:<BLOCK-ID>:[BLOCK-ID]:...
+
+	Kinds of the requisites are:
+
+		require    all listed blocks were performed and did not fail
+		onchanges  any of the listed blocks changed something
+		onfail     any of the listed blocks failed
+
+	For example, to restart the service only if its configuration is changed:
+
+		restart-nginx @onchanges:configure-nginx
+
+	Or to clean up only if the deployment failed:
 
-	if len(dep.Blocks) == 0 {
-		return nil, fmt.Errorf("Dependency directive '%s' should not include the entire state at '%s'.", line, stateid)
+		cleanup @onfail:deploy-app:deploy-worker
+
+	Listed blocks are blocks of the same state, or blocks, that are included
+	into it. They always go before the block with the requisites. Several
+	requisites of the block should all be met, otherwise the block is skipped.
+*/
+type CDLRequisite struct {
+	Kind   string
+	Blocks []string
+	Column int // Where the directive starts in the CDL line
+}
+
+// GetInclusion returns the first inclusion of the CDL line.
+//
+// Deprecated: use ParseCDL, which returns all the inclusions of the line.
+func (cdl *CDLFunc) GetInclusion(stateid string, line string) (*CDLInclusion, error) {
+	expr, err := ParseCDL(line)
+	if err != nil {
+		return nil, fmt.Errorf("Inclusion directive '%s' has invalid syntax at '%s': %s", line, stateid, err.Error())
+	}
+	if len(expr.Inclusions) == 0 {
+		return &CDLInclusion{Blocks: make([]string, 0)}, nil
 	}
+	return expr.Inclusions[0], nil
+}
 
-	return dep, err
+// GetDependency returns the first dependency of the CDL line.
+//
+// Deprecated: use ParseCDL, which returns all the dependencies of the line.
+func (cdl *CDLFunc) GetDependency(stateid string, line string) (*CDLDependency, error) {
+	expr, err := ParseCDL(line)
+	if err != nil || len(expr.Dependencies) == 0 {
+		return nil, fmt.Errorf("Dependency directive '%s' has invalid syntax at '%s'", line, stateid)
+	}
+	return expr.Dependencies[0], nil
 }
 
-// BlockType returns a type of a block: reference or inclusion
+// BlockType returns a type of a block: inclusion, dependency, loop or optional inclusion.
+// Plain block is -1.
+//
+// Deprecated: use the Type of the expression, returned by ParseCDL.
 func (cdl *CDLFunc) BlockType(stateid string, line string) (int, error) {
-	// XXX: The implementation is very basic and dirty. This needs to be a better updated.
-	var err error
-	if strings.Contains(line, "~") && strings.Contains(line, "&") {
-		return -1, fmt.Errorf("Line '%s' in '%s' cannot be both inclusion and reference", stateid, line)
-	}
-	if strings.Contains(line, "~") {
-		return CDL_T_INCLUSION, nil
-	} else if strings.Contains(line, "&") {
-		return CDL_T_DEPENDENCY, nil
-	} else if strings.Contains(line, "[]") {
-		if strings.Contains(line, "~") || strings.Contains(line, "&") {
-			return -1, fmt.Errorf("Loop at '%s' in '%s' cannot be inclusion or a reference", stateid, line)
-		}
-		return CDL_T_LOOP, nil
-	} else if strings.Contains(line, "+") {
-		return CDL_T_OPTIONAL_INCLUSION, nil
+	expr, err := ParseCDL(line)
+	if err != nil {
+		return -1, fmt.Errorf("Line '%s' in '%s' has invalid syntax: %s", line, stateid, err.Error())
 	}
-
-	return -1, err
+	if expr.Type() == CDL_T_BLOCK {
+		return -1, nil
+	}
+	return expr.Type(), nil
 }
 
 // ToCDLKey removes all controlling macros, leaving only ready to final use key.
+//
+// Deprecated: use the Name of the expression, returned by ParseCDL.
 func (cdl *CDLFunc) ToCDLKey(stateid string, line string) string {
-	for _, token := range strings.Split(line, " ") {
-		if len(token) > 0 && !strings.HasPrefix(token, "~") && !strings.HasPrefix(token, "&") {
-			return token
-		}
+	expr, err := ParseCDL(line)
+	if err != nil {
+		return ""
 	}
-	return ""
+	return expr.Name
 }
@@ -25,7 +25,32 @@ type StarlarkProcess struct {
 
 func NewStarlarkProcess() *StarlarkProcess {
 	sp := new(StarlarkProcess)
-	sp.builtins = nanocms_builtins.BuiltinMap
+	sp.builtins = make(starlark.StringDict, len(nanocms_builtins.BuiltinMap)+2)
+	for name, value := range nanocms_builtins.BuiltinMap {
+		sp.builtins[name] = value
+	}
+	sp.SetParams(starlark.NewDict(0))
+	sp.SetData(NewStarData(starlark.NewDict(0)))
+	return sp
+}
+
+// SetParams of the state instance, which are accessible as "params" global
+func (sp *StarlarkProcess) SetParams(params *starlark.Dict) *StarlarkProcess {
+	sp.builtins["params"] = NewStarNamespace("params", params)
+	return sp
+}
+
+// SetData of the host, which is accessible as "data" global
+func (sp *StarlarkProcess) SetData(data *StarData) *StarlarkProcess {
+	sp.builtins["data"] = data
+	return sp
+}
+
+// SetStateBuilder of the Starlark state, which builtins "state" and "block" define the state
+func (sp *StarlarkProcess) SetStateBuilder(ss *StarState) *StarlarkProcess {
+	for name, value := range ss.builtins() {
+		sp.builtins[name] = value
+	}
 	return sp
 }
 
@@ -37,6 +62,15 @@ func (sp *StarlarkProcess) LoadFile(src string) error {
 	return err
 }
 
+// LoadSource of the Starlark script from the memory
+func (sp *StarlarkProcess) LoadSource(filename string, src []byte) error {
+	var err error
+	sp.thread = &starlark.Thread{Load: repl.MakeLoad()}
+	sp.globals, err = starlark.ExecFile(sp.thread, filename, src, sp.builtins)
+
+	return err
+}
+
 func (sp *StarlarkProcess) Call(fn string, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	if !sp.globals.Has(fn) {
 		return nil, fmt.Errorf("No such function: %s", fn)
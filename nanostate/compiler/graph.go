@@ -0,0 +1,270 @@
+/*
+Graph of the compiled blocks.
+
+Every block is a node, identified by the state it comes from and its name,
+e.g. "pgsql/install-pgsql". Dependencies are the edges from a block to
+the blocks it requires. The same block, pulled by several inclusions or
+dependencies, is one node and is therefore compiled into the state only once.
+
+Blocks of the compiled state are named by the key of their node. Blocks of
+the state itself and included blocks keep their names, while blocks, that
+are pulled only by the dependencies, are named by their ID:
+
+	state:
+	  pgsql/install-pgsql:
+	    - packaging.os.apt:
+	        present: pgsql
+	  install-postgres:
+	    - system.service:
+	        name: postgresql
+	graph:
+	  pgsql/install-pgsql: []
+	  install-postgres:
+	    - pgsql/install-pgsql
+
+Run time requisites of the blocks are edges of the graph as well. They are
+listed per block in the "requisites" section, if there are any:
+
+	requisites:
+	  restart-postgres:
+	    onchanges:
+	      - install-postgres
+*/
+
+package nanocms_compiler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BlockNode is a compiled block in the graph
+type BlockNode struct {
+	Id       string   // As "<STATE-ID>/<BLOCK>"
+	StateId  string   // State, where the block is defined
+	Block    string   // Name of the block in its state
+	Key      string   // Name of the block in the compiled state
+	Requires []string // IDs of the blocks, that should be performed before
+
+	Requisites []*BlockRequisite // Run time requisites on the other blocks
+
+	jobs      []interface{}
+	positions []*Position
+	position  *Position
+}
+
+// BlockRequisite is a run time requisite of the block on the other blocks
+type BlockRequisite struct {
+	Kind   string   // CDL_R_REQUIRE, CDL_R_ONCHANGES or CDL_R_ONFAIL
+	Blocks []string // IDs of the blocks
+}
+
+// Jobs returns compiled modules of the block
+func (node *BlockNode) Jobs() []interface{} {
+	return node.jobs
+}
+
+// Position of the block definition in the source
+func (node *BlockNode) Position() *Position {
+	return node.position
+}
+
+// Deep copy of the node under another key
+func (node *BlockNode) copy(key string) *BlockNode {
+	other := *node
+	other.Key = key
+	other.Requires = append([]string{}, node.Requires...)
+	other.Requisites = make([]*BlockRequisite, 0, len(node.Requisites))
+	for _, requisite := range node.Requisites {
+		other.Requisites = append(other.Requisites, &BlockRequisite{
+			Kind:   requisite.Kind,
+			Blocks: append([]string{}, requisite.Blocks...),
+		})
+	}
+	other.jobs = copyValue(node.jobs).([]interface{})
+	other.positions = append([]*Position{}, node.positions...)
+	return &other
+}
+
+// BlockGraph is a directed acyclic graph of the compiled blocks
+type BlockGraph struct {
+	nodes map[string]*BlockNode
+	order []string // Node IDs in the order they were added
+}
+
+func NewBlockGraph() *BlockGraph {
+	bg := new(BlockGraph)
+	bg.nodes = make(map[string]*BlockNode)
+	bg.order = make([]string, 0)
+	return bg
+}
+
+// BlockId of the block in the state
+func BlockId(stateid string, block string) string {
+	return stateid + "/" + block
+}
+
+// Node by its ID or nil
+func (bg *BlockGraph) Node(id string) *BlockNode {
+	return bg.nodes[id]
+}
+
+// NodeByKey returns node by its name in the compiled state or nil
+func (bg *BlockGraph) NodeByKey(key string) *BlockNode {
+	for _, id := range bg.order {
+		if bg.nodes[id].Key == key {
+			return bg.nodes[id]
+		}
+	}
+	return nil
+}
+
+// Nodes in the order they were added
+func (bg *BlockGraph) Nodes() []*BlockNode {
+	nodes := make([]*BlockNode, 0, len(bg.order))
+	for _, id := range bg.order {
+		nodes = append(nodes, bg.nodes[id])
+	}
+	return nodes
+}
+
+// Add node to the graph. Node, which is already in the graph, is merged
+// with the existing one, i.e. only its requirements are added. Key, that is
+// already taken by another node, is replaced with the node ID.
+func (bg *BlockGraph) addNode(node *BlockNode) *BlockNode {
+	if existing, ex := bg.nodes[node.Id]; ex {
+		for _, req := range node.Requires {
+			existing.require(req)
+		}
+		return existing
+	}
+	if other := bg.NodeByKey(node.Key); other != nil {
+		node.Key = node.Id
+	}
+	bg.nodes[node.Id] = node
+	bg.order = append(bg.order, node.Id)
+	return node
+}
+
+// Add requirement, if it is not there yet
+func (node *BlockNode) require(id string) {
+	for _, req := range node.Requires {
+		if req == id {
+			return
+		}
+	}
+	node.Requires = append(node.Requires, id)
+}
+
+// Merge the node of another graph under the given key, together with
+// all the nodes it requires. Nodes are deep copies of the other graph.
+func (bg *BlockGraph) merge(other *BlockGraph, id string, key string) *BlockNode {
+	return bg.mergeExcept(other, id, key, nil)
+}
+
+// Merge the node of another graph like merge does, except the nodes
+// of the other graph by their IDs, which are neither merged nor required.
+func (bg *BlockGraph) mergeExcept(other *BlockGraph, id string, key string, except map[string]bool) *BlockNode {
+	if existing, ex := bg.nodes[id]; ex {
+		return existing
+	}
+	node := other.nodes[id].copy(key)
+	requires := make([]string, 0, len(node.Requires))
+	for _, req := range node.Requires {
+		if except[req] {
+			continue
+		}
+		bg.mergeExcept(other, req, other.nodes[req].Key, except)
+		requires = append(requires, req)
+	}
+	node.Requires = requires
+	return bg.addNode(node)
+}
+
+// Sorted returns nodes in topological order: every node goes after the nodes it requires.
+// Otherwise the order the nodes were added is kept.
+func (bg *BlockGraph) Sorted() ([]*BlockNode, error) {
+	sorted := make([]*BlockNode, 0, len(bg.order))
+	done := make(map[string]bool)
+	for len(sorted) < len(bg.order) {
+		found := false
+		for _, id := range bg.order {
+			if done[id] {
+				continue
+			}
+			ready := true
+			for _, req := range bg.nodes[id].Requires {
+				if _, ex := bg.nodes[req]; ex && !done[req] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				done[id] = true
+				sorted = append(sorted, bg.nodes[id])
+				found = true
+				break
+			}
+		}
+		if !found {
+			pending := make([]string, 0)
+			for _, id := range bg.order {
+				if !done[id] {
+					pending = append(pending, id)
+				}
+			}
+			return nil, fmt.Errorf("Blocks require each other: %s", strings.Join(pending, ", "))
+		}
+	}
+	return sorted, nil
+}
+
+// Requires returns names of the blocks in the compiled state, that should be performed before the given one
+func (bg *BlockGraph) Requires(key string) []string {
+	keys := make([]string, 0)
+	if node := bg.NodeByKey(key); node != nil {
+		for _, req := range node.Requires {
+			if other, ex := bg.nodes[req]; ex {
+				keys = append(keys, other.Key)
+			}
+		}
+	}
+	return keys
+}
+
+// Requisites returns names of the blocks in the compiled state per kind of the
+// requisites of the given block. Blocks, that are not compiled, are named by their ID.
+func (bg *BlockGraph) Requisites(key string) *OTree {
+	requisites := NewOTree()
+	node := bg.NodeByKey(key)
+	if node == nil {
+		return requisites
+	}
+	for _, requisite := range node.Requisites {
+		keys := requisites.GetList(requisite.Kind)
+		if keys == nil {
+			keys = make([]interface{}, 0)
+		}
+		for _, id := range requisite.Blocks {
+			name := id
+			if other, ex := bg.nodes[id]; ex {
+				name = other.Key
+			}
+			if !containsValue(keys, name) {
+				keys = append(keys, name)
+			}
+		}
+		requisites.Set(requisite.Kind, keys)
+	}
+	return requisites
+}
+
+// List contains the value
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, elem := range list {
+		if elem == value {
+			return true
+		}
+	}
+	return false
+}
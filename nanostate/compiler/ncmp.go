@@ -1,110 +1,474 @@
 /*
 Nanostate compiler.
 
-Currently just a static YAML instructions loader according to the Nanostate specs.
+Loads the root state and all the states it refers to, expands their
+conditions, loops, inclusions and templates, and compiles them into one
+static tree of blocks, that Nanostate loads:
+
+	id: state-definition
+	description: Root state
+	version: "1.2"                  # Only if the root state is versioned
+	state:
+	  pgsql/install-pgsql:          # Required block of the other state
+	    - packaging.os.apt: ...
+	  install-postgres:
+	    - packaging.os.apt: ...
+	  restart-postgres:             # Block with "@onchanges:install-postgres"
+	    - system.service: ...
+	graph:                          # Blocks, that each block requires
+	  pgsql/install-pgsql: []
+	  install-postgres: [pgsql/install-pgsql]
+	  restart-postgres: [install-postgres]
+	requisites:                     # Only if any block has run time requisites
+	  restart-postgres:
+	    onchanges: [install-postgres]
+
+Blocks go in the order they can be performed. Blocks, required by the "&"
+dependencies, are separate blocks, named by their state and block, and are
+not merged into the blocks which require them, so each of them runs once.
 */
 
 package nanocms_compiler
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/davecgh/go-spew/spew"
-	"github.com/go-yaml/yaml"
+	"github.com/infra-whizz/wzcmslib/nanoutils"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
+var logger *logrus.Logger
+
+func init() {
+	logger = nanoutils.GetTextLogger(logrus.DebugLevel, os.Stdout)
+}
+
 type NstCompiler struct {
-	// Index of all states that should be included
+	// Index of all states that should be included, by their keys.
+	// Key is the state ID, followed by "@" and its version, if it has any.
 	_states     map[string]*OTree
+	_sources    map[string]string   // State key to its source file
+	_versions   map[string]string   // State key to its version
+	_keys       map[string][]string // State ID to the keys of all its loaded versions
+	_latest     map[string]string   // State ID to the key, which is loaded without a version pin
+	_requested  string              // Reference, that is requested by the last cycle
 	_functions  *CDLFunc
 	_unresolved *RefList
 	tree        *OTree
+	graph       *BlockGraph
 	rootStateId string
+	_chain      []*compileFrame        // States that are being compiled, from the root
+	_compiled   map[string]*BlockGraph // Compiled states, referenced during the current compilation
+	_branches   map[string]*OTree      // Compiled states with the generated blocks
+	_generated  map[string]*generatedBranch
+	_trace      *CompileTrace
 	_debug      bool
 }
 
+// Branch of the state with the blocks, generated when the state is loaded, and the trace of the generators
+type generatedBranch struct {
+	branch *OTree
+	trace  *CompileTrace
+}
+
+// Frame of the compile chain: a state and its block, which refers to another state
+type compileFrame struct {
+	stateid string
+	block   string
+}
+
 func NewNstCompiler() *NstCompiler {
 	nstc := new(NstCompiler)
 	nstc.tree = nil
 	nstc._states = make(map[string]*OTree)
+	nstc._sources = make(map[string]string)
+	nstc._versions = make(map[string]string)
+	nstc._keys = make(map[string][]string)
+	nstc._latest = make(map[string]string)
 	nstc._unresolved = NewRefList()
 	nstc._functions = NewCDLFunc()
+	nstc._generated = make(map[string]*generatedBranch)
+	nstc._trace = NewCompileTrace()
 	nstc._debug = false
 
 	return nstc
 }
 
-// LoadFile loads a nanostate from the YAML file
+// LoadFile loads a nanostate from the YAML file, or from the Starlark file with suffix ".star"
 func (nstc *NstCompiler) LoadFile(nstpath string) error {
-	var err error
+	if strings.HasSuffix(nstpath, ".star") {
+		data, err := ioutil.ReadFile(nstpath)
+		if err != nil {
+			return &CompileError{Source: nstpath, Cause: err}
+		}
+		return nstc.loadStar(nstpath, data)
+	}
 	if !strings.HasSuffix(nstpath, ".st") { // This is not a storage file from IBM's Lotus Domino :-)
-		err = errors.New("State file should have suffix \".st\"")
-	} else {
-		fh, err := os.Open(nstpath)
-		if err == nil {
-			defer fh.Close()
-			data, err := ioutil.ReadAll(fh)
-			if err == nil {
-				id, err := nstc.loadBytes(data)
-				nstc.loadStarlarkFile(id, strings.TrimSuffix(nstpath, ".st")+".fn")
-				return err
-			}
+		return &CompileError{Source: nstpath, Cause: errors.New("State file should have suffix \".st\" or \".star\"")}
+	}
+
+	data, err := ioutil.ReadFile(nstpath)
+	if err != nil {
+		return &CompileError{Source: nstpath, Cause: err}
+	}
+
+	fnpath := strings.TrimSuffix(nstpath, ".st") + ".fn"
+	var functions []byte
+	nfo, err := os.Stat(fnpath)
+	if err == nil && nfo.Mode().IsRegular() {
+		if functions, err = ioutil.ReadFile(fnpath); err != nil {
+			return &CompileError{Source: fnpath, Cause: err}
+		}
+	}
+
+	return nstc.loadSources(nstpath, data, fnpath, functions)
+}
+
+// LoadFS loads a nanostate from the YAML file of the given file system.
+// Functions are loaded from the ".fn" file next to it, if there is one.
+func (nstc *NstCompiler) LoadFS(fsys fs.FS, nstpath string) error {
+	if strings.HasSuffix(nstpath, ".star") {
+		data, err := fs.ReadFile(fsys, nstpath)
+		if err != nil {
+			return &CompileError{Source: nstpath, Cause: err}
 		}
+		return nstc.loadStar(nstpath, data)
+	}
+	if !strings.HasSuffix(nstpath, ".st") {
+		return &CompileError{Source: nstpath, Cause: errors.New("State file should have suffix \".st\" or \".star\"")}
 	}
 
-	return err
+	data, err := fs.ReadFile(fsys, nstpath)
+	if err != nil {
+		return &CompileError{Source: nstpath, Cause: err}
+	}
+
+	fnpath := strings.TrimSuffix(nstpath, ".st") + ".fn"
+	var functions []byte
+	nfo, err := fs.Stat(fsys, fnpath)
+	if err == nil && nfo.Mode().IsRegular() {
+		if functions, err = fs.ReadFile(fsys, fnpath); err != nil {
+			return &CompileError{Source: fnpath, Cause: err}
+		}
+	}
+
+	return nstc.loadSources(nstpath, data, fnpath, functions)
+}
+
+// LoadSource loads a nanostate from the memory. The id names the source in
+// the diagnostics instead of a file path, e.g. a key in a database.
+// Functions are optional and can be nil.
+func (nstc *NstCompiler) LoadSource(id string, state []byte, functions []byte) error {
+	return nstc.loadSources(id, state, id+".fn", functions)
 }
 
-// SetDebug state
+// SetDebug state. Events of the trace are logged as they happen.
 func (nstc *NstCompiler) SetDebug(state bool) *NstCompiler {
 	nstc._debug = state
 	return nstc
 }
 
-// Load starlark file. This is optional step, since the file is also optional.
-func (nstc *NstCompiler) loadStarlarkFile(id string, srcpath string) {
-	nfo, err := os.Stat(srcpath)
-	if err == nil && nfo.Mode().IsRegular() {
-		nstc._functions.ImportSource(id, srcpath)
+// SetRootState of the loaded states, from which the tree is compiled.
+// By default it is the first state of the first loaded source.
+func (nstc *NstCompiler) SetRootState(key string) *NstCompiler {
+	nstc.rootStateId = key
+	return nstc
+}
+
+// SetData of the host, which is accessible to all the states as "data".
+// Generators run as soon as the functions of their state are imported, so data,
+// that they use, should be set before the states are loaded. Blocks, generated
+// before the data is set, are generated again by the compilation.
+func (nstc *NstCompiler) SetData(data *OTree) error {
+	nstc._generated = make(map[string]*generatedBranch)
+	return nstc._functions.SetData(data)
+}
+
+// LoadStarSource loads a nanostate, written in Starlark, from the memory.
+// The id names the source in the diagnostics.
+func (nstc *NstCompiler) LoadStarSource(id string, src []byte) error {
+	return nstc.loadStar(id, src)
+}
+
+// Load Starlark state, which script is also its functions
+func (nstc *NstCompiler) loadStar(srcpath string, src []byte) error {
+	state, err := nstc._functions.DefineState(srcpath, src)
+	if err != nil {
+		pos, cause := starErrorPosition(srcpath, err)
+		return &CompileError{Source: srcpath, Position: pos, Cause: cause}
 	}
+	key, err := nstc.loadTree(srcpath, state)
+	nstc._requested = ""
+	if err != nil {
+		return err
+	}
+	if err := nstc._functions.ImportStar(key, srcpath, src); err != nil {
+		return &CompileError{StateId: key, Source: srcpath, Cause: err}
+	}
+	return nstc.findGeneratedRefs(key)
 }
 
-// Load bytes of the state
-func (nstc *NstCompiler) loadBytes(src []byte) (string, error) {
-	var data yaml.MapSlice
-	var err error
-	if err := yaml.Unmarshal(src, &data); err != nil {
-		panic(err)
+// Load states and their functions, if any. Functions are shared by all the states of the source.
+func (nstc *NstCompiler) loadSources(srcpath string, src []byte, fnpath string, functions []byte) error {
+	keys, err := nstc.loadBytes(srcpath, src)
+	if err != nil {
+		return err
 	}
-	state := NewOTree().LoadMapSlice(data)
 
-	if state.Exists("id") {
-		if nstc.rootStateId == "" {
-			nstc.rootStateId = state.GetString("id")
+	if functions != nil {
+		for _, key := range keys {
+			if err := nstc._functions.ImportBytes(key, fnpath, functions); err != nil {
+				return &CompileError{StateId: key, Source: fnpath, Cause: err}
+			}
+			if err := nstc.findGeneratedRefs(key); err != nil {
+				return err
+			}
 		}
-		nstc._states[state.GetString("id")] = state
-	} else {
-		err = fmt.Errorf("%s", "State has no ID")
 	}
+	return nil
+}
 
-	nstc._unresolved.FindRefs(state)
-	nstc._unresolved.MarkStateResolved(state.GetString("id"))
+// Load bytes of the states, one per YAML document. Returns the keys of the states in their order.
+// The first state of the first source is the root state.
+func (nstc *NstCompiler) loadBytes(srcpath string, src []byte) ([]string, error) {
+	keys := make([]string, 0)
+	loaded := make(map[string]bool)
+	decoder := yaml.NewDecoder(bytes.NewReader(src))
+	for {
+		var data yaml.Node
+		if err := decoder.Decode(&data); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, &CompileError{Source: srcpath, Cause: err}
+		}
+		if data.Kind == 0 || len(data.Content) == 0 || data.Content[0].Tag == "!!null" {
+			continue // Empty document
+		}
+		key, err := nstc.loadDocument(srcpath, &data)
+		if err != nil {
+			return nil, err
+		}
+		if loaded[key] {
+			return nil, &CompileError{StateId: key, Source: srcpath, Position: nstc._states[key].Origin(),
+				Cause: fmt.Errorf("State '%s' is defined several times", key)}
+		}
+		loaded[key] = true
+		keys = append(keys, key)
+	}
+	nstc._requested = ""
+	if len(keys) == 0 {
+		return nil, &CompileError{Source: srcpath, Cause: errors.New("State is empty")}
+	}
+	return keys, nil
+}
+
+// Load the YAML document of the state. Returns the key of the state.
+func (nstc *NstCompiler) loadDocument(srcpath string, data *yaml.Node) (string, error) {
+	state, err := NewOTree().LoadNode(data, srcpath)
+	if err != nil {
+		return "", &CompileError{Source: srcpath, Cause: err}
+	}
+	if version, ok := scalarText(data, "version"); ok {
+		state.Set("version", version)
+	}
+	return nstc.loadTree(srcpath, state)
+}
 
-	return state.GetString("id"), err
+// Text of the scalar of the key in the YAML document as it is written, so the version
+// "1.10" is not the number 1.1
+func scalarText(doc *yaml.Node, key string) (string, bool) {
+	node := doc
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		return "", false
+	}
+	for idx := 0; idx+1 < len(node.Content); idx += 2 {
+		if value := node.Content[idx+1]; node.Content[idx].Value == key && value.Kind == yaml.ScalarNode && value.Tag != "!!null" {
+			return value.Value, true
+		}
+	}
+	return "", false
+}
+
+// Load the tree of the state. Returns the key of the state.
+func (nstc *NstCompiler) loadTree(srcpath string, state *OTree) (string, error) {
+
+	id := state.GetString("id")
+	if id == "" {
+		return "", &CompileError{Source: srcpath, Position: state.Origin(), Cause: errors.New("State has no ID")}
+	}
+	var version string
+	if state.Exists("version") {
+		version = fmt.Sprint(state.Get("version", ""))
+		if _, err := ParseVersionConstraint(version); err != nil || strings.ContainsAny(version, "@/<>=!") {
+			return "", &CompileError{StateId: id, Source: srcpath, Position: state.KeyPosition("version"),
+				Cause: fmt.Errorf("State has invalid version '%s'", version)}
+		}
+	}
+	key := StateRef(id, version)
+	if state.GetBranch("state") == nil {
+		return "", &CompileError{StateId: key, Source: srcpath, Position: state.Origin(),
+			Cause: errors.New("State has no 'state' section")}
+	}
+
+	if state.Exists("vars") {
+		vars, ok := state.Get("vars", nil).(*OTree)
+		if !ok {
+			return "", &CompileError{StateId: key, Source: srcpath, Position: state.KeyPosition("vars"),
+				Cause: errors.New("State 'vars' section should be a mapping")}
+		}
+		if err := nstc._functions.SetVars(key, vars); err != nil {
+			return "", &CompileError{StateId: key, Source: srcpath, Position: state.KeyPosition("vars"), Cause: err}
+		}
+	}
+
+	if state.Exists("params") {
+		params, ok := state.Get("params", nil).(*OTree)
+		if !ok {
+			return "", &CompileError{StateId: key, Source: srcpath, Position: state.KeyPosition("params"),
+				Cause: errors.New("State 'params' section should be a mapping")}
+		}
+		if err := nstc._functions.SetParams(key, params); err != nil {
+			return "", &CompileError{StateId: key, Source: srcpath, Position: state.KeyPosition("params"), Cause: err}
+		}
+	}
+
+	if err := nstc._unresolved.FindRefs(state); err != nil {
+		if ce, ok := err.(*CompileError); ok {
+			ce.Source = srcpath
+			return "", ce
+		}
+		return "", &CompileError{StateId: key, Source: srcpath, Cause: err}
+	}
+
+	if nstc.rootStateId == "" {
+		nstc.rootStateId = key
+	}
+	if _, ex := nstc._states[key]; !ex {
+		nstc._keys[id] = append(nstc._keys[id], key)
+	}
+	nstc._states[key] = state
+	nstc._sources[key] = srcpath
+	nstc._versions[key] = version
+
+	// State, that is loaded not by a pinned reference, is the one to be used without a pin
+	if reqid, constraint := ParseStateRef(nstc._requested); reqid != id || constraint == "" {
+		nstc._latest[id] = key
+	}
+
+	nstc.markLoaded()
+	return key, nil
+}
+
+// States, that are already loaded, are not requested again
+func (nstc *NstCompiler) markLoaded() {
+	for _, included := range nstc._unresolved.GetIncluded() {
+		if _, ex := nstc.resolveState(ParseStateRef(included)); ex {
+			nstc._unresolved.MarkStateResolved(included)
+		}
+	}
+}
+
+// Find references of the blocks, generated by the state, so the states they refer to
+// are loaded as of the written blocks. Generators are run with the default parameters of the state,
+// and the generated blocks are kept for the compilation, so the generators run only once.
+func (nstc *NstCompiler) findGeneratedRefs(key string) error {
+	trace, debug := nstc._trace, nstc._debug
+	nstc._trace, nstc._debug = NewCompileTrace(), false
+	branch := nstc._states[key].GetBranch("state")
+	expanded, err := nstc.expandGenerators(key, branch)
+	nstc._trace, nstc._debug, trace = trace, debug, nstc._trace
+	if err != nil {
+		return err
+	}
+	nstc._generated[key] = &generatedBranch{branch: expanded, trace: trace}
+
+	generated := NewOTree()
+	for _, block := range expanded.Keys() {
+		if !branch.Exists(block) {
+			generated.SetFrom(block, expanded, block)
+		}
+	}
+	if err := nstc._unresolved.FindRefs(NewOTree().Set("id", key).Set("state", generated)); err != nil {
+		return err
+	}
+	nstc.markLoaded()
+	return nil
+}
+
+// Instance of the loaded state with the parameters. Returns the key of the instance,
+// which is the state key with the parameters, sorted by their names.
+func (nstc *NstCompiler) instantiate(refid string, params []*CDLArgument) (string, error) {
+	if len(params) == 0 {
+		return refid, nil
+	}
+	args := make([]*CDLArgument, len(params))
+	copy(args, params)
+	sort.Slice(args, func(i, j int) bool { return args[i].Name < args[j].Name })
+	instance := (&CDLCall{Function: refid, Arguments: args}).String()
+	if _, ex := nstc._states[instance]; ex {
+		return instance, nil
+	}
+
+	if err := nstc._functions.Instance(refid, instance, args); err != nil {
+		return "", err
+	}
+	nstc._states[instance] = nstc._states[refid]
+	nstc._sources[instance] = nstc._sources[refid]
+	nstc._versions[instance] = nstc._versions[refid]
+	return instance, nil
+}
+
+// Key of the loaded state by its ID and the version constraint.
+// Without the constraint it is the state, which was loaded without a version pin,
+// otherwise the highest loaded version, that matches the constraint.
+func (nstc *NstCompiler) resolveState(stateid string, version string) (string, bool) {
+	if version == "" {
+		if key, ex := nstc._latest[stateid]; ex {
+			return key, true
+		}
+		return "", false
+	}
+
+	constraint, err := ParseVersionConstraint(version)
+	if err != nil {
+		return "", false
+	}
+	found := ""
+	for _, key := range nstc._keys[stateid] {
+		if constraint.Match(nstc._versions[key]) && (found == "" || CompareVersions(nstc._versions[key], nstc._versions[found]) > 0) {
+			found = key
+		}
+	}
+	return found, found != ""
 }
 
 // Cycle compiles current state and returns a next state Id to be found and loaded, if any.
 // If returns an empty string, then no more cycles are found and Tree is ready.
-func (nstc *NstCompiler) Cycle() string {
+// State Id can be pinned to a version constraint as "<ID>@<CONSTRAINT>", see ParseStateRef.
+func (nstc *NstCompiler) Cycle() (string, error) {
 	// Resolve includes
 	for _, id := range nstc._unresolved.GetIncluded() {
-		return nstc._unresolved.MarkStateRequested(id)
+		id, err := nstc._unresolved.MarkStateRequested(id)
+		if err != nil {
+			return "", &CompileError{StateId: id, Cause: err}
+		}
+		nstc._requested = id
+		return id, nil
 	}
-	return ""
+	return "", nil
 }
 
 func (nstc *NstCompiler) SquashState(id string) {
@@ -123,177 +487,654 @@ func (nstc *NstCompiler) Compile() error {
 }
 
 func (nstc *NstCompiler) Dump() {
-	spew.Dump(nstc.Tree())
+	tree, err := nstc.Tree()
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err.Error())
+		return
+	}
+	spew.Dump(tree)
 }
 
 // Tree returns completed tree
-func (nstc *NstCompiler) Tree() *OTree {
+func (nstc *NstCompiler) Tree() (*OTree, error) {
 	mandatory := nstc._unresolved.GetMandatoryUnresolved()
 	if len(mandatory) > 0 {
-		panic(fmt.Sprintf("Calling for compiled tree when unresolved sources are still pending: %s", strings.Join(mandatory, ", ")))
+		return nil, &CompileError{StateId: nstc.rootStateId, Source: nstc._sources[nstc.rootStateId],
+			Cause: fmt.Errorf("Calling for compiled tree when unresolved sources are still pending: %s", strings.Join(mandatory, ", "))}
 	}
 
-	nstc.Compile()
+	if err := nstc.Compile(); err != nil {
+		return nil, err
+	}
 
-	return nstc.tree
+	return nstc.tree, nil
 }
 
-// Print problematic source part
-func (nstc *NstCompiler) traceSource(state *OTree, msg string, args ...interface{}) {
-	fmt.Printf("ERROR: %s\n", fmt.Sprintf(msg, args...))
-	fmt.Println(state.ToYAML())
-	fmt.Println("---")
+// Graph returns the graph of the blocks of the completed tree
+func (nstc *NstCompiler) Graph() (*BlockGraph, error) {
+	if _, err := nstc.Tree(); err != nil {
+		return nil, err
+	}
+	return nstc.graph, nil
 }
 
-// Compile inclusion
-func (nstc *NstCompiler) compileInclusion(stateid string, target *OTree, block string) {
-	// Fetch that inclusion, compile it here
-	inclusion, _ := nstc._functions.GetInclusion(stateid, block)
-	if _, ex := nstc._states[inclusion.Stateid]; !ex {
-		for _, optinal := range nstc._unresolved.optional {
-			if inclusion.Stateid == optinal {
-				fmt.Printf("Optional state %s was not found. Skipping.\n", inclusion.Stateid)
-				return
-			}
+// Trace returns decisions of the compiler. It is complete after the tree
+// is compiled, and ends with the last decision if the compilation failed.
+func (nstc *NstCompiler) Trace() *CompileTrace {
+	return nstc._trace
+}
+
+// Add event of the block to the trace. Event without a position is at the block definition.
+func (nstc *NstCompiler) traceEvent(stateid string, blockdef string, event *TraceEvent) {
+	event.StateId = stateid
+	event.Block = blockdef
+	if expr, err := ParseCDL(blockdef); err == nil && expr.Name != "" {
+		event.Block = expr.Name
+	}
+	if event.Position == nil {
+		event.Position = nstc.blockPosition(stateid, blockdef)
+	}
+	nstc.addTraceEvent(event)
+}
+
+// Add complete event to the trace
+func (nstc *NstCompiler) addTraceEvent(event *TraceEvent) {
+	nstc._trace.Add(event)
+	if nstc._debug {
+		logger.Debugf("Trace: %s", event)
+	}
+}
+
+// Position of the block definition in the state source
+func (nstc *NstCompiler) blockPosition(stateid string, block string) *Position {
+	if branch, ex := nstc._branches[stateid]; ex {
+		return branch.KeyPosition(block)
+	}
+	if state, ex := nstc._states[stateid]; ex {
+		if branch := state.GetBranch("state"); branch != nil {
+			return branch.KeyPosition(block)
 		}
-		panic(fmt.Errorf("Cannot include state '%s': not found", inclusion.Stateid))
 	}
+	return nil
+}
 
-	// Pre-compile branch
-	includedState := nstc.compileState(nstc._states[inclusion.Stateid])
+// Wrap an error into the compile error of the state and its block.
+// Errors that are already compile errors are passed as is, because they know better their origin.
+func (nstc *NstCompiler) compileError(stateid string, block string, cause error) error {
+	return nstc.compileErrorAt(stateid, block, block, nstc.blockPosition(stateid, block), cause)
+}
 
-	// Include specific blocks
-	if len(inclusion.Blocks) > 0 {
-		for _, refBlock := range inclusion.Blocks {
-			rb := includedState.Get(refBlock, nil)
-			if rb != nil {
-				target.Set(refBlock, rb)
-			} else {
-				if nstc._debug {
-					nstc.traceSource(includedState, "Skipped reference '%s' by '%s' in the source", refBlock, block)
-				}
+// Wrap an error into the compile error of the state, its block and exact directive inside it.
+func (nstc *NstCompiler) compileErrorAt(stateid string, block string, directive string, pos *Position, cause error) error {
+	if ce, ok := cause.(*CompileError); ok {
+		return ce
+	}
+
+	name := block
+	if expr, err := ParseCDL(block); err == nil {
+		name = expr.Name
+	}
+
+	return &CompileError{
+		StateId:   stateid,
+		Block:     name,
+		Source:    nstc._sources[stateid],
+		Position:  causePosition(pos, cause),
+		Directive: directive,
+		Cause:     cause,
+	}
+}
+
+// Compile inclusions. Included blocks keep their names.
+func (nstc *NstCompiler) compileInclusion(stateid string, graph *BlockGraph, block string, expr *CDLExpr) error {
+	for _, inclusion := range expr.Inclusions {
+		// Fetch that inclusion, compile it here
+		refid, ex := nstc.resolveState(inclusion.Stateid, inclusion.Version)
+		if !ex {
+			ref := StateRef(inclusion.Stateid, inclusion.Version)
+			if inclusion.Optional {
+				nstc.traceEvent(stateid, block, &TraceEvent{Kind: TRACE_INCLUDE, Target: inclusion.String(), Outcome: TRACE_SKIPPED,
+					Message: "not found"})
+				continue
 			}
+			nstc.traceEvent(stateid, block, &TraceEvent{Kind: TRACE_INCLUDE, Target: inclusion.String(), Outcome: TRACE_MISSING,
+				Message: "not found"})
+			return nstc.compileError(stateid, block, fmt.Errorf("Cannot include state '%s': not found", ref))
 		}
-	} else {
-		// Include the entire state content
-		for _, refBlock := range includedState.Keys() {
-			rb := includedState.Get(refBlock, nil)
-			if rb != nil {
-				target.Set(refBlock, rb)
-			} else {
-				nstc.traceSource(includedState, "Could not find reference '%s' called by '%s' in the source", refBlock, block)
+		refid, err := nstc.instantiate(refid, inclusion.Params)
+		if err != nil {
+			return nstc.compileError(stateid, block, err)
+		}
+
+		// Pre-compile branch without the excluded blocks
+		includedState, err := nstc.compileReferenced(stateid, block, refid, inclusion.Exclude)
+		if err != nil {
+			return err
+		}
+
+		// Include specific blocks
+		included := make([]string, 0)
+		if len(inclusion.Blocks) > 0 {
+			for _, refBlock := range inclusion.Blocks {
+				if node := includedState.NodeByKey(refBlock); node != nil {
+					included = append(included, graph.merge(includedState, node.Id, refBlock).Key)
+				} else {
+					nstc.traceEvent(stateid, block, &TraceEvent{Kind: TRACE_INCLUDE, Target: inclusion.String(), Outcome: TRACE_SKIPPED,
+						Blocks: []string{refBlock}, Message: "no such block"})
+				}
+			}
+		} else {
+			// Include the entire state content, except the excluded blocks
+			except := make(map[string]bool)
+			for _, refBlock := range inclusion.Exclude {
+				if node := includedState.NodeByKey(refBlock); node != nil {
+					except[node.Id] = true
+				}
+			}
+			if len(inclusion.Exclude) > 0 {
+				nstc.traceEvent(stateid, block, &TraceEvent{Kind: TRACE_INCLUDE, Target: inclusion.String(), Outcome: TRACE_EXCLUDED,
+					Blocks: inclusion.Exclude})
+			}
+			for _, node := range includedState.Nodes() {
+				if !except[node.Id] {
+					included = append(included, graph.mergeExcept(includedState, node.Id, node.Key, except).Key)
+				}
 			}
 		}
+		nstc.traceEvent(stateid, block, &TraceEvent{Kind: TRACE_INCLUDE, Target: inclusion.String(), Outcome: TRACE_RESOLVED,
+			Blocks: included})
 	}
+
+	return nil
 }
 
-// Compile dependency
-func (nstc *NstCompiler) compileDependency(stateid string, branch *OTree, target *OTree, block string) {
-	dependency, err := nstc._functions.GetDependency(stateid, block)
+// Compile dependency. The anchor block requires all blocks of the dependencies
+// in the order they are declared. Blocks, that are pulled only by the dependencies,
+// are named by their ID.
+func (nstc *NstCompiler) compileDependency(stateid string, branch *OTree, graph *BlockGraph, block string, expr *CDLExpr) error {
+	refids := make([]string, 0, len(expr.Dependencies))
+	for _, dependency := range expr.Dependencies {
+		refid, ex := nstc.resolveState(dependency.Stateid, dependency.Version)
+		if !ex {
+			nstc.traceEvent(stateid, block, &TraceEvent{Kind: TRACE_DEPENDENCY, Target: dependency.String(), Outcome: TRACE_MISSING,
+				Message: "not found"})
+			return nstc.compileError(stateid, block, fmt.Errorf("Cannot depend on a state '%s': not found",
+				StateRef(dependency.Stateid, dependency.Version)))
+		}
+		refid, err := nstc.instantiate(refid, dependency.Params)
+		if err != nil {
+			return nstc.compileError(stateid, block, err)
+		}
+		refids = append(refids, refid)
+	}
+
+	currBlock, currPositions, err := nstc.compileBlock(stateid, branch, block)
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
-	if _, ex := nstc._states[dependency.Stateid]; !ex {
-		panic(fmt.Errorf("Cannot depend on a state '%s': not found", dependency.Stateid))
+
+	anchor := &BlockNode{
+		StateId:   stateid,
+		Block:     expr.Dependencies[0].AnchorBlock,
+		Requires:  make([]string, 0),
+		jobs:      currBlock,
+		positions: currPositions,
+		position:  nstc.blockPosition(stateid, block),
 	}
+	anchor.Id = BlockId(stateid, anchor.Block)
+	anchor.Key = anchor.Block
 
-	currBlock := branch.Get(block, nil)
-	depsBlock := make([]interface{}, 0)
-	if currBlock == nil {
-		nstc.traceSource(branch, "Could not find reference '%s' called by '%s' in the source", block, stateid)
+	for idx, dependency := range expr.Dependencies {
+		dependedOnState, err := nstc.compileReferenced(stateid, block, refids[idx], nil)
+		if err != nil {
+			return err
+		}
+		pulled := make([]string, 0)
+		for _, refBlock := range dependency.Blocks {
+			node := dependedOnState.NodeByKey(refBlock)
+			if node == nil {
+				nstc.traceEvent(stateid, block, &TraceEvent{Kind: TRACE_DEPENDENCY, Target: dependency.String(), Outcome: TRACE_SKIPPED,
+					Blocks: []string{refBlock}, Message: "no such block"})
+				continue
+			}
+			merged := graph.merge(dependedOnState, node.Id, node.Id)
+			pulled = append(pulled, merged.Key)
+			anchor.require(merged.Id)
+		}
+		nstc.traceEvent(stateid, block, &TraceEvent{Kind: TRACE_DEPENDENCY, Target: dependency.String(), Outcome: TRACE_RESOLVED,
+			Blocks: pulled})
 	}
+	graph.addNode(anchor)
 
-	dependedOnState := nstc.compileState(nstc._states[dependency.Stateid])
-	for _, refBlock := range dependency.Blocks {
-		rb := dependedOnState.Get(refBlock, nil)
-		if rb != nil {
-			depsBlock = append(append(depsBlock, rb.([]interface{})...), currBlock.([]interface{})...)
-		} else {
-			depsBlock = append(depsBlock, currBlock.([]interface{})...)
-			if nstc._debug {
-				nstc.traceSource(dependedOnState, "Could not find dependency state '%s' called by '%s' in the source", refBlock, block)
+	return nil
+}
+
+// Compile branch of the state, referenced by the block of another state, without the excluded blocks.
+// State, which is already being compiled, is a cycle of references.
+// Each state is compiled only once per compilation with the same exclusions, so its conditions and
+// loops are called once as well. Callers should copy what they take from it.
+func (nstc *NstCompiler) compileReferenced(stateid string, block string, refid string, exclude []string) (*BlockGraph, error) {
+	for idx, frame := range nstc._chain {
+		if frame.stateid != refid {
+			continue
+		}
+		chain := make([]string, 0)
+		for _, link := range nstc._chain[idx:] {
+			if link.block != "" {
+				chain = append(chain, link.stateid+"/"+link.block)
+			} else {
+				chain = append(chain, link.stateid)
 			}
 		}
+		return nil, nstc.compileError(stateid, block, &CycleError{Chain: append(chain, refid)})
+	}
+
+	key := refid
+	if len(exclude) > 0 {
+		except := make([]string, len(exclude))
+		copy(except, exclude)
+		sort.Strings(except)
+		key += "/!" + strings.Join(except, ":!")
+	}
+	if compiled, ex := nstc._compiled[key]; ex {
+		return compiled, nil
 	}
-	// Reference, compile it here
-	target.Set(dependency.AnchorBlock, depsBlock)
+	compiled, err := nstc.compileState(refid, exclude)
+	if err != nil {
+		return nil, err
+	}
+	nstc._compiled[key] = compiled
+	return compiled, nil
 }
 
-// Compile branch of the state
-func (nstc *NstCompiler) compileState(state *OTree) *OTree {
-	tree := NewOTree()
+// Compile branch of the state into the graph of its blocks. Excluded blocks are skipped
+// before their conditions, loops and templates are evaluated.
+// Blocks of the versioned states are identified by the state key, e.g. "pgsql@13/install".
+func (nstc *NstCompiler) compileState(stateid string, exclude []string) (*BlockGraph, error) {
+	graph := NewBlockGraph()
+	excluded := make(map[string]bool)
+	for _, name := range exclude {
+		excluded[name] = true
+	}
+	state := nstc._states[stateid]
 
-	branch := state.GetBranch("state")
+	frame := &compileFrame{stateid: stateid}
+	nstc._chain = append(nstc._chain, frame)
+	defer func() { nstc._chain = nstc._chain[:len(nstc._chain)-1] }()
+
+	branch, err := nstc.generatedBranch(stateid, state.GetBranch("state"))
+	if err != nil {
+		return nil, err
+	}
+	nstc._branches[stateid] = branch
+	requisites := make(map[string]*CDLExpr)
 	for _, _blockdef := range branch.Keys() {
 		blockdef := _blockdef.(string)
-		if !nstc._functions.Condition(state.GetString("id"), blockdef) {
-			// The block definition did not pass the function condition
+		expr, err := ParseCDL(blockdef)
+		if err != nil {
+			return nil, nstc.compileError(stateid, blockdef, err)
+		}
+		if expr.Name != "" && excluded[expr.Name] {
 			continue
 		}
 
-		blocktype, err := nstc._functions.BlockType(state.GetString("id"), blockdef)
+		passed, err := nstc._functions.Condition(stateid, expr)
 		if err != nil {
-			panic(err.Error())
+			return nil, nstc.compileError(stateid, blockdef, err)
+		}
+		if expr.Condition != nil {
+			outcome := TRACE_PASSED
+			if !passed {
+				outcome = TRACE_FAILED
+			}
+			nstc.traceEvent(stateid, blockdef, &TraceEvent{Kind: TRACE_CONDITION, Target: expr.Condition.String(), Outcome: outcome})
 		}
+		if !passed {
+			// The block definition did not pass the function condition
+			continue
+		}
+		frame.block = expr.Name
 
-		switch blocktype {
+		switch expr.Type() {
 		case CDL_T_INCLUSION, CDL_T_OPTIONAL_INCLUSION:
-			nstc.compileInclusion(state.GetString("id"), tree, blockdef)
+			err = nstc.compileInclusion(stateid, graph, blockdef, expr)
 		case CDL_T_DEPENDENCY:
-			nstc.compileDependency(state.GetString("id"), branch, tree, blockdef)
+			err = nstc.compileDependency(stateid, branch, graph, blockdef, expr)
 		default:
-			tree.Set(nstc._functions.ToCDLKey(state.GetString("id"), blockdef),
-				nstc.compileBlock(state.GetString("id"), branch.Get(_blockdef, nil)))
+			var section []interface{}
+			var positions []*Position
+			section, positions, err = nstc.compileBlock(stateid, branch, blockdef)
+			if err == nil {
+				graph.addNode(&BlockNode{
+					Id:        BlockId(stateid, expr.Name),
+					StateId:   stateid,
+					Block:     expr.Name,
+					Key:       expr.Name,
+					Requires:  make([]string, 0),
+					jobs:      section,
+					positions: positions,
+					position:  branch.KeyPosition(blockdef),
+				})
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(expr.Requisites) > 0 {
+			requisites[blockdef] = expr
+		}
+	}
+
+	// Requisites can refer to any block of the state, so they are resolved at the end
+	for _, _blockdef := range branch.Keys() {
+		if expr, ex := requisites[_blockdef.(string)]; ex {
+			if err := nstc.compileRequisites(stateid, branch, graph, _blockdef.(string), expr); err != nil {
+				return nil, err
+			}
 		}
 	}
-	return tree
+	return graph, nil
 }
 
-// Block compilation
-func (nstc *NstCompiler) compileBlock(stateid string, block interface{}) []interface{} {
+// Branch of the state with the generated blocks. Blocks, generated when the state was loaded,
+// are taken with the trace of their generators, otherwise the generators are run now.
+func (nstc *NstCompiler) generatedBranch(stateid string, branch *OTree) (*OTree, error) {
+	generated, ex := nstc._generated[stateid]
+	if !ex {
+		return nstc.expandGenerators(stateid, branch)
+	}
+	for _, event := range generated.trace.Events {
+		nstc.addTraceEvent(event)
+	}
+	return generated.branch, nil
+}
+
+// Branch of the state, where the generators are replaced with the blocks they generate.
+// Generated blocks are at the position of their generator.
+func (nstc *NstCompiler) expandGenerators(stateid string, branch *OTree) (*OTree, error) {
+	out := NewOTree().SetOrigin(branch.Origin())
+	for _, _blockdef := range branch.Keys() {
+		blockdef, ok := _blockdef.(string)
+		expr, err := ParseCDL(blockdef)
+		if !ok || err != nil || expr.Loop == nil {
+			out.SetFrom(_blockdef, branch, _blockdef) // Errors are reported by the compilation
+			continue
+		}
+		if expr.Name != "" {
+			return nil, nstc.compileError(stateid, blockdef,
+				fmt.Errorf("Generator '[]%s' cannot have a name, its blocks are named by the function", expr.Loop.Function))
+		}
+		if modules := branch.Get(_blockdef, nil); modules != nil {
+			return nil, nstc.compileError(stateid, blockdef,
+				fmt.Errorf("Generator '[]%s' cannot have modules, they are returned by the function", expr.Loop.Function))
+		}
+
+		passed, err := nstc._functions.Condition(stateid, expr)
+		if err != nil {
+			return nil, nstc.compileError(stateid, blockdef, err)
+		}
+		if expr.Condition != nil {
+			outcome := TRACE_PASSED
+			if !passed {
+				outcome = TRACE_FAILED
+			}
+			nstc.traceEvent(stateid, blockdef, &TraceEvent{Kind: TRACE_CONDITION, Target: expr.Condition.String(), Outcome: outcome})
+		}
+		if !passed {
+			continue
+		}
+
+		blocks, err := nstc._functions.Generate(stateid, expr)
+		if err != nil {
+			return nil, nstc.compileError(stateid, blockdef, err)
+		}
+		pos := branch.KeyPosition(_blockdef)
+		names := make([]string, 0, len(blocks))
+		for _, block := range blocks {
+			generated, err := ParseCDL(block.Id)
+			if err != nil {
+				return nil, nstc.compileError(stateid, blockdef, fmt.Errorf("Generated block '%s' is invalid: %s", block.Id, err.Error()))
+			}
+			if generated.Loop != nil {
+				return nil, nstc.compileError(stateid, blockdef, fmt.Errorf("Generated block '%s' cannot be a generator", block.Id))
+			}
+			if branch.Exists(block.Id) || out.Exists(block.Id) {
+				return nil, nstc.compileError(stateid, blockdef, fmt.Errorf("Generated block '%s' is already defined", block.Id))
+			}
+			positions := make([]*Position, len(block.Modules))
+			for idx := range positions {
+				positions[idx] = pos
+			}
+			var modules interface{}
+			if block.Modules != nil {
+				modules = block.Modules
+			}
+			out.Set(block.Id, modules).SetKeyPosition(block.Id, pos).SetElementPositions(block.Id, positions)
+			names = append(names, block.Id)
+		}
+		nstc.traceEvent(stateid, blockdef, &TraceEvent{Kind: TRACE_GENERATOR, Target: blockdef, Outcome: TRACE_EXPANDED,
+			Items: len(blocks), Blocks: names})
+	}
+	return out, nil
+}
+
+// Compile run time requisites of the block. Blocks of the requisites go before
+// the block. Blocks, that are skipped by their conditions, are kept by their ID,
+// so the requisites on them are evaluated as on blocks that were not performed.
+func (nstc *NstCompiler) compileRequisites(stateid string, branch *OTree, graph *BlockGraph, blockdef string, expr *CDLExpr) error {
+	node := graph.Node(BlockId(stateid, expr.Name))
+	for _, requisite := range expr.Requisites {
+		blocks := make([]string, 0, len(requisite.Blocks))
+		for _, name := range requisite.Blocks {
+			target := graph.Node(BlockId(stateid, name))
+			if target == nil {
+				target = graph.NodeByKey(name)
+			}
+			var id string
+			switch {
+			case target != nil:
+				id = target.Id
+				node.require(id)
+			case nstc.definesBlock(branch, name):
+				id = BlockId(stateid, name)
+			default:
+				return nstc.compileError(stateid, blockdef, fmt.Errorf("Requisite '@%s' refers to unknown block '%s'", requisite.Kind, name))
+			}
+			if id == node.Id {
+				return nstc.compileError(stateid, blockdef, fmt.Errorf("Block cannot be its own requisite '@%s'", requisite.Kind))
+			}
+			blocks = append(blocks, id)
+		}
+		node.Requisites = append(node.Requisites, &BlockRequisite{Kind: requisite.Kind, Blocks: blocks})
+	}
+	return nil
+}
+
+// Branch of the state defines the block with the given name
+func (nstc *NstCompiler) definesBlock(branch *OTree, name string) bool {
+	for _, blockdef := range branch.Keys() {
+		if expr, err := ParseCDL(blockdef.(string)); err == nil && expr.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Block compilation. Returns compiled modules of the block and their positions in the source.
+// Every module call is a separate element of the compiled block, loops are expanded in place.
+func (nstc *NstCompiler) compileBlock(stateid string, branch *OTree, blockdef string) ([]interface{}, []*Position, error) {
 	section := make([]interface{}, 0)
-	for _, src := range block.([]interface{}) {
-		dst := NewOTree()
-		for _, mod_ref := range src.(*OTree).Keys() {
-			mod_line := mod_ref.(string)
-			mod_type, _ := nstc._functions.BlockType(stateid, mod_line)
-			if mod_type == CDL_T_LOOP {
-				loopDef, err := nstc._functions.Loop(stateid, mod_line)
+	positions := make([]*Position, 0)
+	modules, ok := branch.Get(blockdef, nil).([]interface{})
+	if !ok {
+		return nil, nil, nstc.compileError(stateid, blockdef, errors.New("Block should be a list of modules"))
+	}
+	written := nstc._states[stateid].GetBranch("state").Exists(blockdef) // Generated blocks are not rendered
+	for idx, src := range modules {
+		srcModule, ok := src.(*OTree)
+		if !ok {
+			return nil, nil, nstc.compileErrorAt(stateid, blockdef, blockdef, branch.ElementPosition(blockdef, idx),
+				fmt.Errorf("Module call '%v' should be a mapping", src))
+		}
+		for _, mod_ref := range srcModule.Keys() {
+			mod_line, ok := mod_ref.(string)
+			if !ok {
+				return nil, nil, nstc.compileErrorAt(stateid, blockdef, blockdef, srcModule.KeyPosition(mod_ref),
+					fmt.Errorf("Module name '%v' should be a string", mod_ref))
+			}
+			mod_expr, err := ParseCDL(mod_line)
+			if err != nil {
+				return nil, nil, nstc.compileErrorAt(stateid, blockdef, mod_line, srcModule.KeyPosition(mod_ref), err)
+			}
+			if (mod_expr.Type() != CDL_T_BLOCK && mod_expr.Type() != CDL_T_LOOP) || mod_expr.Condition != nil ||
+				len(mod_expr.Requisites) > 0 || (mod_expr.Name == "" && mod_expr.Loop == nil) {
+				return nil, nil, nstc.compileErrorAt(stateid, blockdef, mod_line, srcModule.KeyPosition(mod_ref),
+					fmt.Errorf("Module call '%s' can only have a name and a loop", mod_line))
+			}
+
+			// Templates are rendered in the source only, before the loop adds its items
+			module := NewOTree().SetOrigin(srcModule.Origin()).SetFrom(mod_ref, srcModule, mod_ref)
+			if written {
+				args, err := nstc._functions.renderValue(stateid, srcModule.Get(mod_ref, nil))
 				if err != nil {
-					panic(err)
+					return nil, nil, nstc.compileErrorAt(stateid, blockdef, mod_line, srcModule.KeyPosition(mod_ref), err)
 				}
+				module.Set(mod_ref, args)
+			}
 
-				mod_block := make([]interface{}, 0)
-				for _, paramset := range loopDef.Params {
-					modpar := NewOTree()
-					for pk := range paramset {
-						modpar.Set(pk, paramset[pk])
-					}
-					mod_block = append(mod_block, NewOTree().Set(loopDef.Module, modpar))
+			var calls []*OTree
+			if mod_expr.Type() == CDL_T_LOOP {
+				calls, err = nstc.compileLoop(stateid, blockdef, module, mod_ref, mod_expr)
+				if err != nil {
+					return nil, nil, nstc.compileErrorAt(stateid, blockdef, mod_line, srcModule.KeyPosition(mod_ref), err)
 				}
-				return mod_block
 			} else {
-				dst.Set(mod_line, src.(*OTree).Get(mod_ref, nil))
+				calls = []*OTree{NewOTree().SetOrigin(srcModule.Origin()).SetFrom(mod_expr.Name, module, mod_ref)}
+			}
+			for _, call := range calls {
+				section = append(section, call)
+				positions = append(positions, branch.ElementPosition(blockdef, idx))
 			}
 		}
-		section = append(section, dst)
 	}
-	return section
+	return section, positions, nil
 }
 
-// Compile the tree.
+// Expand the loop into module calls, one per module for each set of parameters.
+// Arguments of the module in the source are defaults, which are updated by the parameters.
+func (nstc *NstCompiler) compileLoop(stateid string, blockdef string, srcModule *OTree, mod_ref interface{}, expr *CDLExpr) ([]*OTree, error) {
+	loopDef, err := nstc._functions.Loop(stateid, expr)
+	if err != nil {
+		return nil, err
+	}
+	nstc.traceEvent(stateid, blockdef, &TraceEvent{Kind: TRACE_LOOP, Target: expr.Line, Outcome: TRACE_EXPANDED,
+		Items: len(loopDef.Params), Position: srcModule.KeyPosition(mod_ref)})
+
+	// Modules, fed by the loop
+	feeds := make([]*OTree, 0)
+	if loopDef.Module != "" {
+		feeds = append(feeds, NewOTree().SetFrom(loopDef.Module, srcModule, mod_ref))
+	} else {
+		list, ok := srcModule.Get(mod_ref, nil).([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Loop '[]%s' without a module name should have a list of modules", expr.Loop.Function)
+		}
+		for _, item := range list {
+			mod, ok := item.(*OTree)
+			if !ok || len(mod.Keys()) != 1 {
+				return nil, fmt.Errorf("Loop '[]%s' should have a list of modules with one module per element", expr.Loop.Function)
+			}
+			name, ok := mod.Keys()[0].(string)
+			if inner, err := ParseCDL(name); !ok || err != nil || inner.Type() != CDL_T_BLOCK || inner.Condition != nil || len(inner.Requisites) > 0 {
+				return nil, fmt.Errorf("Loop '[]%s' can only have plain module calls, but got '%v'", expr.Loop.Function, mod.Keys()[0])
+			}
+			feeds = append(feeds, NewOTree().SetFrom(name, mod, name))
+		}
+	}
+
+	calls := make([]*OTree, 0)
+	for _, paramset := range loopDef.Params {
+		for _, feed := range feeds {
+			name := feed.Keys()[0]
+			args := NewOTree().SetOrigin(feed.KeyPosition(name))
+			switch defaults := feed.Get(name, nil).(type) {
+			case nil:
+			case *OTree:
+				for _, key := range defaults.Keys() {
+					args.SetFrom(key, defaults, key)
+				}
+			default:
+				return nil, fmt.Errorf("Arguments of the module '%v' should be a mapping", name)
+			}
+
+			keys := make([]interface{}, 0, len(paramset))
+			for pk := range paramset {
+				keys = append(keys, pk)
+			}
+			sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+			for _, pk := range keys {
+				args.Set(pk, paramset[pk])
+			}
+			calls = append(calls, NewOTree().SetOrigin(srcModule.Origin()).Set(name, args).SetKeyPosition(name, feed.KeyPosition(name)))
+		}
+	}
+	return calls, nil
+}
+
+// Compile the tree. Blocks go in topological order and the "graph" section
+// lists the blocks, that each block requires. Run time requisites of the
+// blocks are in the "requisites" section.
 func (nstc *NstCompiler) compile() error {
+	nstc._trace = NewCompileTrace()
 	rootstate, found := nstc._states[nstc.rootStateId]
 	if !found {
-		panic(fmt.Errorf("Root state as '%s' was not found", nstc.rootStateId))
+		return &CompileError{StateId: nstc.rootStateId, Cause: fmt.Errorf("Root state as '%s' was not found", nstc.rootStateId)}
 	}
-	nstc.tree = NewOTree()
+	tree := NewOTree().SetOrigin(rootstate.Origin())
+	nstc._chain = make([]*compileFrame, 0)
+	nstc._compiled = make(map[string]*BlockGraph)
+	nstc._branches = make(map[string]*OTree)
 
 	// Header
 	for _, id := range []string{"id", "description"} {
-		nstc.tree.Set(id, rootstate.GetString(id))
+		tree.Set(id, rootstate.GetString(id)).SetKeyPosition(id, rootstate.KeyPosition(id))
+	}
+	if version := nstc._versions[nstc.rootStateId]; version != "" {
+		tree.Set("version", version).SetKeyPosition("version", rootstate.KeyPosition("version"))
+	}
+
+	graph, err := nstc.compileState(nstc.rootStateId, nil)
+	if err != nil {
+		return err
+	}
+	nodes, err := graph.Sorted()
+	if err != nil {
+		return &CompileError{StateId: nstc.rootStateId, Source: nstc._sources[nstc.rootStateId], Cause: err}
+	}
+
+	branch := NewOTree().SetOrigin(rootstate.GetBranch("state").Origin())
+	edges := NewOTree()
+	requisites := NewOTree()
+	for _, node := range nodes {
+		branch.Set(node.Key, node.jobs).
+			SetKeyPosition(node.Key, node.position).
+			SetElementPositions(node.Key, node.positions)
+		requires := make([]interface{}, 0)
+		for _, key := range graph.Requires(node.Key) {
+			requires = append(requires, key)
+		}
+		edges.Set(node.Key, requires).SetKeyPosition(node.Key, node.position)
+		if len(node.Requisites) > 0 {
+			requisites.Set(node.Key, graph.Requisites(node.Key)).SetKeyPosition(node.Key, node.position)
+		}
+	}
+
+	nstc.graph = graph
+	nstc.tree = tree.Set("state", branch).SetKeyPosition("state", rootstate.KeyPosition("state")).
+		Set("graph", edges)
+	if len(requisites.Keys()) > 0 {
+		nstc.tree.Set("requisites", requisites)
 	}
 
-	nstc.tree.Set("state", nstc.compileState(rootstate))
 	return nil
 }
@@ -1,19 +1,46 @@
 package nanocms_compiler
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"reflect"
 
-	"github.com/go-yaml/yaml"
+	yamlv2 "github.com/go-yaml/yaml"
+	"gopkg.in/yaml.v3"
 )
 
 /*
 A representation of an object tree, preserving ordering.
+Trees that are loaded from YAML also know where every key
+and every list element came from in the source.
 */
 
 type OTree struct {
 	_data map[interface{}]interface{}
 	_kidx []interface{}
+	_pos  *Position                   // Where the tree itself starts
+	_kpos map[interface{}]*Position   // Where the keys are
+	_epos map[interface{}][]*Position // Where the list elements of the values are
+}
+
+// Position of a key or a list element in the source
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func newPosition(file string, node *yaml.Node) *Position {
+	return &Position{File: file, Line: node.Line, Column: node.Column}
+}
+
+// String representation of the position as "file:line:column"
+func (pos *Position) String() string {
+	if pos == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d:%d", pos.File, pos.Line, pos.Column)
 }
 
 func NewOTree() *OTree {
@@ -24,69 +51,223 @@ func NewOTree() *OTree {
 func (tree *OTree) Flush() *OTree {
 	tree._data = make(map[interface{}]interface{})
 	tree._kidx = make([]interface{}, 0)
+	tree._pos = nil
+	tree._kpos = make(map[interface{}]*Position)
+	tree._epos = make(map[interface{}][]*Position)
 	return tree
 }
 
-// LoadMapSlice loads a yaml.MapSlice object that keeps the ordering
-func (tree *OTree) LoadMapSlice(data yaml.MapSlice) *OTree {
-	for _, item := range data {
-		kind := reflect.TypeOf(item.Value).Kind()
-		switch kind {
-		case reflect.Slice:
-			tree.Set(item.Key, tree.getMapSlice(item.Value.(yaml.MapSlice), nil))
-		case reflect.String:
-			tree.Set(item.Key, item.Value)
-		default:
-			panic(fmt.Errorf("Unknown type '%s' while loading state", kind))
+// LoadMapSlice loads a yaml.MapSlice object that keeps the ordering. Positions are not known.
+//
+// Deprecated: use LoadNode, which also keeps the positions of the keys and the list elements.
+func (tree *OTree) LoadMapSlice(data yamlv2.MapSlice) *OTree {
+	src, err := yamlv2.Marshal(data)
+	if err == nil {
+		var node yaml.Node
+		if err = yaml.Unmarshal(src, &node); err == nil {
+			_, err = tree.LoadNode(&node, "")
 		}
 	}
+	if err != nil {
+		panic(fmt.Errorf("Unable to load state: %s", err.Error()))
+	}
 	return tree
 }
 
-func (tree *OTree) getArray(data interface{}) []interface{} {
-	cnt := make([]interface{}, 0)
+// LoadNode loads a YAML mapping node (or a document with it) that keeps the ordering.
+// Positions of the keys and list elements are tracked against the given file name.
+func (tree *OTree) LoadNode(node *yaml.Node, file string) (*OTree, error) {
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return tree, nil
+		}
+		node = node.Content[0]
+	}
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: expected a mapping", newPosition(file, node))
+	}
 
-	for _, element := range data.([]interface{}) {
-		switch reflect.TypeOf(element).Kind() {
-		case reflect.String:
-			cnt = append(cnt, element.(string))
-		case reflect.Slice:
-			cnt = append(cnt, tree.getMapSlice(element.(yaml.MapSlice), nil))
-		default:
-			panic(fmt.Sprintf("Value %s has an unsupported type %s", element, reflect.TypeOf(element)))
+	tree._pos = newPosition(file, node)
+	explicit := make(map[interface{}]bool) // Keys, which are not merged with "<<"
+	for idx := 0; idx+1 < len(node.Content); idx += 2 {
+		knode, vnode := node.Content[idx], node.Content[idx+1]
+		if knode.Kind == yaml.ScalarNode && knode.Tag == "!!merge" {
+			if err := tree.mergeNode(vnode, file, explicit); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if knode.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s: key should be a scalar", newPosition(file, knode))
+		}
+		var key interface{}
+		if err := knode.Decode(&key); err != nil {
+			return nil, fmt.Errorf("%s: %s", newPosition(file, knode), err.Error())
 		}
+		value, positions, err := tree.getNode(vnode, file)
+		if err != nil {
+			return nil, err
+		}
+		tree.Set(key, value)
+		tree._kpos[key] = newPosition(file, knode)
+		delete(tree._epos, key)
+		if positions != nil {
+			tree._epos[key] = positions
+		}
+		explicit[key] = true
 	}
+	return tree, nil
+}
 
-	return cnt
+// Merge mapping (or a list of mappings) of the "<<" key into the tree.
+// Keys, that are set explicitly, and keys of the earlier mappings take precedence.
+func (tree *OTree) mergeNode(node *yaml.Node, file string, explicit map[interface{}]bool) error {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		merged, err := NewOTree().LoadNode(node, file)
+		if err != nil {
+			return err
+		}
+		for _, key := range merged.Keys() {
+			if explicit[key] {
+				continue
+			}
+			explicit[key] = true
+			tree.SetFrom(key, merged, key)
+		}
+		return nil
+	case yaml.SequenceNode:
+		for _, element := range node.Content {
+			if err := tree.mergeNode(element, file, explicit); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s: merge key '<<' expects a mapping or a list of mappings", newPosition(file, node))
+	}
 }
 
-func (tree *OTree) getMapSlice(data yaml.MapSlice, cnt *OTree) *OTree {
-	if cnt == nil {
-		cnt = NewOTree()
-	}
-	for _, item := range data {
-		if item.Value != nil {
-			kind := reflect.TypeOf(item.Value).Kind()
-			switch kind {
-			case reflect.Slice:
-				i_val_t := reflect.TypeOf(item.Value)
-				if i_val_t.Kind() == reflect.Slice && i_val_t.Elem().Kind() == reflect.Interface {
-					cnt.Set(item.Key, tree.getArray(item.Value))
-				} else {
-					cnt.Set(item.Key, tree.getMapSlice(item.Value.(yaml.MapSlice), nil))
-				}
-			case reflect.String:
-				cnt.Set(item.Key, item.Value)
-			case reflect.Bool:
-				cnt.Set(item.Key, item.Value)
-			default:
-				panic(fmt.Errorf("Unknown type '%s' while loading state", kind))
+// Get a value of the node. If the value is a list, positions of its elements are also returned.
+func (tree *OTree) getNode(node *yaml.Node, file string) (interface{}, []*Position, error) {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return tree.getNode(node.Alias, file)
+	case yaml.MappingNode:
+		branch, err := NewOTree().LoadNode(node, file)
+		return branch, nil, err
+	case yaml.SequenceNode:
+		cnt := make([]interface{}, 0)
+		positions := make([]*Position, 0)
+		for _, element := range node.Content {
+			value, _, err := tree.getNode(element, file)
+			if err != nil {
+				return nil, nil, err
 			}
-		} else {
-			cnt.Set(item.Key, nil)
+			cnt = append(cnt, value)
+			positions = append(positions, newPosition(file, element))
+		}
+		return cnt, positions, nil
+	case yaml.ScalarNode:
+		var value interface{}
+		if err := node.Decode(&value); err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", newPosition(file, node), err.Error())
+		}
+		return value, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("%s: unsupported YAML node", newPosition(file, node))
+	}
+}
+
+// Origin returns position where the tree starts in the source, if known.
+func (tree *OTree) Origin() *Position {
+	return tree._pos
+}
+
+// SetOrigin sets position where the tree starts in the source.
+func (tree *OTree) SetOrigin(pos *Position) *OTree {
+	tree._pos = pos
+	return tree
+}
+
+// KeyPosition returns position of the key in the source, if known.
+func (tree *OTree) KeyPosition(key interface{}) *Position {
+	return tree._kpos[key]
+}
+
+// SetKeyPosition sets position of the key in the source.
+func (tree *OTree) SetKeyPosition(key interface{}, pos *Position) *OTree {
+	if pos != nil {
+		tree._kpos[key] = pos
+	}
+	return tree
+}
+
+// ElementPosition returns position of the element in the list, which is the value of the key.
+func (tree *OTree) ElementPosition(key interface{}, idx int) *Position {
+	positions := tree._epos[key]
+	if idx < 0 || idx >= len(positions) {
+		return nil
+	}
+	return positions[idx]
+}
+
+// SetElementPositions sets positions of all elements of the list, which is the value of the key.
+func (tree *OTree) SetElementPositions(key interface{}, positions []*Position) *OTree {
+	tree._epos[key] = positions
+	return tree
+}
+
+// SetFrom sets the key to the value of another tree by its key, keeping all the known positions.
+func (tree *OTree) SetFrom(key interface{}, other *OTree, otherKey interface{}) *OTree {
+	tree.Set(key, other.Get(otherKey, nil))
+	tree.SetKeyPosition(key, other.KeyPosition(otherKey))
+	if positions, ex := other._epos[otherKey]; ex {
+		tree._epos[key] = positions
+	}
+	return tree
+}
+
+// Copy returns a deep copy of the tree with all the known positions.
+// Nested trees, lists and maps are copied as well, so nothing is shared with the original.
+func (tree *OTree) Copy() *OTree {
+	other := NewOTree().SetOrigin(tree._pos)
+	for _, key := range tree._kidx {
+		other.Set(key, copyValue(tree._data[key]))
+		other.SetKeyPosition(key, tree._kpos[key])
+		if positions, ex := tree._epos[key]; ex {
+			other._epos[key] = append([]*Position{}, positions...)
+		}
+	}
+	return other
+}
+
+// Deep copy of a value of the tree
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *OTree:
+		return v.Copy()
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			out = append(out, copyValue(elem))
 		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[interface{}]interface{}, len(v))
+		for key, elem := range v {
+			out[key] = copyValue(elem)
+		}
+		return out
+	default:
+		return value
 	}
-	return cnt
 }
 
 // Set the key/value
@@ -110,9 +291,8 @@ func (tree *OTree) Get(key interface{}, bydefault interface{}) interface{} {
 
 // GetBranch of the current tree. If branch is not an OTree object or not found, nil is returned.
 func (tree *OTree) GetBranch(key interface{}) *OTree {
-	obj := tree.Get(key, nil)
-	if obj != nil && reflect.TypeOf(obj).Elem().Kind() == reflect.Struct {
-		return obj.(*OTree)
+	if branch, ok := tree.Get(key, nil).(*OTree); ok {
+		return branch
 	}
 
 	return nil
@@ -120,17 +300,18 @@ func (tree *OTree) GetBranch(key interface{}) *OTree {
 
 // GetList returns an object as an array of the interfaces. If an object is not a slice, nil is returned.
 func (tree *OTree) GetList(key interface{}) []interface{} {
-	obj := tree.Get(key, nil)
-	if reflect.TypeOf(obj).Kind() == reflect.Slice {
-		return obj.([]interface{})
+	if list, ok := tree.Get(key, nil).([]interface{}); ok {
+		return list
 	}
 	return nil
 }
 
-// GetString returns a string, blindly assuming it is one.
-// XXX: better implementation needed. :)
+// GetString returns a string. If an object is not a string, an empty string is returned.
 func (tree *OTree) GetString(key interface{}) string {
-	return tree.Get(key, nil).(string)
+	if str, ok := tree.Get(key, nil).(string); ok {
+		return str
+	}
+	return ""
 }
 
 // Check if key is there
@@ -145,6 +326,8 @@ func (tree *OTree) Delete(key interface{}) *OTree {
 		for i, k := range tree._kidx {
 			if k == key {
 				delete(tree._data, key)
+				delete(tree._kpos, key)
+				delete(tree._epos, key)
 				tree._kidx = append(tree._kidx[:i], tree._kidx[i+1:]...)
 				return tree
 			}
@@ -162,48 +345,139 @@ func (tree *OTree) Items() [][]interface{} {
 	return nil
 }
 
+// Plain Go structure of the value: trees and maps become maps with string keys,
+// scalars of any type are kept as is.
 func (tree *OTree) _to_structure(cnt map[string]interface{}, obj interface{}) interface{} {
-	if obj == nil {
-		return nil
-	}
-
 	if cnt == nil {
 		cnt = make(map[string]interface{})
 	}
-	objType := reflect.TypeOf(obj).Kind()
-	if objType == reflect.Ptr {
-		for _, obj_k := range obj.(*OTree).Keys() {
-			cnt[obj_k.(string)] = tree._to_structure(nil, obj.(*OTree).Get(obj_k, nil))
+
+	switch value := obj.(type) {
+	case *OTree:
+		for _, obj_k := range value.Keys() {
+			cnt[fmt.Sprint(obj_k)] = tree._to_structure(nil, value.Get(obj_k, nil))
 		}
-	} else if objType == reflect.Map {
-		for obj_k := range obj.(map[interface{}]interface{}) {
-			cnt[obj_k.(string)] = tree._to_structure(nil, obj.(map[interface{}]interface{})[obj_k])
+		return cnt
+	case map[interface{}]interface{}:
+		for obj_k, obj_v := range value {
+			cnt[fmt.Sprint(obj_k)] = tree._to_structure(nil, obj_v)
 		}
-	} else if objType == reflect.Slice {
-		arr := make([]interface{}, 0)
-		for _, element := range obj.([]interface{}) {
+		return cnt
+	case []interface{}:
+		arr := make([]interface{}, 0, len(value))
+		for _, element := range value {
 			arr = append(arr, tree._to_structure(nil, element))
 		}
 		return arr
-	} else if objType == reflect.String {
-		return obj.(string)
-	} else if objType == reflect.Bool {
-		return obj.(bool)
-	} else {
-		fmt.Println("unsupported DSL type:", objType)
+	default:
+		return obj
 	}
-
-	return cnt
 }
 
-// ToYAML exports ordered tree to an unordered YAML (!)
+// ToYAML exports the tree to YAML, keeping the order of the keys
 func (tree *OTree) ToYAML() string {
-	obj := tree._to_structure(nil, tree._data)
-	data, _ := yaml.Marshal(&obj)
+	var data bytes.Buffer
+	enc := yaml.NewEncoder(&data)
+	enc.SetIndent(2)
+	if err := enc.Encode(tree); err != nil {
+		return ""
+	}
+	enc.Close()
+
+	return data.String()
+}
 
+// ToJSON exports the tree to JSON, keeping the order of the keys
+func (tree *OTree) ToJSON() string {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return ""
+	}
 	return string(data)
 }
 
+// MarshalYAML implements yaml.Marshaler and keeps the order of the keys
+func (tree *OTree) MarshalYAML() (interface{}, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, key := range tree._kidx {
+		knode, vnode := new(yaml.Node), new(yaml.Node)
+		if err := knode.Encode(key); err != nil {
+			return nil, err
+		}
+		if err := vnode.Encode(tree._data[key]); err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, knode, vnode)
+	}
+	return node, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, keeping the order of the keys
+func (tree *OTree) UnmarshalYAML(node *yaml.Node) error {
+	_, err := tree.Flush().LoadNode(node, "")
+	return err
+}
+
+// MarshalJSON implements json.Marshaler and keeps the order of the keys.
+// Keys, which are not strings, are converted to strings.
+func (tree *OTree) MarshalJSON() ([]byte, error) {
+	var data bytes.Buffer
+	data.WriteByte('{')
+	for idx, key := range tree._kidx {
+		if idx > 0 {
+			data.WriteByte(',')
+		}
+		kdata, err := json.Marshal(fmt.Sprint(key))
+		if err != nil {
+			return nil, err
+		}
+		vdata, err := json.Marshal(jsonValue(tree._data[key]))
+		if err != nil {
+			return nil, err
+		}
+		data.Write(kdata)
+		data.WriteByte(':')
+		data.Write(vdata)
+	}
+	data.WriteByte('}')
+	return data.Bytes(), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, keeping the order of the keys
+func (tree *OTree) UnmarshalJSON(data []byte) error {
+	if !json.Valid(data) {
+		return errors.New("Invalid JSON")
+	}
+	// JSON is also YAML, which is loaded with the ordering
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return err
+	}
+	return tree.UnmarshalYAML(&node)
+}
+
+// Value, which can be marshalled to JSON: maps should have string keys
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			out = append(out, jsonValue(elem))
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			out[fmt.Sprint(key)] = jsonValue(elem)
+		}
+		return out
+	default:
+		return value
+	}
+}
+
+// Serialise the tree to a plain map. The map does not keep the order of the keys,
+// use the tree itself or its YAML/JSON export where the order matters.
 func (tree *OTree) Serialise() map[string]interface{} {
 	obj := tree._to_structure(nil, tree._data)
 	shallowObj := make(map[string]interface{})
@@ -2,13 +2,13 @@ package nanocms_compiler
 
 import (
 	"fmt"
-	"strings"
 )
 
 type RefList struct {
-	included        map[string]bool
+	included        map[string]bool // State references, pinned to the versions, if any
 	referenced_jobs map[string]bool
 	required_jobs   map[string]bool // Their content
+	excluded_jobs   map[string]bool // Blocks, excluded from the included states, as "state/block"
 	visited         []string
 	optional        []string // Those with "+" that might not be there
 }
@@ -20,8 +20,8 @@ func NewRefList() *RefList {
 }
 
 // Get all mentioned references
-func (rl *RefList) FindRefs(state *OTree) {
-	rl.findRefs(state)
+func (rl *RefList) FindRefs(state *OTree) error {
+	return rl.findRefs(state)
 }
 
 func (rl *RefList) GetRequiredJobs() []string {
@@ -40,6 +40,17 @@ func (rl *RefList) GetReferencedJobs() []string {
 	return refs
 }
 
+// GetExcludedJobs returns blocks, excluded from the entire included states, by their
+// state and block, e.g. "base-os/install-firewall". They are never required, unless
+// another inclusion lists them.
+func (rl *RefList) GetExcludedJobs() []string {
+	refs := make([]string, 0)
+	for k := range rl.excluded_jobs {
+		refs = append(refs, k)
+	}
+	return refs
+}
+
 func (rl *RefList) GetIncluded() []string {
 	refs := make([]string, 0)
 	for k := range rl.included {
@@ -68,17 +79,17 @@ func (rl *RefList) GetMandatoryUnresolved() []string {
 // MarkVisited marks a reference as "seen" and "requested".
 // If it gets marked again, it means the request wasn't completed,
 // so we hit a infinite cycle, which needs to be broken out.
-func (rl *RefList) MarkStateRequested(id string) string {
+func (rl *RefList) MarkStateRequested(id string) (string, error) {
 	if id == "" {
-		return id
+		return id, nil
 	}
 	for _, mark := range rl.visited {
 		if mark == id {
-			panic(fmt.Errorf("State with ID '%s' still wasn't resolved", id))
+			return "", fmt.Errorf("State with ID '%s' still wasn't resolved", id)
 		}
 	}
 	rl.visited = append(rl.visited, id)
-	return id
+	return id, nil
 }
 
 // MarkResolved marks a reference as "resolved" and removes from the stack
@@ -99,31 +110,43 @@ func (rl *RefList) Flush() *RefList {
 	rl.included = make(map[string]bool)        // State IDs
 	rl.referenced_jobs = make(map[string]bool) // the entire blocks
 	rl.required_jobs = make(map[string]bool)   // their content
+	rl.excluded_jobs = make(map[string]bool)   // and what is not
 	rl.visited = make([]string, 0)
 	rl.optional = make([]string, 0)
 
 	return rl
 }
 
-func (rl *RefList) findRefs(state *OTree) {
+func (rl *RefList) findRefs(state *OTree) error {
 	for _, blockExpr := range state.GetBranch("state").Keys() {
-		expr := blockExpr.(string)
-		if strings.Contains(expr, "~") || strings.Contains(expr, "&") || strings.Contains(expr, "+") {
-			for _, expr_t := range strings.Split(expr, " ") {
-				if strings.HasPrefix(expr_t, "~") || strings.HasPrefix(expr_t, "+") {
-					if !strings.Contains(expr_t, "/") { // Include the entire state
-						expr_t += "/"
-					}
-					rl.included[strings.Split(expr_t, "/")[0][1:]] = true
-					rl.required_jobs[strings.Split(expr_t, "/")[1]] = true
-					if strings.HasPrefix(expr_t, "+") {
-						rl.optional = append(rl.optional, strings.Split(expr_t, "/")[0][1:])
-					}
-				} else if strings.HasPrefix(expr_t, "&") {
-					rl.included[strings.Split(expr_t, "/")[0][1:]] = true
-					rl.referenced_jobs[strings.Split(expr_t, "/")[1]] = true
-				}
+		line, ok := blockExpr.(string)
+		if !ok {
+			return fmt.Errorf("Block ID '%v' should be a string", blockExpr)
+		}
+		expr, err := ParseCDL(line)
+		if err != nil {
+			pos := state.GetBranch("state").KeyPosition(line)
+			return &CompileError{StateId: state.GetString("id"), Block: line, Position: causePosition(pos, err), Directive: line, Cause: err}
+		}
+		for _, inclusion := range expr.Inclusions {
+			ref := StateRef(inclusion.Stateid, inclusion.Version)
+			rl.included[ref] = true
+			for _, block := range inclusion.Blocks {
+				rl.required_jobs[block] = true
+			}
+			for _, block := range inclusion.Exclude {
+				rl.excluded_jobs[BlockId(ref, block)] = true
+			}
+			if inclusion.Optional {
+				rl.optional = append(rl.optional, ref)
+			}
+		}
+		for _, dependency := range expr.Dependencies {
+			rl.included[StateRef(dependency.Stateid, dependency.Version)] = true
+			for _, block := range dependency.Blocks {
+				rl.referenced_jobs[block] = true
 			}
 		}
 	}
+	return nil
 }
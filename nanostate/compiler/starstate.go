@@ -0,0 +1,257 @@
+/*
+States, written in Starlark.
+
+State file with suffix ".star" builds the state with the "state" and
+"block" builtins, instead of YAML:
+
+	state(id="web", description="Web server", version="2")
+
+	def is_debian():
+		return traits.get("os") == "debian"
+
+	def sites():
+		for site in ["example.com", "example.org"]:
+			block("configure-" + site + " ?is_debian", modules=[
+				{"system.file": {"path": "/etc/nginx/sites/" + site}},
+			], requires=["install-nginx", "pgsql/install-pgsql"])
+
+	block("~pgsql/install-pgsql")
+	sites()
+
+State is compiled into the same tree as of the YAML state, so the name of
+the block is a CDL line with its conditions, inclusions and loops, and
+functions of the script are the functions of the state. Required blocks
+of the same state are "@require" requisites, while required blocks of the
+other states, such as "pgsql/install-pgsql", are "&" dependencies.
+
+ID and version of the state should be literals, so the state can be
+indexed without running the script. Version with a decimal point should be
+a string, such as version="1.10", since the number 1.10 is the same as 1.1.
+Loops are allowed only in the functions, as in any other Starlark script
+of the states.
+*/
+
+package nanocms_compiler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// StarState is a state, defined by the Starlark script
+type StarState struct {
+	file   string
+	header *OTree
+	blocks *OTree
+}
+
+// NewStarState constructor
+func NewStarState(file string) *StarState {
+	ss := new(StarState)
+	ss.file = file
+	ss.blocks = NewOTree()
+	return ss
+}
+
+// Builtins, that define the state
+func (ss *StarState) builtins() starlark.StringDict {
+	return starlark.StringDict{
+		"state": starlark.NewBuiltin("state", ss.defineState),
+		"block": starlark.NewBuiltin("block", ss.defineBlock),
+	}
+}
+
+// Position of the caller of the builtin in the script
+func (ss *StarState) position(thread *starlark.Thread) *Position {
+	pos := thread.CallFrame(1).Pos
+	return &Position{File: ss.file, Line: int(pos.Line), Column: int(pos.Col)}
+}
+
+// state(id, description, version=None, vars=None, params=None)
+func (ss *StarState) defineState(thread *starlark.Thread, builtin *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var id, description string
+	var version, vars, params starlark.Value = starlark.None, starlark.None, starlark.None
+	if err := starlark.UnpackArgs(builtin.Name(), args, kwargs, "id", &id, "description", &description,
+		"version?", &version, "vars?", &vars, "params?", &params); err != nil {
+		return nil, err
+	}
+	if _, ok := version.(starlark.Float); ok {
+		return nil, fmt.Errorf("State version should be a string, but got the number %s", version)
+	}
+	if ss.header != nil {
+		return nil, fmt.Errorf("State is already defined as '%s'", ss.header.GetString("id"))
+	}
+
+	pos := ss.position(thread)
+	ss.header = NewOTree().SetOrigin(pos)
+	ss.header.Set("id", id).SetKeyPosition("id", pos)
+	ss.header.Set("description", description).SetKeyPosition("description", pos)
+	if version != starlark.None {
+		ss.header.Set("version", NewStarType(version).Interface()).SetKeyPosition("version", pos)
+	}
+	for idx, value := range []starlark.Value{vars, params} {
+		name := []string{"vars", "params"}[idx]
+		if value == starlark.None {
+			continue
+		}
+		if _, ok := value.(*starlark.Dict); !ok {
+			return nil, fmt.Errorf("State '%s' should be a dict, but got '%s'", name, value.Type())
+		}
+		ss.header.Set(name, fromStarlarkOrdered(value)).SetKeyPosition(name, pos)
+	}
+	return starlark.None, nil
+}
+
+// block(name, modules=None, requires=None)
+func (ss *StarState) defineBlock(thread *starlark.Thread, builtin *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	var modules, requires *starlark.List
+	if err := starlark.UnpackArgs(builtin.Name(), args, kwargs, "name", &name, "modules?", &modules, "requires?", &requires); err != nil {
+		return nil, err
+	}
+
+	blockdef := name
+	if requires != nil {
+		blocks := make([]string, 0)
+		for idx := 0; idx < requires.Len(); idx++ {
+			ref, ok := requires.Index(idx).(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("Block '%s' requires '%s', but is expected to require a string", name, requires.Index(idx))
+			}
+			if strings.Contains(ref.GoString(), "/") {
+				blockdef += " &" + ref.GoString()
+			} else {
+				blocks = append(blocks, ref.GoString())
+			}
+		}
+		if len(blocks) > 0 {
+			blockdef += " @" + CDL_R_REQUIRE + ":" + strings.Join(blocks, ":")
+		}
+	}
+	if ss.blocks.Exists(blockdef) {
+		return nil, fmt.Errorf("Block '%s' is already defined", name)
+	}
+
+	pos := ss.position(thread)
+	var value interface{}
+	var positions []*Position
+	if modules != nil {
+		list := make([]interface{}, 0, modules.Len())
+		for idx := 0; idx < modules.Len(); idx++ {
+			if _, ok := modules.Index(idx).(*starlark.Dict); !ok {
+				return nil, fmt.Errorf("Module %d of block '%s' should be a dict, but got '%s'", idx, name, modules.Index(idx).Type())
+			}
+			list = append(list, fromStarlarkOrdered(modules.Index(idx)))
+			positions = append(positions, pos)
+		}
+		value = list
+	}
+	ss.blocks.Set(blockdef, value).SetKeyPosition(blockdef, pos).SetElementPositions(blockdef, positions)
+	return starlark.None, nil
+}
+
+// Tree of the state, the same as of the YAML state
+func (ss *StarState) Tree() (*OTree, error) {
+	if ss.header == nil {
+		return nil, fmt.Errorf("State is not defined, call state(id=..., description=...) in '%s'", ss.file)
+	}
+	tree := ss.header.Copy()
+	tree.Set("state", ss.blocks).SetKeyPosition("state", ss.header.Origin())
+	return tree, nil
+}
+
+// LoadStarState runs the Starlark script without the data and returns the tree of the state it defines
+func LoadStarState(file string, src []byte) (*OTree, error) {
+	return NewCDLFunc().DefineState(file, src)
+}
+
+// DefineState runs the Starlark script and returns the tree of the state it defines.
+// Functions of the state are imported later by its ID, when its parameters are known.
+func (cdl *CDLFunc) DefineState(file string, src []byte) (*OTree, error) {
+	ss := NewStarState(file)
+	if err := NewStarlarkProcess().SetData(cdl.data).SetStateBuilder(ss).LoadSource(file, src); err != nil {
+		return nil, err
+	}
+	return ss.Tree()
+}
+
+// Position of the error in the Starlark script, if it is known. Returns the error without the position.
+func starErrorPosition(file string, err error) (*Position, error) {
+	switch e := err.(type) {
+	case *starlark.EvalError:
+		for idx := len(e.CallStack) - 1; idx >= 0; idx-- {
+			if pos := e.CallStack[idx].Pos; pos.Filename() == file {
+				return &Position{File: file, Line: int(pos.Line), Column: int(pos.Col)}, errors.New(e.Msg)
+			}
+		}
+	case syntax.Error:
+		return &Position{File: file, Line: int(e.Pos.Line), Column: int(e.Pos.Col)}, errors.New(e.Msg)
+	case resolve.ErrorList:
+		if len(e) > 0 {
+			return &Position{File: file, Line: int(e[0].Pos.Line), Column: int(e[0].Pos.Col)}, errors.New(e[0].Msg)
+		}
+	}
+	return nil, err
+}
+
+// ImportStar imports functions of the Starlark state. Definitions of the state are ignored.
+func (cdl *CDLFunc) ImportStar(id string, srcpath string, src []byte) error {
+	return cdl.importSource(id, &cdlSource{path: srcpath, src: src, star: true})
+}
+
+// ParseStarStateId returns the ID and the version of the state from the "state" call of the script,
+// without running it.
+func ParseStarStateId(file string, src []byte) (string, string, error) {
+	f, err := syntax.Parse(file, src, 0)
+	if err != nil {
+		return "", "", err
+	}
+	var id, version, float string
+	var found bool
+	syntax.Walk(f, func(node syntax.Node) bool {
+		call, ok := node.(*syntax.CallExpr)
+		if !ok || found {
+			return !found
+		}
+		if fn, ok := call.Fn.(*syntax.Ident); !ok || fn.Name != "state" {
+			return true
+		}
+		found = true
+		for idx, arg := range call.Args {
+			name, value := "", arg
+			if kw, ok := arg.(*syntax.BinaryExpr); ok && kw.Op == syntax.EQ {
+				if ident, ok := kw.X.(*syntax.Ident); ok {
+					name, value = ident.Name, kw.Y
+				}
+			} else if idx == 0 {
+				name = "id"
+			}
+			literal, ok := value.(*syntax.Literal)
+			if !ok {
+				continue
+			}
+			switch name {
+			case "id":
+				id, _ = literal.Value.(string)
+			case "version":
+				if literal.Token == syntax.FLOAT {
+					float = literal.Raw
+				}
+				version = fmt.Sprint(literal.Value)
+			}
+		}
+		return false
+	})
+	if id == "" {
+		return "", "", fmt.Errorf("State in '%s' has no literal ID", file)
+	}
+	if float != "" {
+		return "", "", fmt.Errorf("State in '%s' should have a string version, e.g. version=\"%s\"", file, float)
+	}
+	return id, version, nil
+}
@@ -153,8 +153,82 @@ func (st *StarType) Interface() interface{} {
 		out = st.parseBool(st.v.(starlark.Bool))
 	case "string":
 		out = st.v.(starlark.String).GoString()
+	case "float":
+		out = float64(st.v.(starlark.Float))
+	case "NoneType":
+		out = nil
 	default:
 		out = st.v
 	}
 	return out
 }
+
+// ToStarlark converts Go value to Starlark value
+func ToStarlark(v interface{}) (starlark.Value, error) {
+	switch value := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case starlark.Value:
+		return value, nil
+	case string:
+		return starlark.String(value), nil
+	case bool:
+		return starlark.Bool(value), nil
+	case int:
+		return starlark.MakeInt(value), nil
+	case int64:
+		return starlark.MakeInt64(value), nil
+	case uint64:
+		return starlark.MakeUint64(value), nil
+	case float64:
+		return starlark.Float(value), nil
+	case []interface{}:
+		elems := make([]starlark.Value, 0, len(value))
+		for _, elem := range value {
+			sv, err := ToStarlark(elem)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, sv)
+		}
+		return starlark.NewList(elems), nil
+	case map[interface{}]interface{}:
+		dict := starlark.NewDict(len(value))
+		for key, elem := range value {
+			if err := setStarDictItem(dict, key, elem); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	case *OTree:
+		dict := starlark.NewDict(len(value.Keys()))
+		for _, key := range value.Keys() {
+			if err := setStarDictItem(dict, key, value.Get(key, nil)); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	case map[string]interface{}:
+		dict := starlark.NewDict(len(value))
+		for key, elem := range value {
+			if err := setStarDictItem(dict, key, elem); err != nil {
+				return nil, err
+			}
+		}
+		return dict, nil
+	default:
+		return nil, fmt.Errorf("Unable to convert %T to Starlark value", v)
+	}
+}
+
+func setStarDictItem(dict *starlark.Dict, key interface{}, value interface{}) error {
+	sk, err := ToStarlark(key)
+	if err != nil {
+		return err
+	}
+	sv, err := ToStarlark(value)
+	if err != nil {
+		return err
+	}
+	return dict.SetKey(sk, sv)
+}
@@ -0,0 +1,259 @@
+/*
+Templates in the module arguments and shell commands:
+
+	install-kernel-modules:
+		- system.service:
+			name: "{{ service_name() }}"
+			path: /lib/modules/{{ traits.kernelrelease }}
+			port: "{{ vars.port }}"
+			version: "{{ params.version }}"
+		- shell:
+			- show-release: "cat /etc/{{ release_file() }}"
+
+Each template is a Starlark expression, evaluated with the builtins,
+functions of the state, its "vars" section, "params" of the state
+instance and "data" of the host. Dicts are accessible with
+attributes as well as with keys, i.e. "traits.kernel" is the same as
+traits["kernel"]. A value, which is nothing but one template, keeps the
+type of the result, so "{{ vars.port }}" can be a number.
+
+Templates are rendered in every string of the module arguments and shell
+commands, written in the state source, so "{{" in the existing states is
+a template now. Literal "{{" is written as "\{{", or as the template
+{{ "{{" }}, while "\\{{" is a backslash, followed by the template:
+
+	- shell:
+		- list-containers: docker ps --format '\{{.Names}}'
+
+Values, that are not written in the state source, are never rendered:
+items of the loops, blocks of the generators, data and the results of
+the templates themselves keep "{{" as it is.
+*/
+
+package nanocms_compiler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+const (
+	tpl_open   = "{{"
+	tpl_close  = "}}"
+	tpl_escape = "\\"
+)
+
+// StarNamespace is a dict, which values are accessible as attributes
+type StarNamespace struct {
+	name string
+	dict *starlark.Dict
+}
+
+// NewStarNamespace constructor
+func NewStarNamespace(name string, dict *starlark.Dict) *StarNamespace {
+	ns := new(StarNamespace)
+	ns.name = name
+	ns.dict = dict
+	return ns
+}
+
+func (ns *StarNamespace) String() string        { return ns.dict.String() }
+func (ns *StarNamespace) Type() string          { return ns.name }
+func (ns *StarNamespace) Freeze()               { ns.dict.Freeze() }
+func (ns *StarNamespace) Truth() starlark.Bool  { return ns.dict.Truth() }
+func (ns *StarNamespace) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %s", ns.name) }
+
+// Attr returns value of the key, or (nil, nil) if there is no such key
+func (ns *StarNamespace) Attr(name string) (starlark.Value, error) {
+	value, found, err := ns.dict.Get(starlark.String(name))
+	if err != nil || !found {
+		return nil, err
+	}
+	return ns.wrap(name, value), nil
+}
+
+// AttrNames returns all string keys
+func (ns *StarNamespace) AttrNames() []string {
+	names := make([]string, 0)
+	for _, key := range ns.dict.Keys() {
+		if name, ok := key.(starlark.String); ok {
+			names = append(names, name.GoString())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get value of the key, as in ns["key"]
+func (ns *StarNamespace) Get(key starlark.Value) (starlark.Value, bool, error) {
+	value, found, err := ns.dict.Get(key)
+	if err != nil || !found {
+		return nil, found, err
+	}
+	return ns.wrap(key.String(), value), true, nil
+}
+
+// Nested dicts are namespaces too
+func (ns *StarNamespace) wrap(name string, value starlark.Value) starlark.Value {
+	if dict, ok := value.(*starlark.Dict); ok {
+		return NewStarNamespace(ns.name+"."+name, dict)
+	}
+	return value
+}
+
+// Render templates in the text. Text, which is only one template, returns
+// the result of the expression, otherwise the result is a string.
+func (cdl *CDLFunc) Render(stateid string, text string) (interface{}, error) {
+	if !strings.Contains(text, tpl_open) {
+		return text, nil
+	}
+
+	var out strings.Builder
+	rest := text
+	for {
+		start := strings.Index(rest, tpl_open)
+		if start < 0 {
+			out.WriteString(rest)
+			break
+		}
+		prefix := rest[:start]
+		if templateEscaped(prefix) {
+			out.WriteString(prefix[:len(prefix)-len(tpl_escape)] + tpl_open)
+			rest = rest[start+len(tpl_open):]
+			continue
+		} else if strings.HasSuffix(prefix, tpl_escape) {
+			prefix = prefix[:len(prefix)-len(tpl_escape)] // Literal backslash before the template
+		}
+		end := strings.Index(rest[start:], tpl_close)
+		if end < 0 {
+			return nil, fmt.Errorf("Template in '%s' is not closed with '%s'", text, tpl_close)
+		}
+		expr := strings.TrimSpace(rest[start+len(tpl_open) : start+end])
+		if expr == "" {
+			return nil, fmt.Errorf("Template in '%s' is empty", text)
+		}
+		value, err := cdl.Eval(stateid, expr)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to render '%s': %s", rest[start:start+end+len(tpl_close)], err.Error())
+		}
+
+		// Value is the template alone
+		if rest == text && start == 0 && end+len(tpl_close) == len(rest) {
+			if ns, ok := value.(*StarNamespace); ok {
+				value = ns.dict
+			} else if data, ok := value.(*StarData); ok {
+				value = data.dict
+			}
+			return NewStarType(value).Interface(), nil
+		}
+
+		out.WriteString(prefix)
+		if str, ok := value.(starlark.String); ok {
+			out.WriteString(str.GoString())
+		} else {
+			out.WriteString(value.String())
+		}
+		rest = rest[start+end+len(tpl_close):]
+	}
+
+	return out.String(), nil
+}
+
+// The "{{" after the text is escaped with a backslash, which is not escaped itself
+func templateEscaped(text string) bool {
+	return strings.HasSuffix(text, tpl_escape) && !strings.HasSuffix(text, tpl_escape+tpl_escape)
+}
+
+// TemplateExpressions returns expressions of the templates in the text, as they are rendered.
+// Escaped "{{" and a template, which is not closed, are skipped.
+func TemplateExpressions(text string) []string {
+	exprs := make([]string, 0)
+	rest := text
+	for {
+		start := strings.Index(rest, tpl_open)
+		if start < 0 {
+			return exprs
+		}
+		if templateEscaped(rest[:start]) {
+			rest = rest[start+len(tpl_open):]
+			continue
+		}
+		end := strings.Index(rest[start:], tpl_close)
+		if end < 0 {
+			return exprs
+		}
+		exprs = append(exprs, strings.TrimSpace(rest[start+len(tpl_open):start+end]))
+		rest = rest[start+end+len(tpl_close):]
+	}
+}
+
+// Eval evaluates Starlark expression with the builtins, functions and variables of the state
+func (cdl *CDLFunc) Eval(stateid string, expr string) (starlark.Value, error) {
+	thread := &starlark.Thread{Name: stateid}
+	env := make(starlark.StringDict)
+	if state, ex := cdl.threads[stateid]; ex {
+		thread = state.thread
+		for name, value := range state.builtins {
+			env[name] = value
+		}
+		for name, value := range state.globals {
+			env[name] = value
+		}
+	} else {
+		for name, value := range NewStarlarkProcess().builtins {
+			env[name] = value
+		}
+	}
+	for name, value := range env {
+		if dict, ok := value.(*starlark.Dict); ok {
+			env[name] = NewStarNamespace(name, dict)
+		}
+	}
+
+	vars, ex := cdl.vars[stateid]
+	if !ex {
+		vars = starlark.NewDict(0)
+	}
+	env["vars"] = NewStarNamespace("vars", vars)
+	params, ex := cdl.params[stateid]
+	if !ex {
+		params = starlark.NewDict(0)
+	}
+	env["params"] = NewStarNamespace("params", params)
+	env["data"] = cdl.data
+
+	return starlark.Eval(thread, stateid, expr, env)
+}
+
+// Render templates of the value: strings, lists and mappings
+func (cdl *CDLFunc) renderValue(stateid string, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return cdl.Render(stateid, v)
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			rendered, err := cdl.renderValue(stateid, elem)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, rendered)
+		}
+		return out, nil
+	case *OTree:
+		out := NewOTree().SetOrigin(v.Origin())
+		for _, key := range v.Keys() {
+			rendered, err := cdl.renderValue(stateid, v.Get(key, nil))
+			if err != nil {
+				return nil, err
+			}
+			out.SetFrom(key, v, key).Set(key, rendered)
+		}
+		return out, nil
+	default:
+		return value, nil
+	}
+}
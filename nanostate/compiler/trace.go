@@ -0,0 +1,126 @@
+/*
+Trace of the compilation.
+
+Every decision of the compiler is an event of the trace: a condition of a
+block passed or failed, an inclusion resolved or skipped, a loop expanded
+into a number of items, blocks pulled in by a dependency. Trace explains
+why a block is or is not in the compiled tree, e.g.:
+
+	states/web.st:12:3: state 'web', block 'install-emacs': condition ?is_debian() failed
+	states/web.st:20:3: state 'web', block 'optional-db': include +pgsql skipped: not found
+	states/web.st:25:7: state 'web', block 'add-users': loop []more_users() expanded: 3 items
+
+It is rendered as text, one event per line, or as JSON.
+*/
+
+package nanocms_compiler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Kinds of the trace events
+const (
+	TRACE_CONDITION  = "condition"
+	TRACE_INCLUDE    = "include"
+	TRACE_LOOP       = "loop"
+	TRACE_GENERATOR  = "generator"
+	TRACE_DEPENDENCY = "dependency"
+)
+
+// Outcomes of the trace events
+const (
+	TRACE_PASSED   = "passed"   // Condition is true
+	TRACE_FAILED   = "failed"   // Condition is false, the block is dropped
+	TRACE_RESOLVED = "resolved" // Referenced state is found
+	TRACE_SKIPPED  = "skipped"  // Optional state or a block of the referenced state is not found
+	TRACE_MISSING  = "missing"  // Mandatory state is not found
+	TRACE_EXPANDED = "expanded" // Loop is expanded into the items, or generator into the blocks
+	TRACE_EXCLUDED = "excluded" // Blocks are excluded from the included state
+)
+
+// TraceEvent is one decision of the compiler
+type TraceEvent struct {
+	Kind     string    `json:"kind"`
+	StateId  string    `json:"state"`
+	Block    string    `json:"block"`
+	Position *Position `json:"-"`
+	Target   string    `json:"target"` // Condition, reference or loop as written in the source
+	Outcome  string    `json:"outcome"`
+	Blocks   []string  `json:"blocks,omitempty"` // Blocks, that are included, pulled in or skipped
+	Items    int       `json:"items,omitempty"`  // Items of the loop or blocks of the generator
+	Message  string    `json:"message,omitempty"`
+}
+
+// String representation of the event as one line of the text trace
+func (ev *TraceEvent) String() string {
+	var out strings.Builder
+	if ev.Position != nil {
+		out.WriteString(ev.Position.String() + ": ")
+	}
+	out.WriteString(fmt.Sprintf("state '%s', block '%s': %s %s %s", ev.StateId, ev.Block, ev.Kind, ev.Target, ev.Outcome))
+	if ev.Kind == TRACE_LOOP {
+		out.WriteString(fmt.Sprintf(": %d items", ev.Items))
+	} else if ev.Kind == TRACE_GENERATOR && ev.Outcome == TRACE_EXPANDED {
+		out.WriteString(fmt.Sprintf(": %d blocks", ev.Items))
+	} else if len(ev.Blocks) > 0 {
+		out.WriteString(": " + strings.Join(ev.Blocks, ", "))
+	}
+	if ev.Message != "" {
+		out.WriteString(": " + ev.Message)
+	}
+	return out.String()
+}
+
+// MarshalJSON adds the position as "file:line:column" string
+func (ev *TraceEvent) MarshalJSON() ([]byte, error) {
+	type event TraceEvent
+	return json.Marshal(&struct {
+		*event
+		Position string `json:"position,omitempty"`
+	}{event: (*event)(ev), Position: ev.Position.String()})
+}
+
+// CompileTrace is a list of the events in the order they happened
+type CompileTrace struct {
+	Events []*TraceEvent `json:"events"`
+}
+
+func NewCompileTrace() *CompileTrace {
+	trace := new(CompileTrace)
+	trace.Events = make([]*TraceEvent, 0)
+	return trace
+}
+
+// Add event to the trace
+func (trace *CompileTrace) Add(event *TraceEvent) *CompileTrace {
+	trace.Events = append(trace.Events, event)
+	return trace
+}
+
+// Block returns events of the block of the state
+func (trace *CompileTrace) Block(stateid string, block string) []*TraceEvent {
+	events := make([]*TraceEvent, 0)
+	for _, event := range trace.Events {
+		if event.StateId == stateid && event.Block == block {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// String representation of the trace as text, one event per line
+func (trace *CompileTrace) String() string {
+	var out strings.Builder
+	for _, event := range trace.Events {
+		out.WriteString(event.String() + "\n")
+	}
+	return out.String()
+}
+
+// JSON representation of the trace
+func (trace *CompileTrace) JSON() ([]byte, error) {
+	return json.MarshalIndent(trace, "", "  ")
+}
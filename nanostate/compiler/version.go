@@ -0,0 +1,154 @@
+/*
+Versions of the states.
+
+State can have an optional "version" field. The same state ID can be
+shipped in several versions, and references can pin them:
+
+	install-postgres ~pgsql@13/install-pgsql
+	deploy-app &pgsql@>=12/install-pgsql
+
+Constraint is a version, which matches itself and all its sub-versions,
+e.g. "13" matches "13", "13.1" and "13.1.2", or a version with one of the
+operators "=", "!=", ">", ">=", "<" or "<=". Reference without a pin uses
+the highest version. Versions are compared by their dot-separated parts,
+numerically where both parts are numbers, e.g. "9.6" < "12" < "12.1".
+State without a version is lower than any other version.
+*/
+
+package nanocms_compiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operators of the version constraints, longest first
+var versionOperators = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// VersionConstraint selects versions of a state
+type VersionConstraint struct {
+	Op      string // Empty if the version is a prefix
+	Version string
+}
+
+// ParseVersionConstraint, such as "13", ">=12" or "!=12.1"
+func ParseVersionConstraint(text string) (*VersionConstraint, error) {
+	vc := &VersionConstraint{Version: text}
+	for _, op := range versionOperators {
+		if strings.HasPrefix(text, op) {
+			vc.Op = op
+			vc.Version = text[len(op):]
+			break
+		}
+	}
+	if vc.Version == "" {
+		return nil, fmt.Errorf("Version constraint '%s' has no version", text)
+	}
+	for _, part := range strings.Split(vc.Version, ".") {
+		if part == "" || strings.ContainsAny(part, "<>=!") {
+			return nil, fmt.Errorf("Version constraint '%s' is invalid", text)
+		}
+	}
+	return vc, nil
+}
+
+// Match the version
+func (vc *VersionConstraint) Match(version string) bool {
+	if version == "" {
+		return false
+	}
+	cmp := CompareVersions(version, vc.Version)
+	switch vc.Op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	default:
+		return version == vc.Version || strings.HasPrefix(version, vc.Version+".")
+	}
+}
+
+// String representation of the constraint as it is written
+func (vc *VersionConstraint) String() string {
+	return vc.Op + vc.Version
+}
+
+// CompareVersions returns -1, 0 or 1 if the version "a" is lower, equal or higher than "b"
+func CompareVersions(a string, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" || b == "" {
+		if a == "" {
+			return -1
+		}
+		return 1
+	}
+
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for idx := 0; idx < len(pa) || idx < len(pb); idx++ {
+		var x, y string
+		if idx < len(pa) {
+			x = pa[idx]
+		}
+		if idx < len(pb) {
+			y = pb[idx]
+		}
+		if cmp := compareVersionParts(x, y); cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+// Compare parts of the versions. Missing part is zero.
+func compareVersionParts(x string, y string) int {
+	if x == "" {
+		x = "0"
+	}
+	if y == "" {
+		y = "0"
+	}
+	nx, errx := strconv.ParseUint(x, 10, 64)
+	ny, erry := strconv.ParseUint(y, 10, 64)
+	switch {
+	case errx == nil && erry == nil:
+		if nx == ny {
+			return 0
+		} else if nx < ny {
+			return -1
+		}
+		return 1
+	case errx == nil:
+		return -1 // Numbers go before the names, e.g. "1.0" < "1.beta"
+	case erry == nil:
+		return 1
+	default:
+		return strings.Compare(x, y)
+	}
+}
+
+// StateRef is a reference to the state ID, pinned to the version constraint, e.g. "pgsql@>=12"
+func StateRef(stateid string, version string) string {
+	if version == "" {
+		return stateid
+	}
+	return stateid + "@" + version
+}
+
+// ParseStateRef splits the reference to the state ID and the version constraint
+func ParseStateRef(ref string) (string, string) {
+	if idx := strings.Index(ref, "@"); idx > -1 {
+		return ref[:idx], ref[idx+1:]
+	}
+	return ref, ""
+}
@@ -1,6 +1,8 @@
 package nanocms_state
 
 import (
+	"io/fs"
+
 	nanocms_compiler "github.com/infra-whizz/wzcmslib/nanostate/compiler"
 	wzlib_utils "github.com/infra-whizz/wzlib/utils"
 )
@@ -14,6 +16,7 @@ type StateCompiler struct {
 	compiler   *nanocms_compiler.NstCompiler
 	stateIndex *NanoStateIndex
 	state      *Nanostate
+	data       *DataContext
 }
 
 func NewStateCompiler() *StateCompiler {
@@ -31,21 +34,99 @@ func (nst *StateCompiler) Index(roots ...string) *StateCompiler {
 	return nst
 }
 
+// IndexFS indexes state roots of the file system, e.g. embedded bundles
+func (nst *StateCompiler) IndexFS(fsys fs.FS, roots ...string) *StateCompiler {
+	nst.GetStateIndex().AddStateFS(fsys, roots...).Index()
+	return nst
+}
+
+// SetDataContext selects data files of the host for the next compilations.
+// Without the context only the defaults are used.
+func (nst *StateCompiler) SetDataContext(ctx *DataContext) *StateCompiler {
+	nst.data = ctx
+	return nst
+}
+
 // Compile state tree starting from the entry state as a resolvable path.
+// Problems in the state sources are returned as *nanocms_compiler.CompileError.
 func (nst *StateCompiler) Compile(indexPath string) (int, error) {
+	if err := nst.reset(); err != nil {
+		return wzlib_utils.EX_GENERIC, err
+	}
 	if err := nst.compiler.LoadFile(indexPath); err != nil {
 		return wzlib_utils.EX_GENERIC, err
 	}
+	return nst.compile()
+}
+
+// CompileState compiles state tree starting from the indexed state by its ID,
+// optionally pinned to a version, such as "pgsql@13". Other states of its
+// file are loaded as well.
+func (nst *StateCompiler) CompileState(ref string) (int, error) {
+	meta, err := nst.stateIndex.GetStateByVersion(nanocms_compiler.ParseStateRef(ref))
+	if err != nil {
+		return wzlib_utils.EX_GENERIC, err
+	}
+	if err := nst.reset(); err != nil {
+		return wzlib_utils.EX_GENERIC, err
+	}
+	if err := nst.loadMeta(meta); err != nil {
+		return wzlib_utils.EX_GENERIC, err
+	}
+	nst.compiler.SetRootState(nanocms_compiler.StateRef(meta.Id, meta.Version))
+	return nst.compile()
+}
+
+// CompileFS compiles state tree starting from the entry state on the file system
+func (nst *StateCompiler) CompileFS(fsys fs.FS, indexPath string) (int, error) {
+	if err := nst.reset(); err != nil {
+		return wzlib_utils.EX_GENERIC, err
+	}
+	if err := nst.compiler.LoadFS(fsys, indexPath); err != nil {
+		return wzlib_utils.EX_GENERIC, err
+	}
+	return nst.compile()
+}
+
+// CompileSource compiles state tree starting from the entry state in the memory.
+// Functions of the state are optional and can be nil.
+func (nst *StateCompiler) CompileSource(id string, state []byte, functions []byte) (int, error) {
+	if err := nst.reset(); err != nil {
+		return wzlib_utils.EX_GENERIC, err
+	}
+	if err := nst.compiler.LoadSource(id, state, functions); err != nil {
+		return wzlib_utils.EX_GENERIC, err
+	}
+	return nst.compile()
+}
+
+// Start a new compilation: states, loaded by the previous one, are dropped,
+// and data of the context is loaded before the functions of the states are imported
+func (nst *StateCompiler) reset() error {
+	nst.compiler = nanocms_compiler.NewNstCompiler()
+	nst.state = NewNanostate()
+	data, err := nst.stateIndex.LoadData(nst.data)
+	if err != nil {
+		return err
+	}
+	return nst.compiler.SetData(data)
+}
+
+// Load the rest of the states from the index and compile the tree
+func (nst *StateCompiler) compile() (int, error) {
 	// Load the entire chain of the local caller
 	for {
-		nextId := nst.compiler.Cycle()
-		cMeta, x := nst.stateIndex.GetStateById(nextId)
+		nextId, err := nst.compiler.Cycle()
+		if err != nil {
+			return wzlib_utils.EX_GENERIC, err
+		}
+		cMeta, x := nst.stateIndex.GetStateByVersion(nanocms_compiler.ParseStateRef(nextId))
 		if x != nil && nextId != "" {
 			nst.compiler.SquashState(nextId) // XXX: This still is not sure if state is optional!
 			continue
 		}
 		if cMeta != nil {
-			if err := nst.compiler.LoadFile(cMeta.Path); err != nil {
+			if err := nst.loadMeta(cMeta); err != nil {
 				return wzlib_utils.EX_GENERIC, err
 			}
 		} else {
@@ -53,13 +134,30 @@ func (nst *StateCompiler) Compile(indexPath string) (int, error) {
 		}
 	}
 
-	if err := nst.state.Load(nst.compiler.Tree()); err != nil {
+	tree, err := nst.compiler.Tree()
+	if err != nil {
+		return wzlib_utils.EX_GENERIC, err
+	}
+	if err := nst.state.Load(tree); err != nil {
 		return wzlib_utils.EX_GENERIC, err
 	}
 
 	return wzlib_utils.EX_OK, nil
 }
 
+// Load file of the indexed state
+func (nst *StateCompiler) loadMeta(meta *NanoStateMeta) error {
+	if meta.FS != nil {
+		return nst.compiler.LoadFS(meta.FS, meta.Path)
+	}
+	return nst.compiler.LoadFile(meta.Path)
+}
+
+// GetTrace returns decisions of the compiler, made during the last compilation.
+func (nst *StateCompiler) GetTrace() *nanocms_compiler.CompileTrace {
+	return nst.compiler.Trace()
+}
+
 // GetStateIndex returns an instance of the state index.
 func (nst *StateCompiler) GetStateIndex() *NanoStateIndex {
 	return nst.stateIndex
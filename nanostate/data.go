@@ -0,0 +1,126 @@
+/*
+Data files of the hosts ("pillar").
+
+Data is kept apart from the states in YAML or JSON files under the "data"
+directory of the state roots:
+
+	data/defaults.yml
+	data/environments/production.yml
+	data/groups/webservers.yml
+	data/hosts/web01.example.com.yml
+
+Files are merged in the order of precedence: defaults, environment, host
+groups in the given order, host. Mappings are merged key by key, while
+any other value of a file with a higher precedence replaces the previous
+one. Within the same level, files of the later roots take precedence.
+*/
+
+package nanocms_state
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+
+	nanocms_compiler "github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/yaml.v3"
+)
+
+// Directory of the data files in the state root
+const DATA_DIR = "data"
+
+// Extensions of the data files, in the order they are looked up
+var dataExtensions = []string{".yml", ".yaml", ".json"}
+
+// DataContext selects data files of the host
+type DataContext struct {
+	Environment string   // Empty for no environment
+	Groups      []string // Host groups, the later group takes precedence
+	Host        string   // Empty for no host
+}
+
+// Data files of the context without the extension, lowest precedence first
+func (ctx *DataContext) files() []string {
+	files := []string{"defaults"}
+	if ctx == nil {
+		return files
+	}
+	if ctx.Environment != "" {
+		files = append(files, path.Join("environments", ctx.Environment))
+	}
+	for _, group := range ctx.Groups {
+		files = append(files, path.Join("groups", group))
+	}
+	if ctx.Host != "" {
+		files = append(files, path.Join("hosts", ctx.Host))
+	}
+	return files
+}
+
+// LoadData of the context from all the state roots. Context can be nil for the defaults only.
+func (nsf *NanoStateIndex) LoadData(ctx *DataContext) (*nanocms_compiler.OTree, error) {
+	data := nanocms_compiler.NewOTree()
+	for _, name := range ctx.files() {
+		for _, root := range nsf.stateRoots {
+			for _, ext := range dataExtensions {
+				pth := filepath.Join(root, DATA_DIR, filepath.FromSlash(name)+ext)
+				src, err := ioutil.ReadFile(pth)
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				if err := mergeDataSource(data, pth, src, err); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, root := range nsf.stateFS {
+			for _, ext := range dataExtensions {
+				pth := path.Join(root.root, DATA_DIR, name+ext)
+				src, err := fs.ReadFile(root.fsys, pth)
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				if err := mergeDataSource(data, pth, src, err); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return data, nil
+}
+
+// Merge the content of the data file into the data
+func mergeDataSource(data *nanocms_compiler.OTree, pth string, src []byte, err error) error {
+	if err != nil {
+		return fmt.Errorf("Unable to read data file '%s': %s", pth, err.Error())
+	}
+	var node yaml.Node
+	if err := yaml.Unmarshal(src, &node); err != nil {
+		return fmt.Errorf("Unable to load data file '%s': %s", pth, err.Error())
+	}
+	if node.Kind == 0 {
+		return nil // Empty file
+	}
+	tree, err := nanocms_compiler.NewOTree().LoadNode(&node, pth)
+	if err != nil {
+		return fmt.Errorf("Unable to load data file '%s': %s", pth, err.Error())
+	}
+	mergeData(data, tree)
+	return nil
+}
+
+// Merge mappings of the data recursively. Other values replace the previous ones.
+func mergeData(data *nanocms_compiler.OTree, other *nanocms_compiler.OTree) {
+	for _, key := range other.Keys() {
+		current, isTree := data.Get(key, nil).(*nanocms_compiler.OTree)
+		update, isUpdate := other.Get(key, nil).(*nanocms_compiler.OTree)
+		if isTree && isUpdate {
+			mergeData(current, update)
+			continue
+		}
+		data.SetFrom(key, other, key)
+	}
+}
@@ -0,0 +1,824 @@
+/*
+Linter of the indexed states and their function files.
+
+Problems like a typo in a module name or a condition, that calls a function
+which is not defined, are found only at run time or when the state is
+compiled on the target. Linter finds them beforehand:
+
+	findings := nanocms_state.NewNanoStateLinter(index).Lint()
+	for _, finding := range findings {
+		fmt.Println(finding)
+	}
+
+Every state of the index is checked as a source and, if the source has no
+errors, it is compiled as well, with the data of the context, selected by
+SetDataContext, the same way as by the StateCompiler. Modules are looked
+up in the "modules" directory of the state roots, the same way as they are
+resolved by the runners. Modules are not checked, if there are no modules
+at all.
+
+Arguments of the modules in the compiled tree are checked against the
+argument specs of the modules, if they have any. Compiled Nanostate can
+be checked the same way before it runs:
+
+	findings := nanocms_state.NewNanoStateLinter(index).LintNanostate(state)
+*/
+
+package nanocms_state
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	nanocms_compiler "github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"go.starlark.net/syntax"
+	"gopkg.in/yaml.v3"
+)
+
+// LintSeverity of the finding
+type LintSeverity int
+
+const (
+	LINT_INFO LintSeverity = iota
+	LINT_WARNING
+	LINT_ERROR
+)
+
+// String name of the severity
+func (ls LintSeverity) String() string {
+	switch ls {
+	case LINT_INFO:
+		return "info"
+	case LINT_WARNING:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// LintKind is a type of the finding
+type LintKind string
+
+const (
+	LINT_UNKNOWN_MODULE    LintKind = "unknown-module"
+	LINT_MISSING_FUNCTION  LintKind = "missing-function"
+	LINT_UNUSED_FUNCTION   LintKind = "unused-function"
+	LINT_MISSING_HEADER    LintKind = "missing-header"
+	LINT_MISSING_REFERENCE LintKind = "missing-reference"
+	LINT_DUPLICATE_BLOCK   LintKind = "duplicate-block"
+	LINT_DUPLICATE_STATE   LintKind = "duplicate-state"
+	LINT_SYNTAX            LintKind = "syntax"
+	LINT_COMPILE           LintKind = "compile"
+	LINT_ARGUMENT_SPEC     LintKind = "argument-spec"
+	LINT_MISSING_ARGUMENT  LintKind = "missing-argument"
+	LINT_UNKNOWN_ARGUMENT  LintKind = "unknown-argument"
+	LINT_ARGUMENT_TYPE     LintKind = "argument-type"
+	LINT_ARGUMENT_CHOICE   LintKind = "argument-choice"
+)
+
+// LintFinding is a problem, found in the state source
+type LintFinding struct {
+	Kind     LintKind
+	Severity LintSeverity
+	StateId  string
+	Position *nanocms_compiler.Position // Place in the source, if known
+	Message  string
+}
+
+// String representation of the finding as "file:line:column: severity: message [kind]"
+func (lf *LintFinding) String() string {
+	msg := fmt.Sprintf("%s: %s [%s]", lf.Severity, lf.Message, lf.Kind)
+	if lf.Position != nil {
+		return fmt.Sprintf("%s: %s", lf.Position, msg)
+	}
+	if lf.StateId != "" {
+		return fmt.Sprintf("state '%s': %s", lf.StateId, msg)
+	}
+	return msg
+}
+
+// Source of the indexed state, loaded for the linter
+type lintSource struct {
+	meta      *NanoStateMeta
+	node      *yaml.Node // nil for the Starlark state
+	tree      *nanocms_compiler.OTree
+	functions []byte // nil if there is no function file
+	fnpath    string
+}
+
+// Names of the blocks, defined in the state
+func (src *lintSource) blocks() []string {
+	names := make([]string, 0)
+	if src.tree == nil || src.tree.GetBranch("state") == nil {
+		return names
+	}
+	for _, blockdef := range src.tree.GetBranch("state").Keys() {
+		if expr, err := nanocms_compiler.ParseCDL(fmt.Sprint(blockdef)); err == nil && expr.Name != "" {
+			names = append(names, expr.Name)
+		}
+	}
+	return names
+}
+
+// Function calls of the state, which are checked against its function file
+type lintCall struct {
+	name     string
+	position *nanocms_compiler.Position
+}
+
+// Module or its argument spec in the module roots
+type lintModule struct {
+	name string // Path of the module without the suffix, e.g. "system/user"
+	path string
+	fsys fs.FS // nil if the module is on the local disk
+}
+
+// Read the file of the module
+func (mod *lintModule) read() ([]byte, error) {
+	if mod.fsys != nil {
+		return fs.ReadFile(mod.fsys, mod.path)
+	}
+	return ioutil.ReadFile(mod.path)
+}
+
+// Module matches the name, the same way as the runners find it
+func (mod *lintModule) matches(modpath string) bool {
+	return mod.name == modpath || strings.HasSuffix(mod.name, "/"+modpath)
+}
+
+type NanoStateLinter struct {
+	index    *NanoStateIndex
+	sources  map[string]*lintSource
+	modules  []*lintModule // Modules in the module roots
+	sidecars []*lintModule // Argument specs of the modules
+	specs    map[string]*ModuleArgSpec
+	findings []*LintFinding
+	data     *DataContext
+	_seen    map[string]bool
+}
+
+func NewNanoStateLinter(index *NanoStateIndex) *NanoStateLinter {
+	nsl := new(NanoStateLinter)
+	nsl.index = index
+	nsl.sources = make(map[string]*lintSource)
+	nsl.specs = make(map[string]*ModuleArgSpec)
+	return nsl
+}
+
+// SetDataContext selects data files of the host, which the states are compiled with,
+// the same way as by the StateCompiler. Without the context only the defaults are used.
+func (nsl *NanoStateLinter) SetDataContext(ctx *DataContext) *NanoStateLinter {
+	nsl.data = ctx
+	return nsl
+}
+
+// Lint all states of the index in all their versions. Findings are sorted by their position.
+func (nsl *NanoStateLinter) Lint() []*LintFinding {
+	nsl.reset()
+	for _, id := range nsl.index.GetStateIds() {
+		for _, meta := range nsl.index.GetStateVersions(id) {
+			nsl.lintState(id, meta)
+		}
+		for _, state := range nsl.index.GetShadowedStates(id) {
+			nsl.report(LINT_DUPLICATE_STATE, LINT_WARNING, id, nil, "State '%s' at '%s' is shadowed by the same state at '%s'",
+				nanocms_compiler.StateRef(state.Shadowed.Id, state.Shadowed.Version), state.Shadowed.Path, state.By.Path)
+		}
+	}
+	return nsl.sorted()
+}
+
+// LintState lints only one state of the index by its ID, which can be pinned to a version as "<ID>@<VERSION>"
+func (nsl *NanoStateLinter) LintState(id string) []*LintFinding {
+	nsl.reset()
+	meta, err := nsl.index.GetStateByVersion(nanocms_compiler.ParseStateRef(id))
+	if err != nil {
+		nsl.report(LINT_SYNTAX, LINT_ERROR, id, nil, "Unable to load state: %s", err.Error())
+	} else {
+		nsl.lintState(id, meta)
+	}
+	return nsl.sorted()
+}
+
+// LintTree checks modules of the compiled tree and their arguments
+func (nsl *NanoStateLinter) LintTree(tree *nanocms_compiler.OTree) []*LintFinding {
+	nsl.reset()
+	nsl.lintTree(tree)
+	return nsl.sorted()
+}
+
+// LintNanostate checks modules of the compiled Nanostate and their arguments.
+// Nanostate does not know the source, so findings have no positions.
+func (nsl *NanoStateLinter) LintNanostate(state *Nanostate) []*LintFinding {
+	nsl.reset()
+	for _, group := range state.OrderedGroups() {
+		for _, module := range group.Group {
+			if nsl.lintModule(state.Id, module.Module, nil) && module.Args != nil {
+				nsl.lintArguments(state.Id, module.Module, module.Args, nil, nil, fmt.Sprintf("Block '%s', ", group.Id))
+			}
+		}
+	}
+	return nsl.sorted()
+}
+
+func (nsl *NanoStateLinter) reset() {
+	nsl.findings = make([]*LintFinding, 0)
+	nsl._seen = make(map[string]bool)
+	if nsl.modules == nil {
+		nsl.findModules()
+	}
+}
+
+// Add finding, unless exactly the same is already found
+func (nsl *NanoStateLinter) report(kind LintKind, severity LintSeverity, stateid string, pos *nanocms_compiler.Position,
+	msg string, args ...interface{}) {
+	finding := &LintFinding{Kind: kind, Severity: severity, StateId: stateid, Position: pos, Message: fmt.Sprintf(msg, args...)}
+	if nsl._seen[finding.String()] {
+		return
+	}
+	nsl._seen[finding.String()] = true
+	nsl.findings = append(nsl.findings, finding)
+}
+
+// Findings, sorted by the file and the position in it
+func (nsl *NanoStateLinter) sorted() []*LintFinding {
+	sort.SliceStable(nsl.findings, func(i, j int) bool {
+		a, b := nsl.findings[i].Position, nsl.findings[j].Position
+		switch {
+		case a == nil || b == nil:
+			return a == nil && b != nil
+		case a.File != b.File:
+			return a.File < b.File
+		case a.Line != b.Line:
+			return a.Line < b.Line
+		default:
+			return a.Column < b.Column
+		}
+	})
+	return nsl.findings
+}
+
+// Load the indexed state and its functions by the reference, that can be pinned to a version
+func (nsl *NanoStateLinter) getSource(ref string) (*lintSource, error) {
+	meta, err := nsl.index.GetStateByVersion(nanocms_compiler.ParseStateRef(ref))
+	if err != nil {
+		return nil, err
+	}
+	return nsl.loadSource(meta)
+}
+
+// Load the indexed state and its functions
+func (nsl *NanoStateLinter) loadSource(meta *NanoStateMeta) (*lintSource, error) {
+	key := nanocms_compiler.StateRef(meta.Id, meta.Version)
+	if src, ex := nsl.sources[key]; ex {
+		return src, nil
+	}
+
+	readFile := ioutil.ReadFile
+	if meta.FS != nil {
+		readFile = func(name string) ([]byte, error) { return fs.ReadFile(meta.FS, name) }
+	}
+	data, err := readFile(meta.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(meta.Path, ".star") { // Script is also the functions of the state
+		src := &lintSource{meta: meta, functions: data, fnpath: meta.Path}
+		if src.tree, err = nanocms_compiler.LoadStarState(meta.Path, data); err != nil {
+			return nil, err
+		}
+		nsl.sources[key] = src
+		return src, nil
+	}
+
+	src := &lintSource{meta: meta, fnpath: strings.TrimSuffix(meta.Path, ".st") + ".fn"}
+	decoder := yaml.NewDecoder(bytes.NewReader(data)) // Document of the state in the file
+	for idx := 0; idx <= meta.Document; idx++ {
+		src.node = &yaml.Node{}
+		if err := decoder.Decode(src.node); err != nil {
+			return nil, err
+		}
+	}
+	if src.tree, err = nanocms_compiler.NewOTree().LoadNode(src.node, meta.Path); err != nil {
+		return nil, err
+	}
+	if functions, err := readFile(src.fnpath); err == nil {
+		src.functions = functions
+	}
+
+	nsl.sources[key] = src
+	return src, nil
+}
+
+// Lint source of the state and compile it
+func (nsl *NanoStateLinter) lintState(id string, meta *NanoStateMeta) {
+	found := len(nsl.findings)
+	src, err := nsl.loadSource(meta)
+	if err != nil {
+		nsl.report(LINT_SYNTAX, LINT_ERROR, id, nil, "Unable to load state: %s", err.Error())
+		return
+	}
+
+	origin := src.tree.Origin()
+	for _, key := range []string{"id", "description"} {
+		if src.tree.GetString(key) == "" {
+			nsl.report(LINT_MISSING_HEADER, LINT_ERROR, id, origin, "State has no '%s'", key)
+		}
+	}
+
+	state := src.tree.GetBranch("state")
+	if state == nil {
+		nsl.report(LINT_MISSING_HEADER, LINT_ERROR, id, origin, "State has no 'state' section")
+		return
+	}
+
+	nsl.lintDuplicates(src)
+	calls := nsl.lintBlocks(src, state)
+	templates := nsl.templateNames(src.tree)
+	for name := range nsl.siblingNames(src) {
+		templates[name] = true
+	}
+	nsl.lintFunctions(src, calls, templates)
+
+	// Compilation would fail anyway on the same errors
+	for _, finding := range nsl.findings[found:] {
+		if finding.Severity == LINT_ERROR {
+			return
+		}
+	}
+	nsl.compile(src)
+}
+
+// Find blocks, that are defined several times. Same keys are overwritten by YAML,
+// while the same names with the other directives are compiled only once.
+func (nsl *NanoStateLinter) lintDuplicates(src *lintSource) {
+	doc := src.node
+	if doc == nil {
+		return // Starlark state fails on the same block anyway
+	}
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	var state *yaml.Node
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value == "state" {
+			state = doc.Content[i+1]
+		}
+	}
+	if state == nil || state.Kind != yaml.MappingNode {
+		return
+	}
+
+	keys := make(map[string]bool)
+	names := make(map[string]string)
+	for i := 0; i+1 < len(state.Content); i += 2 {
+		key := state.Content[i]
+		pos := &nanocms_compiler.Position{File: src.meta.Path, Line: key.Line, Column: key.Column}
+		if keys[key.Value] {
+			nsl.report(LINT_DUPLICATE_BLOCK, LINT_ERROR, src.meta.Id, pos, "Block '%s' is defined more than once", key.Value)
+			continue
+		}
+		keys[key.Value] = true
+
+		expr, err := nanocms_compiler.ParseCDL(key.Value)
+		if err != nil || expr.Name == "" {
+			continue
+		}
+		if other, ex := names[expr.Name]; ex {
+			nsl.report(LINT_DUPLICATE_BLOCK, LINT_WARNING, src.meta.Id, pos,
+				"Block '%s' has the same name as '%s', only one of them is compiled", key.Value, other)
+			continue
+		}
+		names[expr.Name] = key.Value
+	}
+}
+
+// Lint directives of the blocks and their modules. Returns all function calls.
+func (nsl *NanoStateLinter) lintBlocks(src *lintSource, state *nanocms_compiler.OTree) []*lintCall {
+	calls := make([]*lintCall, 0)
+	names := src.blocks()
+	for _, _blockdef := range state.Keys() {
+		blockdef := fmt.Sprint(_blockdef)
+		pos := state.KeyPosition(_blockdef)
+		expr, err := nanocms_compiler.ParseCDL(blockdef)
+		if err != nil {
+			nsl.report(LINT_SYNTAX, LINT_ERROR, src.meta.Id, pos, "%s", err.Error())
+			continue
+		}
+		calls = append(calls, nsl.exprCalls(expr, pos)...)
+
+		for _, inclusion := range expr.Inclusions {
+			ref := nanocms_compiler.StateRef(inclusion.Stateid, inclusion.Version)
+			nsl.lintReference(src, pos, ref, append(append([]string{}, inclusion.Blocks...), inclusion.Exclude...), inclusion.Optional)
+			if other, err := nsl.getSource(ref); err == nil {
+				names = append(names, other.blocks()...)
+			}
+		}
+		for _, dependency := range expr.Dependencies {
+			nsl.lintReference(src, pos, nanocms_compiler.StateRef(dependency.Stateid, dependency.Version), dependency.Blocks, false)
+		}
+
+		modules, ok := state.Get(_blockdef, nil).([]interface{})
+		if !ok {
+			continue
+		}
+		for idx, module := range modules {
+			if module, ok := module.(*nanocms_compiler.OTree); ok {
+				calls = append(calls, nsl.lintModules(src, module, state.ElementPosition(_blockdef, idx))...)
+			}
+		}
+	}
+
+	// Requisites can refer to any block of the state or the blocks, that are included into it
+	for _, _blockdef := range state.Keys() {
+		expr, err := nanocms_compiler.ParseCDL(fmt.Sprint(_blockdef))
+		if err != nil {
+			continue
+		}
+		for _, requisite := range expr.Requisites {
+			for _, block := range requisite.Blocks {
+				if !containsString(names, block) {
+					nsl.report(LINT_MISSING_REFERENCE, LINT_ERROR, src.meta.Id, state.KeyPosition(_blockdef),
+						"Requisite '@%s' refers to unknown block '%s'", requisite.Kind, block)
+				}
+			}
+		}
+	}
+
+	return calls
+}
+
+// Lint module calls of the block element. Returns function calls of the loops.
+func (nsl *NanoStateLinter) lintModules(src *lintSource, module *nanocms_compiler.OTree, pos *nanocms_compiler.Position) []*lintCall {
+	calls := make([]*lintCall, 0)
+	for _, modref := range module.Keys() {
+		modpos := module.KeyPosition(modref)
+		if modpos == nil {
+			modpos = pos
+		}
+		expr, err := nanocms_compiler.ParseCDL(fmt.Sprint(modref))
+		if err != nil {
+			nsl.report(LINT_SYNTAX, LINT_ERROR, src.meta.Id, modpos, "%s", err.Error())
+			continue
+		}
+		calls = append(calls, nsl.exprCalls(expr, modpos)...)
+		if expr.Name != "" {
+			nsl.lintModule(src.meta.Id, expr.Name, modpos)
+			continue
+		}
+
+		// Loop without a name feeds a list of modules
+		feeds, _ := module.Get(modref, nil).([]interface{})
+		for _, feed := range feeds {
+			if feed, ok := feed.(*nanocms_compiler.OTree); ok {
+				for _, name := range feed.Keys() {
+					nsl.lintModule(src.meta.Id, fmt.Sprint(name), feed.KeyPosition(name))
+				}
+			}
+		}
+	}
+	return calls
+}
+
+// Function calls of the line
+func (nsl *NanoStateLinter) exprCalls(expr *nanocms_compiler.CDLExpr, pos *nanocms_compiler.Position) []*lintCall {
+	calls := make([]*lintCall, 0)
+	for _, call := range expr.Condition.Calls() {
+		calls = append(calls, &lintCall{name: call.Function, position: pos})
+	}
+	if expr.Loop != nil {
+		calls = append(calls, &lintCall{name: expr.Loop.Function, position: pos})
+	}
+	return calls
+}
+
+// Lint reference to another state and its blocks. State can be pinned to a version as "<ID>@<VERSION>".
+func (nsl *NanoStateLinter) lintReference(src *lintSource, pos *nanocms_compiler.Position, ref string, blocks []string, optional bool) {
+	other, err := nsl.getSource(ref)
+	if err != nil {
+		if optional {
+			nsl.report(LINT_MISSING_REFERENCE, LINT_INFO, src.meta.Id, pos, "Optional state '%s' is not found", ref)
+		} else {
+			nsl.report(LINT_MISSING_REFERENCE, LINT_ERROR, src.meta.Id, pos, "State '%s' is not found", ref)
+		}
+		return
+	}
+	names := other.blocks()
+	for _, block := range blocks {
+		if !containsString(names, block) {
+			nsl.report(LINT_MISSING_REFERENCE, LINT_ERROR, src.meta.Id, pos, "State '%s' has no block '%s'", ref, block)
+		}
+	}
+}
+
+// Lint functions of the state: calls of the missing functions and functions, that are never used
+func (nsl *NanoStateLinter) lintFunctions(src *lintSource, calls []*lintCall, templates map[string]bool) {
+	defs := make(map[string]*nanocms_compiler.Position)
+	used := make(map[string]bool)
+	order := make([]string, 0)
+
+	if src.functions != nil {
+		file, err := syntax.Parse(src.fnpath, src.functions, 0)
+		if err != nil {
+			nsl.report(LINT_SYNTAX, LINT_ERROR, src.meta.Id, &nanocms_compiler.Position{File: src.fnpath}, "%s", err.Error())
+			return
+		}
+		for _, stmt := range file.Stmts {
+			if def, ok := stmt.(*syntax.DefStmt); ok {
+				start, _ := def.Name.Span()
+				defs[def.Name.Name] = &nanocms_compiler.Position{File: src.fnpath, Line: int(start.Line), Column: int(start.Col)}
+				order = append(order, def.Name.Name)
+			}
+		}
+		// Functions, that are called by the other functions
+		syntax.Walk(file, func(node syntax.Node) bool {
+			switch n := node.(type) {
+			case *syntax.DefStmt:
+				for _, stmt := range n.Body {
+					syntax.Walk(stmt, func(inner syntax.Node) bool {
+						if ident, ok := inner.(*syntax.Ident); ok {
+							used[ident.Name] = true
+						}
+						return true
+					})
+				}
+				return false
+			case *syntax.Ident:
+				used[n.Name] = true
+			}
+			return true
+		})
+	}
+
+	for _, call := range calls {
+		used[call.name] = true
+		if _, ex := defs[call.name]; !ex {
+			nsl.report(LINT_MISSING_FUNCTION, LINT_ERROR, src.meta.Id, call.position,
+				"Function '%s' is not defined in '%s'", call.name, src.fnpath)
+		}
+	}
+	for _, name := range order {
+		if !used[name] && !templates[name] {
+			nsl.report(LINT_UNUSED_FUNCTION, LINT_WARNING, src.meta.Id, defs[name], "Function '%s' is never used", name)
+		}
+	}
+}
+
+var lintTemplateName = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+// Names, that are referred in the templates of the state
+func (nsl *NanoStateLinter) templateNames(value interface{}) map[string]bool {
+	names := make(map[string]bool)
+	switch v := value.(type) {
+	case string:
+		for _, expr := range nanocms_compiler.TemplateExpressions(v) {
+			for _, name := range lintTemplateName.FindAllString(expr, -1) {
+				names[name] = true
+			}
+		}
+	case []interface{}:
+		for _, elem := range v {
+			for name := range nsl.templateNames(elem) {
+				names[name] = true
+			}
+		}
+	case *nanocms_compiler.OTree:
+		for _, key := range v.Keys() {
+			for name := range nsl.templateNames(v.Get(key, nil)) {
+				names[name] = true
+			}
+		}
+	}
+	return names
+}
+
+// Names, used by the other states of the same file, which share its functions
+func (nsl *NanoStateLinter) siblingNames(src *lintSource) map[string]bool {
+	names := make(map[string]bool)
+	for _, id := range nsl.index.GetStateIds() {
+		for _, meta := range nsl.index.GetStateVersions(id) {
+			if meta.Path != src.meta.Path || (meta.FS == nil) != (src.meta.FS == nil) || meta.Document == src.meta.Document {
+				continue
+			}
+			other, err := nsl.loadSource(meta)
+			if err != nil || other.tree.GetBranch("state") == nil {
+				continue
+			}
+			for name := range nsl.templateNames(other.tree) {
+				names[name] = true
+			}
+			state := other.tree.GetBranch("state")
+			for _, block := range state.Keys() {
+				for _, name := range lintTemplateName.FindAllString(fmt.Sprint(block), -1) {
+					names[name] = true
+				}
+				for _, module := range state.GetList(block) {
+					if module, ok := module.(*nanocms_compiler.OTree); ok {
+						for _, modref := range module.Keys() {
+							for _, name := range lintTemplateName.FindAllString(fmt.Sprint(modref), -1) {
+								names[name] = true
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return names
+}
+
+// Compile the state and lint its compiled tree
+func (nsl *NanoStateLinter) compile(src *lintSource) {
+	cmp := NewStateCompiler().SetDataContext(nsl.data)
+	cmp.stateIndex = nsl.index
+	if _, err := cmp.CompileState(nanocms_compiler.StateRef(src.meta.Id, src.meta.Version)); err != nil {
+		var pos *nanocms_compiler.Position
+		msg := err.Error()
+		if ce, ok := err.(*nanocms_compiler.CompileError); ok && ce.Position != nil && ce.Cause != nil {
+			pos, msg = ce.Position, ce.Cause.Error()
+		}
+		nsl.report(LINT_COMPILE, LINT_ERROR, src.meta.Id, pos, "%s", msg)
+		return
+	}
+	if tree, err := cmp.compiler.Tree(); err == nil {
+		nsl.lintTree(tree)
+	}
+}
+
+// Lint modules of the compiled tree
+func (nsl *NanoStateLinter) lintTree(tree *nanocms_compiler.OTree) {
+	state := tree.GetBranch("state")
+	if state == nil {
+		return
+	}
+	stateid := tree.GetString("id")
+	for _, block := range state.Keys() {
+		for idx, module := range state.GetList(block) {
+			module, ok := module.(*nanocms_compiler.OTree)
+			if !ok {
+				continue
+			}
+			for _, name := range module.Keys() {
+				pos := module.KeyPosition(name)
+				if pos == nil {
+					pos = state.ElementPosition(block, idx)
+				}
+				if !nsl.lintModule(stateid, fmt.Sprint(name), pos) {
+					continue
+				}
+				argtree, _ := module.Get(name, nil).(*nanocms_compiler.OTree)
+				switch args := plainValue(module.Get(name, nil)).(type) {
+				case nil:
+					nsl.lintArguments(stateid, fmt.Sprint(name), map[string]interface{}{}, pos, nil, "")
+				case map[string]interface{}:
+					nsl.lintArguments(stateid, fmt.Sprint(name), args, pos, argtree, "")
+				}
+			}
+		}
+	}
+}
+
+// Lint arguments of the module against its spec, if there is any.
+// Problems point to the arguments in the source, if they are known.
+func (nsl *NanoStateLinter) lintArguments(stateid string, name string, args map[string]interface{}, pos *nanocms_compiler.Position,
+	argtree *nanocms_compiler.OTree, context string) {
+	spec, err := nsl.getArgSpec(name)
+	if err != nil {
+		nsl.report(LINT_ARGUMENT_SPEC, LINT_WARNING, stateid, pos, "%s%s", context, err.Error())
+		return
+	}
+	if spec == nil {
+		return
+	}
+	for _, problem := range spec.Check(args) {
+		argpos := pos
+		if argtree != nil && problem.Kind != LINT_MISSING_ARGUMENT {
+			if keypos := argtree.KeyPosition(strings.SplitN(problem.Argument, ".", 2)[0]); keypos != nil {
+				argpos = keypos
+			}
+		}
+		nsl.report(problem.Kind, LINT_ERROR, stateid, argpos, "%sModule '%s': %s", context, name, problem.Message)
+	}
+}
+
+// Path of the module, as it is looked up in the module roots
+func lintModulePath(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(name, "ansible.")), ".", "/")
+}
+
+// Argument spec of the module from its sidecar or documentation. Modules
+// without any spec are not checked, so nil spec is not an error.
+func (nsl *NanoStateLinter) getArgSpec(name string) (*ModuleArgSpec, error) {
+	modpath := lintModulePath(name)
+	if spec, ex := nsl.specs[modpath]; ex {
+		return spec, nil
+	}
+
+	var spec *ModuleArgSpec
+	var err error
+	for _, sidecar := range nsl.sidecars {
+		if sidecar.matches(modpath) {
+			var data []byte
+			if data, err = sidecar.read(); err == nil {
+				spec, err = ParseModuleArgSpec(name, data)
+			}
+			break
+		}
+	}
+	if spec == nil && err == nil {
+		for _, module := range nsl.modules {
+			if module.matches(modpath) && strings.HasSuffix(module.path, ".py") {
+				var data []byte
+				if data, err = module.read(); err == nil {
+					if bytes.Contains(data, []byte("DOCUMENTATION")) {
+						spec, err = ParseModuleDocumentation(name, data)
+					}
+				}
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read argument spec of module '%s': %s", name, err.Error())
+	}
+	nsl.specs[modpath] = spec
+	return spec, nil
+}
+
+// Lint the module name. Returns true if the module is found.
+func (nsl *NanoStateLinter) lintModule(stateid string, name string, pos *nanocms_compiler.Position) bool {
+	if name == "shell" || len(nsl.modules) == 0 {
+		return false
+	}
+	modpath := lintModulePath(name)
+	for _, module := range nsl.modules {
+		if module.matches(modpath) {
+			return true
+		}
+	}
+	nsl.report(LINT_UNKNOWN_MODULE, LINT_ERROR, stateid, pos, "Module '%s' is not found in the module roots", name)
+	return false
+}
+
+// Find modules and their argument specs in the "modules" directory of the state roots.
+// Python modules are named by their path, binary modules by their path in the platform directory.
+func (nsl *NanoStateLinter) findModules() {
+	nsl.modules = make([]*lintModule, 0)
+	nsl.sidecars = make([]*lintModule, 0)
+	add := func(fsys fs.FS, pth string, rel string) {
+		name := rel
+		if parts := strings.SplitN(rel, "/", 4); len(parts) == 4 && parts[0] == "bin" {
+			name = parts[3]
+		}
+		for _, suffix := range argSpecSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				nsl.sidecars = append(nsl.sidecars, &lintModule{name: strings.TrimSuffix(name, suffix), path: pth, fsys: fsys})
+				return
+			}
+		}
+		if name != rel || strings.HasSuffix(name, ".py") {
+			nsl.modules = append(nsl.modules, &lintModule{name: strings.TrimSuffix(name, ".py"), path: pth, fsys: fsys})
+		}
+	}
+
+	for _, root := range nsl.index.GetStateRoots() {
+		moduleRoot := filepath.Join(root, "modules")
+		filepath.Walk(moduleRoot, func(pth string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			if rel, err := filepath.Rel(moduleRoot, pth); err == nil {
+				add(nil, pth, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+	}
+	for _, root := range nsl.index.stateFS {
+		moduleRoot := path.Join(root.root, "modules")
+		fs.WalkDir(root.fsys, moduleRoot, func(pth string, entry fs.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return nil
+			}
+			add(root.fsys, pth, strings.TrimPrefix(strings.TrimPrefix(pth, moduleRoot), "/"))
+			return nil
+		})
+	}
+}
+
+// List contains the string
+func containsString(list []string, value string) bool {
+	for _, elem := range list {
+		if elem == value {
+			return true
+		}
+	}
+	return false
+}
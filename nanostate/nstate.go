@@ -7,35 +7,37 @@ id: some-Nanostate
 descr: This describes what this Nanostate is for.
 
 state:
-  maintain-database:
-	- sshrunner:
-	  - stop-db: systemctl stop postgresql.service
-	  - backup-db: pg-backup /var/lib/pgsql/data /opt/backups/
-	  - start-db: systemctl start postgresql.service
-	- somemodule:
-	  keyparam: valueparam
-	  keyparam2: valueparam2
-	  keyparam3: valueparam3
-
-  some-other-group:
-	- sshrunner:
-	  - uptime: uptime
-	  - id : cat /etc/machine-id
+
+	  maintain-database:
+		- sshrunner:
+		  - stop-db: systemctl stop postgresql.service
+		  - backup-db: pg-backup /var/lib/pgsql/data /opt/backups/
+		  - start-db: systemctl start postgresql.service
+		- somemodule:
+		  keyparam: valueparam
+		  keyparam2: valueparam2
+		  keyparam3: valueparam3
+
+	  some-other-group:
+		- sshrunner:
+		  - uptime: uptime
+		  - id : cat /etc/machine-id
+
 ----------------------------------------------
 
 In the example above, three fields are required:
 
-- id
-  This an ID of the Nanostate. It is used for the
-  reporting at the end.
+  - id
+    This an ID of the Nanostate. It is used for the
+    reporting at the end.
 
-- descr:
-  Description of the Nanostate. Also reporting.
+  - descr:
+    Description of the Nanostate. Also reporting.
 
-- state:
-  This is the entire tree of the Nanostate structure.
-  It has twofold tree: a group IDs with a list of
-  modules and the params or commands below.
+  - state:
+    This is the entire tree of the Nanostate structure.
+    It has twofold tree: a group IDs with a list of
+    modules and the params or commands below.
 
 Currently only one module is implemented: sshrunner,
 which performs a series of synchronous commands in
@@ -43,12 +45,26 @@ the order they were placed for orchestration purposes.
 
 In the nanoNanostate groups are asynchronous, but the
 commands inside the groups are synchronous.
+
+Nanostate is loaded from the compiled tree, where the
+"state" has only static groups in the order they can be
+performed, and two more sections are added:
+
+  - graph:
+    Groups, that each group requires, i.e. the "&"
+    dependencies. Required groups of the other states are
+    separate groups, named as "state/group", rather than
+    the modules of the groups, which require them.
+
+  - requisites:
+    Run time requisites of the groups by their kind, such
+    as "onchanges" or "onfail". Only groups with any
+    requisites are listed.
 */
 package nanocms_state
 
 import (
-	"errors"
-	"reflect"
+	"fmt"
 
 	nanocms_compiler "github.com/infra-whizz/wzcmslib/nanostate/compiler"
 )
@@ -60,12 +76,18 @@ type StateModule struct {
 }
 
 type StateGroup struct {
-	Id    string
-	Group []*StateModule
+	Id       string
+	Group    []*StateModule
+	Requires []string // Groups, that should be performed before this one
+
+	// Run time requisites per kind, i.e. "require", "onchanges" or "onfail",
+	// on the groups, that are performed before this one
+	Requisites map[string][]string
 }
 
 type Nanostate struct {
 	Id         string
+	Version    string // Empty if the state is not versioned
 	Descr      string
 	Groups     []*StateGroup
 	GroupIndex []string
@@ -89,54 +111,159 @@ func (pb *Nanostate) OrderedGroups() []*StateGroup {
 }
 
 // Load Nanostate tree, which is already compiled statically and vaildated.
+// Groups and their modules are loaded in the order of the tree.
 func (pb *Nanostate) Load(tree *nanocms_compiler.OTree) error {
+	if err := pb.validate(tree); err != nil {
+		return err
+	}
+
+	pb.Id = tree.GetString("id")
+	pb.Version = tree.GetString("version")
+	pb.Descr = tree.GetString("description")
 	pb.Groups = make([]*StateGroup, 0)
 	pb.GroupIndex = make([]string, 0)
-	sTree := tree.Serialise()
+	pb.loadState(tree.GetBranch("state"))
+	if graph := tree.GetBranch("graph"); graph != nil {
+		for _, group := range pb.Groups {
+			for _, req := range graph.GetList(group.Id) {
+				group.Requires = append(group.Requires, req.(string))
+			}
+		}
+	}
+	if requisites := tree.GetBranch("requisites"); requisites != nil {
+		for _, group := range pb.Groups {
+			if kinds := requisites.GetBranch(group.Id); kinds != nil {
+				for _, kind := range kinds.Keys() {
+					for _, block := range kinds.GetList(kind) {
+						group.Requisites[kind.(string)] = append(group.Requisites[kind.(string)], block.(string))
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Error, that points to the position in the state source, if that is known
+func (pb *Nanostate) errorAt(pos *nanocms_compiler.Position, format string, args ...interface{}) error {
+	if pos == nil {
+		return fmt.Errorf(format, args...)
+	}
+	return fmt.Errorf("%s: %s", pos, fmt.Sprintf(format, args...))
+}
+
+// Validate the structure of the compiled tree before loading it
+func (pb *Nanostate) validate(tree *nanocms_compiler.OTree) error {
+	for _, rootKey := range []string{"id", "description"} {
+		if tree.GetString(rootKey) == "" {
+			return pb.errorAt(tree.Origin(), "Broken state: %s is missing", rootKey)
+		}
+	}
 
-	for _, groupId := range tree.GetBranch("state").Keys() {
-		pb.GroupIndex = append(pb.GroupIndex, groupId.(string))
+	state := tree.GetBranch("state")
+	if state == nil {
+		return pb.errorAt(tree.Origin(), "Broken state: state itself is missing")
 	}
 
-	for _, rootKey := range []string{"id", "description", "state"} {
-		if val, ex := sTree[rootKey]; ex {
-			switch rootKey {
-			case "id":
-				pb.Id = val.(string)
-			case "description":
-				pb.Descr = val.(string)
-			case "state":
-				pb.loadState(val)
+	for _, groupId := range state.Keys() {
+		if _, ok := groupId.(string); !ok {
+			return pb.errorAt(state.KeyPosition(groupId), "Block ID '%v' should be a string", groupId)
+		}
+		modules := state.GetList(groupId)
+		if modules == nil {
+			return pb.errorAt(state.KeyPosition(groupId), "Block '%s' should be a list of modules", groupId)
+		}
+		for idx, mobj := range modules {
+			module, ok := mobj.(*nanocms_compiler.OTree)
+			if !ok || len(module.Keys()) != 1 {
+				return pb.errorAt(state.ElementPosition(groupId, idx), "Block '%s' should have exactly one module per list element", groupId)
+			}
+			for _, mname := range module.Keys() {
+				if _, ok := mname.(string); !ok {
+					return pb.errorAt(module.KeyPosition(mname), "Module name '%v' should be a string", mname)
+				}
 			}
 		}
 	}
 
-	pb.Groups = pb.OrderedGroups()
+	if tree.Exists("graph") {
+		graph := tree.GetBranch("graph")
+		if graph == nil {
+			return pb.errorAt(tree.KeyPosition("graph"), "Block graph should be a mapping")
+		}
+		for _, groupId := range graph.Keys() {
+			requires, ok := graph.Get(groupId, nil).([]interface{})
+			if !ok {
+				return pb.errorAt(graph.KeyPosition(groupId), "Requisites of the block '%v' should be a list", groupId)
+			}
+			for _, req := range requires {
+				if name, ok := req.(string); !ok || !state.Exists(name) {
+					return pb.errorAt(graph.KeyPosition(groupId), "Block '%v' requires unknown block '%v'", groupId, req)
+				}
+			}
+		}
+	}
 
-	var err error
-	if pb.Id == "" || pb.Descr == "" || pb.Groups == nil {
-		err = errors.New("Broken state: id or description or state itself is missing")
+	if tree.Exists("requisites") {
+		return pb.validateRequisites(tree.GetBranch("requisites"), tree.KeyPosition("requisites"), state)
 	}
-	return err
+	return nil
+}
+
+// Validate run time requisites of the blocks. Requisites can refer to
+// the blocks, that are not in the state, as these are never performed.
+func (pb *Nanostate) validateRequisites(requisites *nanocms_compiler.OTree, pos *nanocms_compiler.Position, state *nanocms_compiler.OTree) error {
+	if requisites == nil {
+		return pb.errorAt(pos, "Block requisites should be a mapping")
+	}
+	for _, groupId := range requisites.Keys() {
+		if name, ok := groupId.(string); !ok || !state.Exists(name) {
+			return pb.errorAt(requisites.KeyPosition(groupId), "Requisites are defined for unknown block '%v'", groupId)
+		}
+		kinds := requisites.GetBranch(groupId)
+		if kinds == nil {
+			return pb.errorAt(requisites.KeyPosition(groupId), "Requisites of the block '%v' should be a mapping", groupId)
+		}
+		for _, kind := range kinds.Keys() {
+			switch kind {
+			case nanocms_compiler.CDL_R_REQUIRE, nanocms_compiler.CDL_R_ONCHANGES, nanocms_compiler.CDL_R_ONFAIL:
+			default:
+				return pb.errorAt(kinds.KeyPosition(kind), "Block '%v' has unknown requisite '%v'", groupId, kind)
+			}
+			blocks, ok := kinds.Get(kind, nil).([]interface{})
+			if !ok {
+				return pb.errorAt(kinds.KeyPosition(kind), "Requisite '%v' of the block '%v' should be a list", kind, groupId)
+			}
+			for _, block := range blocks {
+				if _, ok := block.(string); !ok {
+					return pb.errorAt(kinds.KeyPosition(kind), "Requisite '%v' of the block '%v' should be a list of block names", kind, groupId)
+				}
+			}
+		}
+	}
+	return nil
 }
 
 // Load the state, splitting groups and modules
-func (pb *Nanostate) loadState(state interface{}) {
-	// Load groups
-	for gname, gobj := range state.(map[string]interface{}) {
-		pb.Groups = append(pb.Groups, pb.loadGroup(gname, gobj))
+func (pb *Nanostate) loadState(state *nanocms_compiler.OTree) {
+	for _, gname := range state.Keys() {
+		pb.GroupIndex = append(pb.GroupIndex, gname.(string))
+		pb.Groups = append(pb.Groups, pb.loadGroup(gname.(string), state.GetList(gname)))
 	}
 }
 
 // Load a group
-func (pb *Nanostate) loadGroup(name string, gobj interface{}) *StateGroup {
+func (pb *Nanostate) loadGroup(name string, modules []interface{}) *StateGroup {
 	group := &StateGroup{
-		Id:    name,
-		Group: make([]*StateModule, 0),
+		Id:         name,
+		Group:      make([]*StateModule, 0),
+		Requires:   make([]string, 0),
+		Requisites: make(map[string][]string),
 	}
 
-	for _, mobj := range gobj.([]interface{}) {
-		instr := pb.loadModuleInstructions(mobj)
+	for _, mobj := range modules {
+		instr := pb.loadModuleInstructions(mobj.(*nanocms_compiler.OTree))
 		if instr != nil {
 			group.Group = append(group.Group, instr)
 		}
@@ -145,23 +272,46 @@ func (pb *Nanostate) loadGroup(name string, gobj interface{}) *StateGroup {
 }
 
 // Load an arbitrary module instructions (parameters)
-func (pb *Nanostate) loadModuleInstructions(mobj interface{}) *StateModule {
+func (pb *Nanostate) loadModuleInstructions(mobj *nanocms_compiler.OTree) *StateModule {
 	// Note: always length of 1
 	var module *StateModule
-	for mname, minstr := range mobj.(map[string]interface{}) {
+	for _, mname := range mobj.Keys() {
 		module = &StateModule{
+			Module:       mname.(string),
 			Instructions: make([]interface{}, 0),
 		}
-		module.Module = mname
-		tMinstr := reflect.ValueOf(minstr).Kind()
-		if tMinstr == reflect.Slice {
-			module.Instructions = append(module.Instructions, minstr.([]interface{})...)
-		} else if tMinstr == reflect.Map {
-			module.Args = make(map[string]interface{})
-			for argname, argval := range minstr.(map[string]interface{}) {
-				module.Args[argname] = argval
-			}
+		switch minstr := plainValue(mobj.Get(mname, nil)).(type) {
+		case []interface{}:
+			module.Instructions = append(module.Instructions, minstr...)
+		case map[string]interface{}:
+			module.Args = minstr
 		}
 	}
 	return module
 }
+
+// Plain Go value of the compiled tree: nested trees become maps with string keys
+func plainValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *nanocms_compiler.OTree:
+		out := make(map[string]interface{})
+		for _, key := range v.Keys() {
+			out[fmt.Sprint(key)] = plainValue(v.Get(key, nil))
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			out = append(out, plainValue(elem))
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{})
+		for key, elem := range v {
+			out[fmt.Sprint(key)] = plainValue(elem)
+		}
+		return out
+	default:
+		return value
+	}
+}
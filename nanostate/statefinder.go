@@ -1,20 +1,45 @@
 /*
 Nanostate is loaded by Id or filename.
+
+The same state Id can be indexed in several versions. Lookup by the Id
+returns the highest version, and a specific version is found by the
+version constraint, such as "13" or ">=12".
+
+State file can have several states, one per YAML document:
+
+	id: nginx
+	description: Web server
+	state:
+	  ...
+	---
+	id: nginx-config
+	description: Configuration of the web server
+	state:
+	  ...
+
+Each state is indexed by its file and the index of its document. All the
+states of the file share the same functions file. States, written in
+Starlark, are files with suffix ".star", one state per file.
 */
 
 package nanocms_state
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 
-	"github.com/go-yaml/yaml"
+	nanocms_compiler "github.com/infra-whizz/wzcmslib/nanostate/compiler"
 	"github.com/infra-whizz/wzcmslib/nanoutils"
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 var logger *logrus.Logger
@@ -31,26 +56,45 @@ type NanoStateFunctionsMeta struct {
 
 type NanoStateMeta struct {
 	Id        string
+	Version   string // Empty if the state is not versioned
+	Document  int    // Index of the YAML document of the state in the file
 	Filename  string
 	Path      string
 	Info      *os.FileInfo
 	Functions *NanoStateFunctionsMeta
+	FS        fs.FS // File system of the state, nil if the state is on the local disk
+}
+
+// State root on a file system
+type nanoStateFSRoot struct {
+	fsys fs.FS
+	root string
 }
 
 type NanoStateIndex struct {
 	stateRoots []string
-	_id_index  map[string]int
+	stateFS    []*nanoStateFSRoot
+	_id_index  map[string][]int // All versions of the state Id
 	_fn_index  map[string]int
 	_mt_index  map[int]NanoStateMeta
+	_shadowed  map[int]int // State, replaced by another one of the same Id and version, to the one that replaces it
 	_ct        int
 }
 
+// ShadowedState is a state, replaced in the index by another state of the same Id and version
+type ShadowedState struct {
+	Shadowed *NanoStateMeta
+	By       *NanoStateMeta
+}
+
 func NewNanoStateIndex() *NanoStateIndex {
 	nsf := new(NanoStateIndex)
 	nsf.stateRoots = make([]string, 0)
-	nsf._id_index = make(map[string]int)
+	nsf.stateFS = make([]*nanoStateFSRoot, 0)
+	nsf._id_index = make(map[string][]int)
 	nsf._fn_index = make(map[string]int)
 	nsf._mt_index = make(map[int]NanoStateMeta)
+	nsf._shadowed = make(map[int]int)
 
 	return nsf
 }
@@ -74,35 +118,99 @@ func (nsf *NanoStateIndex) AddStateRoots(pth ...string) *NanoStateIndex {
 	return nsf
 }
 
+// AddStateFS is used to chain-add state roots of the file system, such as embedded bundles.
+// Without roots the entire file system is indexed.
+func (nsf *NanoStateIndex) AddStateFS(fsys fs.FS, roots ...string) *NanoStateIndex {
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	for _, root := range roots {
+		nsf.stateFS = append(nsf.stateFS, &nanoStateFSRoot{fsys: fsys, root: root})
+	}
+	return nsf
+}
+
 // Index all the files in the all roots
 func (nsf *NanoStateIndex) Index() *NanoStateIndex {
 	nsf._ct = len(nsf._mt_index)
 	for _, root := range nsf.stateRoots {
 		nsf.getPathFiles(root)
 	}
+	for _, root := range nsf.stateFS {
+		nsf.getFSFiles(root.fsys, root.root)
+	}
 	return nsf
 }
 
-// This only unmarshalls the state and fetches its ID
-func (nsf *NanoStateIndex) getStateId(pth string) (string, error) {
+// State of the YAML document in the file
+type nanoStateDocument struct {
+	id       string
+	version  string
+	document int
+}
+
+// This only unmarshalls the states of the file and fetches their IDs and versions.
+// Documents without an ID are skipped.
+func (nsf *NanoStateIndex) getStateIds(fsys fs.FS, pth string) ([]*nanoStateDocument, error) {
 	logger.Debugln("Loading state ID by path", pth)
 
-	data, err := ioutil.ReadFile(pth)
+	var data []byte
+	var err error
+	if fsys != nil {
+		data, err = fs.ReadFile(fsys, pth)
+	} else {
+		data, err = ioutil.ReadFile(pth)
+	}
 	if err != nil {
 		logger.Errorf("Error reading state file '%s': %s", pth, err.Error())
-		return "", err
+		return nil, err
 	}
-	var state map[string]interface{}
-	err = yaml.Unmarshal(data, &state)
-	if err != nil {
-		logger.Errorf("Error loading state '%s': %s", pth, err.Error())
-		return "", err
+	if strings.HasSuffix(pth, ".star") {
+		id, version, err := nanocms_compiler.ParseStarStateId(pth, data)
+		if err != nil {
+			logger.Errorf("Error loading state '%s': %s", pth, err.Error())
+			return nil, err
+		}
+		return []*nanoStateDocument{{id: id, version: version}}, nil
+	}
+
+	docs := make([]*nanoStateDocument, 0)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for idx := 0; ; idx++ {
+		var state yaml.Node
+		err = decoder.Decode(&state)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			logger.Errorf("Error loading state '%s': %s", pth, err.Error())
+			return nil, err
+		}
+		stateId := documentScalar(&state, "id")
+		if stateId == "" {
+			logger.Debugf("State %s, document %d has no id, skipping", pth, idx)
+			continue
+		}
+		docs = append(docs, &nanoStateDocument{id: stateId, version: documentScalar(&state, "version"), document: idx})
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("State %s has no id, skipping", pth)
+	}
+	return docs, nil
+}
+
+// Scalar of the key in the YAML document as it is written, so the version "1.10" is not 1.1.
+// Missing key, null or not a scalar is empty.
+func documentScalar(doc *yaml.Node, key string) string {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return ""
 	}
-	stateId, ex := state["id"]
-	if !ex {
-		return "", fmt.Errorf("State %s has no id, skipping", pth)
+	mapping := doc.Content[0]
+	for idx := 0; idx+1 < len(mapping.Content); idx += 2 {
+		if value := mapping.Content[idx+1]; mapping.Content[idx].Value == key && value.Kind == yaml.ScalarNode && value.Tag != "!!null" {
+			return value.Value
+		}
 	}
-	return stateId.(string), nil
+	return ""
 }
 
 func (nsf *NanoStateIndex) getPathFiles(root string) {
@@ -111,39 +219,153 @@ func (nsf *NanoStateIndex) getPathFiles(root string) {
 			if err != nil {
 				return err
 			}
-			if !info.IsDir() && strings.HasSuffix(info.Name(), ".st") { // Filter out only state files
-				stateId, err := nsf.getStateId(pth)
+			if !info.IsDir() && isStateFile(info.Name()) {
+				nsf.addState(nil, pth, info)
+			}
+			return nil
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Index the states of the root in the file system. Missing or unreadable root or directory
+// is skipped with an error, so the rest of the states are still indexed.
+func (nsf *NanoStateIndex) getFSFiles(fsys fs.FS, root string) {
+	fs.WalkDir(fsys, root,
+		func(pth string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				logger.Errorf("Error indexing states at '%s': %s", pth, err.Error())
+				return nil
+			}
+			if !entry.IsDir() && isStateFile(entry.Name()) {
+				info, err := entry.Info()
 				if err != nil {
-					logger.Debugln("Skipping state", pth)
+					logger.Errorf("Error indexing state '%s': %s", pth, err.Error())
 					return nil
 				}
-				// Load state
-				nsm := &NanoStateMeta{
-					Id:       stateId,
-					Filename: path.Base(pth),
-					Path:     pth,
-					Info:     &info,
-				}
-				nsf._mt_index[nsf._ct] = *nsm
-				nsf._fn_index[nsm.Filename] = nsf._ct
-				nsf._id_index[nsm.Id] = nsf._ct
-				nsf._ct++
+				nsf.addState(fsys, pth, info)
 			}
 			return nil
 		})
+}
+
+// Filter out only state files, either YAML or Starlark
+func isStateFile(name string) bool {
+	return strings.HasSuffix(name, ".st") || strings.HasSuffix(name, ".star")
+}
+
+// Add state file to the index
+func (nsf *NanoStateIndex) addState(fsys fs.FS, pth string, info os.FileInfo) {
+	docs, err := nsf.getStateIds(fsys, pth)
 	if err != nil {
-		panic(err)
+		logger.Debugln("Skipping state", pth)
+		return
+	}
+	for idx, doc := range docs {
+		nsm := &NanoStateMeta{
+			Id:       doc.id,
+			Version:  doc.version,
+			Document: doc.document,
+			Filename: path.Base(pth),
+			Path:     pth,
+			Info:     &info,
+			FS:       fsys,
+		}
+		nsf._mt_index[nsf._ct] = *nsm
+		if idx == 0 { // File name is of its first state
+			nsf._fn_index[nsm.Filename] = nsf._ct
+		}
+		nsf.indexVersion(nsm.Id, nsm.Version, nsf._ct)
+		nsf._ct++
 	}
 }
 
-func (nsf *NanoStateIndex) GetStateById(id string) (*NanoStateMeta, error) {
-	fp, ok := nsf._id_index[id]
-	if !ok {
-		return nil, fmt.Errorf("No state can be found by Id %s", id)
+// Add the state to the versions of its Id. The same version, indexed again, replaces the previous one,
+// and the previous one is shadowed, unless it is the same state of the same file.
+func (nsf *NanoStateIndex) indexVersion(id string, version string, fp int) {
+	versions := nsf._id_index[id]
+	for idx, vfp := range versions {
+		if nsf._mt_index[vfp].Version == version {
+			prev, meta := nsf._mt_index[vfp], nsf._mt_index[fp]
+			if prev.Path != meta.Path || prev.FS != meta.FS || prev.Document != meta.Document {
+				logger.Warnf("State '%s' at '%s' is shadowed by the same state at '%s'",
+					nanocms_compiler.StateRef(id, version), prev.Path, meta.Path)
+				nsf._shadowed[vfp] = fp
+			}
+			versions[idx] = fp
+			return
+		}
 	}
+	nsf._id_index[id] = append(versions, fp)
+}
 
-	nstm := nsf._mt_index[fp]
-	return &nstm, nil
+// GetShadowedStates returns states of the Id, that are replaced by the other states
+// of the same version, in the order they were indexed
+func (nsf *NanoStateIndex) GetShadowedStates(id string) []*ShadowedState {
+	states := make([]*ShadowedState, 0)
+	for idx := 0; idx < nsf._ct; idx++ {
+		by, ex := nsf._shadowed[idx]
+		if !ex || nsf._mt_index[idx].Id != id {
+			continue
+		}
+		shadowed, meta := nsf._mt_index[idx], nsf._mt_index[by]
+		states = append(states, &ShadowedState{Shadowed: &shadowed, By: &meta})
+	}
+	return states
+}
+
+// GetStateIds returns IDs of all indexed states in the order they were indexed
+func (nsf *NanoStateIndex) GetStateIds() []string {
+	ids := make([]string, 0, len(nsf._id_index))
+	for idx := 0; idx < nsf._ct; idx++ {
+		if meta, ex := nsf._mt_index[idx]; ex {
+			if versions := nsf._id_index[meta.Id]; len(versions) > 0 && versions[0] == idx {
+				ids = append(ids, meta.Id)
+			}
+		}
+	}
+	return ids
+}
+
+// GetStateVersions returns all indexed versions of the state, from the lowest to the highest
+func (nsf *NanoStateIndex) GetStateVersions(id string) []*NanoStateMeta {
+	versions := make([]*NanoStateMeta, 0, len(nsf._id_index[id]))
+	for _, fp := range nsf._id_index[id] {
+		nstm := nsf._mt_index[fp]
+		versions = append(versions, &nstm)
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return nanocms_compiler.CompareVersions(versions[i].Version, versions[j].Version) < 0
+	})
+	return versions
+}
+
+// GetStateById returns the highest version of the state
+func (nsf *NanoStateIndex) GetStateById(id string) (*NanoStateMeta, error) {
+	return nsf.GetStateByVersion(id, "")
+}
+
+// GetStateByVersion returns the highest version of the state, that matches the version constraint.
+// Empty constraint matches any version.
+func (nsf *NanoStateIndex) GetStateByVersion(id string, version string) (*NanoStateMeta, error) {
+	var constraint *nanocms_compiler.VersionConstraint
+	if version != "" {
+		var err error
+		if constraint, err = nanocms_compiler.ParseVersionConstraint(version); err != nil {
+			return nil, err
+		}
+	}
+	versions := nsf.GetStateVersions(id)
+	for idx := len(versions) - 1; idx >= 0; idx-- {
+		if constraint == nil || constraint.Match(versions[idx].Version) {
+			return versions[idx], nil
+		}
+	}
+	if constraint != nil && len(versions) > 0 {
+		return nil, fmt.Errorf("No state can be found by Id %s and version %s", id, version)
+	}
+	return nil, fmt.Errorf("No state can be found by Id %s", id)
 }
 
 func (nsf *NanoStateIndex) GetStateByFileName(name string) (*NanoStateMeta, error) {
@@ -0,0 +1,284 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type CDLParserTestSuite struct{}
+
+var _ = check.Suite(&CDLParserTestSuite{})
+
+/*
+Test block names may contain directive symbols.
+*/
+func (s *CDLParserTestSuite) TestNameWithSigils(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("install-c++-compiler ?is_debian")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Name, check.Equals, "install-c++-compiler")
+	c.Assert(expr.Type(), check.Equals, nanocms_compiler.CDL_T_BLOCK)
+	c.Assert(expr.Condition.Op, check.Equals, nanocms_compiler.CDL_C_CALL)
+	c.Assert(expr.Condition.Call.Function, check.Equals, "is_debian")
+}
+
+/*
+Test dependency combined with a condition.
+*/
+func (s *CDLParserTestSuite) TestDependencyWithCondition(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("name  &dep/x:y ?cond")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Type(), check.Equals, nanocms_compiler.CDL_T_DEPENDENCY)
+	c.Assert(expr.Dependencies[0].Stateid, check.Equals, "dep")
+	c.Assert(expr.Dependencies[0].AnchorBlock, check.Equals, "name")
+	c.Assert(expr.Dependencies[0].Blocks, check.DeepEquals, []string{"x", "y"})
+	c.Assert(expr.Condition.Call.Function, check.Equals, "cond")
+}
+
+/*
+Test dependencies on several states.
+*/
+func (s *CDLParserTestSuite) TestSeveralDependencies(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("deploy-app &pgsql/install &redis/install:configure")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Type(), check.Equals, nanocms_compiler.CDL_T_DEPENDENCY)
+	c.Assert(len(expr.Dependencies), check.Equals, 2)
+	c.Assert(expr.Dependencies[1].Stateid, check.Equals, "redis")
+	c.Assert(expr.Dependencies[1].AnchorBlock, check.Equals, "deploy-app")
+	c.Assert(expr.Dependencies[1].Blocks, check.DeepEquals, []string{"install", "configure"})
+}
+
+/*
+Test optional and mandatory inclusions.
+*/
+func (s *CDLParserTestSuite) TestInclusions(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("+pgsql/ ~base/a:b")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Type(), check.Equals, nanocms_compiler.CDL_T_INCLUSION)
+	c.Assert(len(expr.Inclusions), check.Equals, 2)
+	c.Assert(expr.Inclusions[0].Optional, check.Equals, true)
+	c.Assert(len(expr.Inclusions[0].Blocks), check.Equals, 0)
+	c.Assert(expr.Inclusions[1].Blocks, check.DeepEquals, []string{"a", "b"})
+}
+
+/*
+Test references pinned to the state versions.
+*/
+func (s *CDLParserTestSuite) TestVersionedReferences(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("deploy-app &pgsql@>=12/install &redis/install @require:configure")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Dependencies[0].Stateid, check.Equals, "pgsql")
+	c.Assert(expr.Dependencies[0].Version, check.Equals, ">=12")
+	c.Assert(expr.Dependencies[0].Blocks, check.DeepEquals, []string{"install"})
+	c.Assert(expr.Dependencies[1].Version, check.Equals, "")
+
+	expr, err = nanocms_compiler.ParseCDL("+pgsql@13 ~redis@6.2/configure")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Inclusions[0].Stateid, check.Equals, "pgsql")
+	c.Assert(expr.Inclusions[0].Version, check.Equals, "13")
+	c.Assert(expr.Inclusions[1].Version, check.Equals, "6.2")
+	c.Assert(expr.Inclusions[1].Blocks, check.DeepEquals, []string{"configure"})
+}
+
+/*
+Test parameters of the referenced states.
+*/
+func (s *CDLParserTestSuite) TestReferenceParameters(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL(`~pgsql@13/install:configure(version="13", port=5433) ~redis(port=6380) +base/()`)
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Inclusions[0].Version, check.Equals, "13")
+	c.Assert(expr.Inclusions[0].Blocks, check.DeepEquals, []string{"install", "configure"})
+	c.Assert(len(expr.Inclusions[0].Params), check.Equals, 2)
+	c.Assert(expr.Inclusions[0].Params[1].Name, check.Equals, "port")
+	c.Assert(expr.Inclusions[0].Params[1].Value, check.Equals, int64(5433))
+	c.Assert(len(expr.Inclusions[1].Blocks), check.Equals, 0)
+	c.Assert(expr.Inclusions[1].Params[0].Name, check.Equals, "port")
+	c.Assert(len(expr.Inclusions[2].Params), check.Equals, 0)
+
+	expr, err = nanocms_compiler.ParseCDL(`deploy-app &pgsql/install(port=5433)`)
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Dependencies[0].Params[0].Value, check.Equals, int64(5433))
+}
+
+/*
+Test module loop.
+*/
+func (s *CDLParserTestSuite) TestLoop(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("system.user []more_users")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Type(), check.Equals, nanocms_compiler.CDL_T_LOOP)
+	c.Assert(expr.Name, check.Equals, "system.user")
+	c.Assert(expr.Loop.Function, check.Equals, "more_users")
+}
+
+/*
+Test syntax errors point to the offending token.
+*/
+func (s *CDLParserTestSuite) TestSyntaxErrors(c *check.C) {
+	for line, column := range map[string]int{
+		"foo ~/bar":           6,
+		"foo ~bar &baz/x":     10,
+		"foo bar":             5,
+		"foo&bar/x":           4,
+		"foo ?":               6,
+		"foo [bar":            5,
+		"foo &bar":            5,
+		"mod []fn ~state/x":   5,
+		"foo ~state/block:/":  18,
+		"foo @onerror:bar":    6,
+		"foo @onfail":         12,
+		"foo @onfail:":        13,
+		"@require:bar":        1,
+		"foo ~bar @require:x": 10,
+		"foo ~bar@/x":         9,
+		"foo ~bar@>=/x":       9,
+		"foo &bar@ /x":        9,
+		"foo ~bar/x(13)":      12,
+		"foo ~bar/x (a=1)":    13,
+		"foo ~bar/x(a=1":      15,
+	} {
+		_, err := nanocms_compiler.ParseCDL(line)
+		c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CDLSyntaxError{}, check.Commentf("Line: %s", line))
+		c.Assert(err.(*nanocms_compiler.CDLSyntaxError).Column, check.Equals, column, check.Commentf("Line: %s", line))
+	}
+}
+
+/*
+Test precedence of the boolean operators in conditions.
+*/
+func (s *CDLParserTestSuite) TestConditionPrecedence(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("foo ?a or ?b and not ?c")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Condition.Op, check.Equals, nanocms_compiler.CDL_C_OR)
+	c.Assert(len(expr.Condition.Operands), check.Equals, 2)
+	c.Assert(expr.Condition.Operands[1].Op, check.Equals, nanocms_compiler.CDL_C_AND)
+	c.Assert(expr.Condition.Operands[1].Operands[1].Op, check.Equals, nanocms_compiler.CDL_C_NOT)
+
+	expr, err = nanocms_compiler.ParseCDL("foo (?a or ?b) and ?c")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Condition.Op, check.Equals, nanocms_compiler.CDL_C_AND)
+	c.Assert(expr.Condition.Operands[0].Op, check.Equals, nanocms_compiler.CDL_C_OR)
+}
+
+/*
+Test several conditions in a row keep "or" meaning, even if they are apart.
+*/
+func (s *CDLParserTestSuite) TestConditionImplicitOr(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("?a foo ?b ?c")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Name, check.Equals, "foo")
+	c.Assert(expr.Condition.Op, check.Equals, nanocms_compiler.CDL_C_OR)
+	c.Assert(len(expr.Condition.Calls()), check.Equals, 3)
+}
+
+/*
+Test broken boolean conditions.
+*/
+func (s *CDLParserTestSuite) TestConditionErrors(c *check.C) {
+	for line, column := range map[string]int{
+		"foo (?a or ?b":    14,
+		"foo and ?b":       5,
+		"foo ?a and":       11,
+		"foo ?a or and ?b": 11,
+		"foo ?a )":         8,
+	} {
+		_, err := nanocms_compiler.ParseCDL(line)
+		c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CDLSyntaxError{}, check.Commentf("Line: %s", line))
+		c.Assert(err.(*nanocms_compiler.CDLSyntaxError).Column, check.Equals, column, check.Commentf("Line: %s", line))
+	}
+}
+
+/*
+Test function calls with literal arguments.
+*/
+func (s *CDLParserTestSuite) TestCallArguments(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL(`foo ?has_package("nginx", 'it\'s', 13, -1.5, True, None, port=5432,)`)
+	c.Assert(err, check.IsNil)
+	call := expr.Condition.Call
+	c.Assert(call.Function, check.Equals, "has_package")
+	c.Assert(call.Args(), check.DeepEquals, []interface{}{"nginx", "it's", int64(13), -1.5, true, nil})
+	c.Assert(len(call.Kwargs()), check.Equals, 1)
+	c.Assert(call.Kwargs()[0].Name, check.Equals, "port")
+	c.Assert(call.Kwargs()[0].Value, check.Equals, int64(5432))
+
+	expr, err = nanocms_compiler.ParseCDL(`system.user []users_in_group("admins, ops") ?a() or ?b`)
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Loop.Args(), check.DeepEquals, []interface{}{"admins, ops"})
+	c.Assert(expr.Loop.String(), check.Equals, `users_in_group("admins, ops")`)
+	c.Assert(len(expr.Condition.Calls()), check.Equals, 2)
+}
+
+/*
+Test broken function arguments.
+*/
+func (s *CDLParserTestSuite) TestCallArgumentErrors(c *check.C) {
+	for line, column := range map[string]int{
+		`foo ?fn("a"`:       12,
+		`foo ?fn("a)`:       9,
+		`foo ?fn(x=1, 2)`:   14,
+		`foo ?fn(x=1, x=2)`: 14,
+		`foo ?fn(nginx)`:    9,
+		`foo ?fn("a" "b")`:  13,
+		`foo ?fn(,)`:        9,
+		`mod []fn(x=)`:      12,
+		`foo ?fn ("a")`:     10,
+	} {
+		_, err := nanocms_compiler.ParseCDL(line)
+		c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CDLSyntaxError{}, check.Commentf("Line: %s", line))
+		c.Assert(err.(*nanocms_compiler.CDLSyntaxError).Column, check.Equals, column, check.Commentf("Line: %s", line))
+	}
+}
+
+func (s *CDLParserTestSuite) TestRequisites(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("deploy-app &pgsql/install @require:configure @onchanges:config:certs")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Type(), check.Equals, nanocms_compiler.CDL_T_DEPENDENCY)
+	c.Assert(len(expr.Requisites), check.Equals, 2)
+	c.Assert(expr.Requisites[0].Kind, check.Equals, nanocms_compiler.CDL_R_REQUIRE)
+	c.Assert(expr.Requisites[1].Kind, check.Equals, nanocms_compiler.CDL_R_ONCHANGES)
+	c.Assert(expr.Requisites[1].Blocks, check.DeepEquals, []string{"config", "certs"})
+	c.Assert(expr.Requisites[1].Column, check.Equals, 46)
+
+	// Not a requisite in the middle of a name
+	expr, err = nanocms_compiler.ParseCDL("notify@admins")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Name, check.Equals, "notify@admins")
+}
+
+/*
+Test deprecated helpers of the functions still parse the CDL lines.
+*/
+func (s *CDLParserTestSuite) TestDeprecatedHelpers(c *check.C) {
+	cdl := nanocms_compiler.NewCDLFunc()
+	inclusion, err := cdl.GetInclusion("test", "~pgsql/install:configure")
+	c.Assert(err, check.IsNil)
+	c.Assert(inclusion.Stateid, check.Equals, "pgsql")
+	c.Assert(inclusion.Blocks, check.DeepEquals, []string{"install", "configure"})
+
+	dependency, err := cdl.GetDependency("test", "deploy-app &pgsql/install")
+	c.Assert(err, check.IsNil)
+	c.Assert(dependency.AnchorBlock, check.Equals, "deploy-app")
+	c.Assert(dependency.Blocks, check.DeepEquals, []string{"install"})
+	_, err = cdl.GetDependency("test", "deploy-app")
+	c.Assert(err, check.ErrorMatches, "Dependency directive 'deploy-app' has invalid syntax at 'test'")
+
+	for line, kind := range map[string]int{
+		"~pgsql": nanocms_compiler.CDL_T_INCLUSION, "+pgsql": nanocms_compiler.CDL_T_OPTIONAL_INCLUSION,
+		"deploy &pgsql/install": nanocms_compiler.CDL_T_DEPENDENCY, "deploy ?is_debian": -1,
+	} {
+		blockType, err := cdl.BlockType("test", line)
+		c.Assert(err, check.IsNil)
+		c.Assert(blockType, check.Equals, kind, check.Commentf("Line: %s", line))
+	}
+	c.Assert(cdl.ToCDLKey("test", "deploy-app &pgsql/install ?is_debian"), check.Equals, "deploy-app")
+}
+
+/*
+Test signed numbers in the arguments are not optional inclusions or exclusions.
+*/
+func (s *CDLParserTestSuite) TestSignedArguments(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("~base-os ?check( +1, -1)")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Inclusions, check.HasLen, 1)
+	c.Assert(expr.Inclusions[0].Optional, check.Equals, false)
+	c.Assert(expr.Condition.Call.Args(), check.DeepEquals, []interface{}{int64(1), int64(-1)})
+}
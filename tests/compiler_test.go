@@ -27,11 +27,14 @@ func (s *CompilerTestSuite) SetUpTest(c *check.C) {
 	}
 
 	for {
-		id := s.cmp.Cycle()
+		id, err := s.cmp.Cycle()
+		if err != nil {
+			panic(err)
+		}
 		if id == "" {
 			break
 		}
-		err := s.cmp.LoadFile("states/pgsql.st")
+		err = s.cmp.LoadFile("states/pgsql.st")
 		if err != nil {
 			panic(err)
 		}
@@ -42,11 +45,18 @@ func (s *CompilerTestSuite) TearDownTest(c *check.C) {
 	s.cmp = nil
 }
 
+// Compiled tree, which is expected to have no errors
+func (s *CompilerTestSuite) tree(c *check.C) *nanocms_compiler.OTree {
+	tree, err := s.cmp.Tree()
+	c.Assert(err, check.IsNil)
+	return tree
+}
+
 /*
 Test "add-some-more-users" has three expected entries.
 */
 func (s *CompilerTestSuite) TestDefinitionAddSomeMoreUsersLen(c *check.C) {
-	users := s.cmp.Tree().GetBranch("state").GetList("add-some-more-users")
+	users := s.tree(c).GetBranch("state").GetList("add-some-more-users")
 	c.Assert(len(users), check.Equals, 3)
 }
 
@@ -54,7 +64,7 @@ func (s *CompilerTestSuite) TestDefinitionAddSomeMoreUsersLen(c *check.C) {
 Test "add-some-more-users" has proper ordering.
 */
 func (s *CompilerTestSuite) TestDefinitionAddSomeMoreUsersOrdering(c *check.C) {
-	users := s.cmp.Tree().GetBranch("state").GetList("add-some-more-users")
+	users := s.tree(c).GetBranch("state").GetList("add-some-more-users")
 	names := []string{"john", "fred", "ralf"}
 	for idx, kwset := range users {
 		for _, k := range kwset.(*nanocms_compiler.OTree).Keys() {
@@ -62,27 +72,136 @@ func (s *CompilerTestSuite) TestDefinitionAddSomeMoreUsersOrdering(c *check.C) {
 			c.Assert(kwset.(*nanocms_compiler.OTree).Get(k, nil).(*nanocms_compiler.OTree).Get("name", nil), check.Equals, names[idx])
 		}
 	}
-	//c.Log(s.cmp.Tree().ToYAML())
+	//c.Log(s.tree(c).ToYAML())
 }
 
 /*
 Test "installing Emacs on Debian using apt" .
 */
 func (s *CompilerTestSuite) TestDefinitionInstallEmacsDebian(c *check.C) {
-	c.Assert(len(s.cmp.Tree().GetBranch("state").GetList("install-emacs-apt")), check.Equals, 1)
+	c.Assert(len(s.tree(c).GetBranch("state").GetList("install-emacs-apt")), check.Equals, 1)
 }
 
 /*
 Test "installing Emacs on Debian not using yum" .
 */
 func (s *CompilerTestSuite) TestDefinitionInstallEmacsRedhat(c *check.C) {
-	c.Assert(s.cmp.Tree().GetBranch("state").Get("install-emacs-yum", "missing"), check.Equals, "missing")
+	c.Assert(s.tree(c).GetBranch("state").Get("install-emacs-yum", "missing"), check.Equals, "missing")
 }
 
 /*
 Test "installing Emacs on Debian not using yum" .
 */
 func (s *CompilerTestSuite) TestDefinitionIncludePgSql(c *check.C) {
-	c.Assert(len(s.cmp.Tree().GetBranch("state").GetList("install-postgres")), check.Equals, 2)
-	//c.Log(s.cmp.Tree().ToYAML())
+	// Modules of the block and of the blocks it depends on
+	tree := s.tree(c)
+	modules := len(tree.GetBranch("state").GetList("install-postgres"))
+	for _, dep := range tree.GetBranch("graph").GetList("install-postgres") {
+		modules += len(tree.GetBranch("state").GetList(dep.(string)))
+	}
+	c.Assert(modules, check.Equals, 2)
+	//c.Log(s.tree(c).ToYAML())
+}
+
+/*
+Test dependency of the other state is a separate block, which is required by the graph.
+*/
+func (s *CompilerTestSuite) TestDefinitionDependencyBlock(c *check.C) {
+	state := s.tree(c).GetBranch("state")
+	c.Assert(len(state.GetList("install-postgres")), check.Equals, 1)
+	c.Assert(len(state.GetList("pgsql/install-pgsql")), check.Equals, 1)
+	c.Assert(s.tree(c).GetBranch("graph").GetList("install-postgres"), check.DeepEquals, []interface{}{"pgsql/install-pgsql"})
+}
+
+/*
+Test compiled blocks know where they are defined in the source.
+*/
+func (s *CompilerTestSuite) TestDefinitionBlockPosition(c *check.C) {
+	pos := s.tree(c).GetBranch("state").KeyPosition("install-emacs-apt")
+	c.Assert(pos, check.NotNil)
+	c.Assert(pos.String(), check.Equals, "states/definition.st:47:3")
+}
+
+/*
+Test modules from a dependency keep positions of their own state source.
+*/
+func (s *CompilerTestSuite) TestDependencyModulePosition(c *check.C) {
+	state := s.tree(c).GetBranch("state")
+	c.Assert(state.ElementPosition("pgsql/install-pgsql", 0).String(), check.Equals, "states/pgsql.st:9:7")
+	c.Assert(state.KeyPosition("pgsql/install-pgsql").String(), check.Equals, "states/pgsql.st:8:3")
+	c.Assert(state.ElementPosition("install-postgres", 0).File, check.Equals, "states/definition.st")
+}
+
+/*
+Test conditions with boolean operators.
+*/
+func (s *CompilerTestSuite) TestDefinitionBooleanConditions(c *check.C) {
+	state := s.tree(c).GetBranch("state")
+	c.Assert(state.Exists("install-emacs-container"), check.Equals, false)
+	c.Assert(state.Exists("install-vim"), check.Equals, true)
+}
+
+/*
+Test conditions with arguments.
+*/
+func (s *CompilerTestSuite) TestDefinitionConditionArguments(c *check.C) {
+	state := s.tree(c).GetBranch("state")
+	c.Assert(state.Exists("configure-nginx"), check.Equals, true)
+	c.Assert(state.Exists("configure-apache"), check.Equals, false)
+}
+
+/*
+Test loops with arguments.
+*/
+func (s *CompilerTestSuite) TestDefinitionLoopArguments(c *check.C) {
+	admins := s.tree(c).GetBranch("state").GetList("add-admins")
+	c.Assert(len(admins), check.Equals, 2)
+	for idx, name := range []string{"root", "bofh"} {
+		user := admins[idx].(*nanocms_compiler.OTree).GetBranch("system.user")
+		c.Assert(user.Get("name", nil), check.Equals, name)
+		c.Assert(user.Get("group", nil), check.Equals, "admins")
+		c.Assert(user.Get("state", nil), check.Equals, "present")
+	}
+}
+
+/*
+Test loops are expanded in place among other modules of the block.
+*/
+func (s *CompilerTestSuite) TestDefinitionLoopsInPlace(c *check.C) {
+	staff := s.tree(c).GetBranch("state").GetList("setup-staff")
+	modules := []string{"system.group", "system.user", "system.user"}
+	for i := 0; i < 3; i++ {
+		modules = append(modules, "system.user", "mail.alias")
+	}
+	modules = append(modules, "system.service")
+	c.Assert(len(staff), check.Equals, len(modules))
+	for idx, name := range modules {
+		c.Assert(staff[idx].(*nanocms_compiler.OTree).Keys(), check.DeepEquals, []interface{}{name})
+	}
+
+	admin := staff[1].(*nanocms_compiler.OTree).GetBranch("system.user")
+	c.Assert(admin.Get("shell", nil), check.Equals, "/bin/bash")
+	c.Assert(admin.Get("name", nil), check.Equals, "root")
+	c.Assert(admin.Get("state", nil), check.Equals, "absent")
+
+	user := staff[3].(*nanocms_compiler.OTree).GetBranch("system.user")
+	c.Assert(user.Get("group", nil), check.Equals, "staff")
+	c.Assert(user.Get("name", nil), check.Equals, "john")
+	alias := staff[6].(*nanocms_compiler.OTree).GetBranch("mail.alias")
+	c.Assert(alias.Get("name", nil), check.Equals, "fred")
+}
+
+/*
+Test dependency goes before the block, which depends on it.
+*/
+func (s *CompilerTestSuite) TestDefinitionDependencyOrder(c *check.C) {
+	keys := s.tree(c).GetBranch("state").Keys()
+	c.Assert(keys[:3], check.DeepEquals, []interface{}{"an-example", "pgsql/install-pgsql", "install-postgres"})
+
+	graph, err := s.cmp.Graph()
+	c.Assert(err, check.IsNil)
+	node := graph.NodeByKey("install-postgres")
+	c.Assert(node.Id, check.Equals, "state-definition/install-postgres")
+	c.Assert(node.Requires, check.DeepEquals, []string{"pgsql/install-pgsql"})
+	c.Assert(graph.Node("pgsql/install-pgsql").StateId, check.Equals, "pgsql")
 }
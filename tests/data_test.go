@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate"
+	"gopkg.in/check.v1"
+)
+
+type DataTestSuite struct{}
+
+var _ = check.Suite(&DataTestSuite{})
+
+// Compile the database state with the data of the context
+func (s *DataTestSuite) compile(c *check.C, ctx *nanocms_state.DataContext) map[string]map[string]interface{} {
+	cmp := nanocms_state.NewStateCompiler().Index("states/pillar").SetDataContext(ctx)
+	_, err := cmp.Compile("states/pillar/db.st")
+	c.Assert(err, check.IsNil)
+
+	args := make(map[string]map[string]interface{})
+	for _, group := range cmp.GetState().OrderedGroups() {
+		for _, module := range group.Group {
+			args[group.Id] = module.Args
+		}
+	}
+	return args
+}
+
+/*
+Test data files are merged in the order of their precedence.
+*/
+func (s *DataTestSuite) TestMerge(c *check.C) {
+	index := nanocms_state.NewNanoStateIndex().AddStateRoot("states/pillar")
+	data, err := index.LoadData(&nanocms_state.DataContext{
+		Environment: "production",
+		Groups:      []string{"db", "replicas"},
+		Host:        "db01",
+	})
+	c.Assert(err, check.IsNil)
+
+	db := data.GetBranch("db")
+	c.Assert(db.Keys(), check.DeepEquals, []interface{}{"version", "port", "user", "replica", "primary"})
+	c.Assert(db.Get("version", nil), check.Equals, 14)
+	c.Assert(db.Get("port", nil), check.Equals, 5434)
+	c.Assert(db.GetString("user"), check.Equals, "pgsql")
+	c.Assert(db.GetString("primary"), check.Equals, "db00.example.com")
+	c.Assert(len(data.GetList("users")), check.Equals, 1)
+
+	defaults, err := index.LoadData(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(defaults.GetBranch("db").Get("port", nil), check.Equals, 5432)
+	c.Assert(defaults.GetBranch("db").Exists("replica"), check.Equals, false)
+}
+
+/*
+Test functions and templates of the states access the data.
+*/
+func (s *DataTestSuite) TestStates(c *check.C) {
+	args := s.compile(c, &nanocms_state.DataContext{Environment: "production", Groups: []string{"db"}, Host: "db01"})
+	c.Assert(args["install-db"]["present"], check.Equals, "postgresql-14")
+	c.Assert(args["configure-db"]["port"], check.Equals, int64(5433))
+	c.Assert(args["configure-db"]["user"], check.Equals, "pgsql")
+	c.Assert(args["configure-db"]["primary"], check.Equals, "db00.example.com")
+	c.Assert(args["configure-db"]["admin"], check.Equals, "admin")
+}
+
+/*
+Test compilation without the context uses the defaults.
+*/
+func (s *DataTestSuite) TestDefaults(c *check.C) {
+	args := s.compile(c, nil)
+	c.Assert(args["install-db"]["present"], check.Equals, "postgresql-12")
+	_, ex := args["configure-db"]
+	c.Assert(ex, check.Equals, false)
+}
+
+/*
+Test missing data without a default fails the compilation.
+*/
+func (s *DataTestSuite) TestMissing(c *check.C) {
+	cmp := nanocms_state.NewStateCompiler().Index("states/pillar")
+	_, err := cmp.CompileSource("test", []byte(`id: test
+description: Missing data
+state:
+  configure:
+    - system.service:
+        name: "{{ data('no.such.key') }}"
+`), nil)
+	c.Assert(err, check.ErrorMatches, ".*Data 'no.such.key' is not found.*")
+}
+
+/*
+Test the same compiler compiles the state again with another context.
+*/
+func (s *DataTestSuite) TestSwitchContext(c *check.C) {
+	cmp := nanocms_state.NewStateCompiler().Index("states/pillar")
+	packages := make([]interface{}, 0)
+	for _, ctx := range []*nanocms_state.DataContext{nil, {Environment: "production"}, nil} {
+		_, err := cmp.SetDataContext(ctx).Compile("states/pillar/db.st")
+		c.Assert(err, check.IsNil)
+		groups := cmp.GetState().OrderedGroups()
+		packages = append(packages, len(groups), groups[0].Group[0].Args["present"])
+	}
+	c.Assert(packages, check.DeepEquals, []interface{}{1, "postgresql-12", 2, "postgresql-14", 1, "postgresql-12"})
+}
@@ -0,0 +1,65 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type DependencyTestSuite struct {
+	state *nanocms_compiler.OTree
+	graph *nanocms_compiler.OTree
+}
+
+var _ = check.Suite(&DependencyTestSuite{})
+
+func (s *DependencyTestSuite) SetUpTest(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	for _, id := range []string{"app", "pgsql", "redis"} {
+		c.Assert(cmp.LoadFile("states/deps/"+id+".st"), check.IsNil)
+	}
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	s.state = tree.GetBranch("state")
+	s.graph = tree.GetBranch("graph")
+}
+
+// Module names with their first argument value of the block
+func (s *DependencyTestSuite) jobs(block string) []string {
+	jobs := make([]string, 0)
+	for _, job := range s.state.GetList(block) {
+		module := job.(*nanocms_compiler.OTree)
+		name := module.Keys()[0].(string)
+		switch args := module.Get(name, nil).(type) {
+		case *nanocms_compiler.OTree:
+			jobs = append(jobs, name+"="+args.Get(args.Keys()[0], "").(string))
+		default:
+			jobs = append(jobs, name)
+		}
+	}
+	return jobs
+}
+
+/*
+Test dependencies on several states go in the declared order before the block.
+*/
+func (s *DependencyTestSuite) TestSeveralStates(c *check.C) {
+	c.Assert(s.state.Keys(), check.DeepEquals, []interface{}{
+		"pgsql/install", "redis/install", "redis/configure", "deploy-app", "deploy-worker",
+	})
+	c.Assert(s.jobs("deploy-app"), check.DeepEquals, []string{"system.service=app"})
+	c.Assert(s.jobs("redis/configure"), check.DeepEquals, []string{"system.service=redis", "shell"})
+	c.Assert(s.graph.GetList("deploy-app"), check.DeepEquals, []interface{}{
+		"pgsql/install", "redis/install", "redis/configure",
+	})
+	c.Assert(s.state.ElementPosition("pgsql/install", 0).String(), check.Equals, "states/deps/pgsql.st:5:7")
+	c.Assert(s.state.ElementPosition("deploy-app", 0).String(), check.Equals, "states/deps/app.st:5:7")
+}
+
+/*
+Test each dependency block is compiled only once, even if several blocks require it.
+*/
+func (s *DependencyTestSuite) TestBlocksOnce(c *check.C) {
+	c.Assert(s.jobs("deploy-worker"), check.DeepEquals, []string{"system.service=worker"})
+	c.Assert(s.graph.GetList("deploy-worker"), check.DeepEquals, []interface{}{"redis/configure", "redis/install"})
+	c.Assert(s.graph.GetList("redis/install"), check.DeepEquals, []interface{}{})
+}
@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type CompilerErrorsTestSuite struct{}
+
+var _ = check.Suite(&CompilerErrorsTestSuite{})
+
+// Load state and compile it, returning whatever error happens
+func (s *CompilerErrorsTestSuite) compile(path string) error {
+	cmp := nanocms_compiler.NewNstCompiler()
+	if err := cmp.LoadFile(path); err != nil {
+		return err
+	}
+	_, err := cmp.Tree()
+	return err
+}
+
+/*
+Test broken YAML is reported with its source file.
+*/
+func (s *CompilerErrorsTestSuite) TestBrokenYAML(c *check.C) {
+	err := s.compile("states/broken/bad-yaml.st")
+	c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CompileError{})
+	c.Assert(err.(*nanocms_compiler.CompileError).Source, check.Equals, "states/broken/bad-yaml.st")
+	c.Assert(err, check.ErrorMatches, ".*line 5.*")
+}
+
+/*
+Test missing condition function is reported with its state and block.
+*/
+func (s *CompilerErrorsTestSuite) TestMissingConditionFunction(c *check.C) {
+	err := s.compile("states/broken/conditions.st")
+	c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CompileError{})
+	cerr := err.(*nanocms_compiler.CompileError)
+	c.Assert(cerr.StateId, check.Equals, "broken-conditions")
+	c.Assert(cerr.Block, check.Equals, "install-something")
+	c.Assert(cerr.Directive, check.Equals, "install-something ?no_such_function")
+	c.Assert(cerr.Position.String(), check.Equals, "states/broken/conditions.st:4:3")
+}
+
+/*
+Test loop function, returning a wrong type.
+*/
+func (s *CompilerErrorsTestSuite) TestLoopWrongType(c *check.C) {
+	err := s.compile("states/broken/loop.st")
+	c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CompileError{})
+	c.Assert(err.(*nanocms_compiler.CompileError).Block, check.Equals, "add-users")
+	c.Assert(err, check.ErrorMatches, ".*expected to return a list of dicts.*")
+}
+
+/*
+Test unresolved inclusion does not panic.
+*/
+func (s *CompilerErrorsTestSuite) TestUnresolvedInclusion(c *check.C) {
+	err := s.compile("states/broken/inclusion.st")
+	c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CompileError{})
+	c.Assert(err, check.ErrorMatches, ".*missing-state.*")
+}
+
+/*
+Test CDL syntax error points to the token in the state source.
+*/
+func (s *CompilerErrorsTestSuite) TestSyntaxErrorPosition(c *check.C) {
+	err := s.compile("states/broken/syntax.st")
+	c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CompileError{})
+	c.Assert(err.(*nanocms_compiler.CompileError).Position.String(), check.Equals, "states/broken/syntax.st:4:22")
+}
+
+/*
+Test wrong arguments of a function call are reported with its state and block.
+*/
+func (s *CompilerErrorsTestSuite) TestWrongArguments(c *check.C) {
+	err := s.compile("states/broken/arguments.st")
+	c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CompileError{})
+	cerr := err.(*nanocms_compiler.CompileError)
+	c.Assert(cerr.StateId, check.Equals, "broken-arguments")
+	c.Assert(cerr.Block, check.Equals, "install-something")
+	c.Assert(err, check.ErrorMatches, `.*has_package\(name="nginx", version=1\).*version.*`)
+}
+
+/*
+Test missing reference in a template is a compile error.
+*/
+func (s *CompilerErrorsTestSuite) TestMissingTemplateReference(c *check.C) {
+	err := s.compile("states/broken/templates.st")
+	c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CompileError{})
+	cerr := err.(*nanocms_compiler.CompileError)
+	c.Assert(cerr.StateId, check.Equals, "broken-templates")
+	c.Assert(cerr.Block, check.Equals, "configure-pgsql")
+	c.Assert(cerr.Position.String(), check.Equals, "states/broken/templates.st:7:7")
+	c.Assert(err, check.ErrorMatches, ".*no_such_port.*")
+}
+
+// Load states from the directory, resolving all references
+func (s *CompilerErrorsTestSuite) load(c *check.C, dir string, id string) *nanocms_compiler.NstCompiler {
+	cmp := nanocms_compiler.NewNstCompiler()
+	for id != "" {
+		c.Assert(cmp.LoadFile(dir+"/"+id+".st"), check.IsNil)
+		next, err := cmp.Cycle()
+		c.Assert(err, check.IsNil)
+		id = next
+	}
+	return cmp
+}
+
+/*
+Test cycle of inclusions and dependencies is reported with the whole chain.
+*/
+func (s *CompilerErrorsTestSuite) TestReferenceCycle(c *check.C) {
+	cmp := s.load(c, "states/cycle", "a")
+	_, err := cmp.Tree()
+	c.Assert(err, check.FitsTypeOf, &nanocms_compiler.CompileError{})
+	cerr := err.(*nanocms_compiler.CompileError)
+	c.Assert(cerr.StateId, check.Equals, "b")
+	c.Assert(cerr.Cause, check.FitsTypeOf, &nanocms_compiler.CycleError{})
+	c.Assert(cerr.Cause.(*nanocms_compiler.CycleError).Chain, check.DeepEquals, []string{"a/block1", "b", "a"})
+	c.Assert(err, check.ErrorMatches, ".*a/block1 -> b -> a")
+
+	// Compiler is still usable and reports the same
+	_, again := cmp.Tree()
+	c.Assert(again, check.ErrorMatches, ".*a/block1 -> b -> a")
+}
+
+/*
+Test state, which includes itself.
+*/
+func (s *CompilerErrorsTestSuite) TestSelfInclusion(c *check.C) {
+	_, err := s.load(c, "states/cycle", "self").Tree()
+	c.Assert(err, check.ErrorMatches, ".*states/cycle/self.st:4:3.*self/install-self -> self")
+}
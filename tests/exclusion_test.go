@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type ExclusionTestSuite struct{}
+
+var _ = check.Suite(&ExclusionTestSuite{})
+
+// Compile the state, that includes the base OS
+func (s *ExclusionTestSuite) compile(c *check.C, load func(*nanocms_compiler.NstCompiler) error) *nanocms_compiler.OTree {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(load(cmp), check.IsNil)
+	c.Assert(cmp.LoadFile("states/exclusion/base-os.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	return tree
+}
+
+/*
+Test excluded block is neither compiled nor required.
+*/
+func (s *ExclusionTestSuite) TestExclusion(c *check.C) {
+	tree := s.compile(c, func(cmp *nanocms_compiler.NstCompiler) error {
+		return cmp.LoadFile("states/exclusion/server.st")
+	})
+	c.Assert(tree.GetBranch("state").Keys(), check.DeepEquals, []interface{}{
+		"update-packages", "configure-firewall", "install-tools", "install-nftables",
+	})
+	c.Assert(tree.GetBranch("graph").GetList("configure-firewall"), check.DeepEquals, []interface{}{})
+}
+
+/*
+Test blocks are excluded with "!" in the inclusion.
+*/
+func (s *ExclusionTestSuite) TestNegatedBlocks(c *check.C) {
+	tree := s.compile(c, func(cmp *nanocms_compiler.NstCompiler) error {
+		return cmp.LoadSource("test", []byte(`id: test
+description: Only the tools
+state:
+  ~base-os/!install-firewall:!configure-firewall:!update-packages:
+`), nil)
+	})
+	c.Assert(tree.GetBranch("state").Keys(), check.DeepEquals, []interface{}{"install-tools"})
+}
+
+/*
+Test reference list does not require excluded blocks.
+*/
+func (s *ExclusionTestSuite) TestRefList(c *check.C) {
+	state := nanocms_compiler.NewOTree().Set("id", "test").Set("state", nanocms_compiler.NewOTree().
+		Set("~base-os/!install-firewall", []interface{}{}))
+	refs := nanocms_compiler.NewRefList()
+	c.Assert(refs.FindRefs(state), check.IsNil)
+	c.Assert(refs.GetRequiredJobs(), check.DeepEquals, []string{})
+	c.Assert(refs.GetExcludedJobs(), check.DeepEquals, []string{"base-os/install-firewall"})
+	c.Assert(refs.GetIncluded(), check.DeepEquals, []string{"base-os"})
+
+	// Block of the same name in the other state is not excluded
+	state = nanocms_compiler.NewOTree().Set("id", "test").Set("state", nanocms_compiler.NewOTree().
+		Set("~base-os/!install-firewall", []interface{}{}).
+		Set("~firewall/install-firewall", []interface{}{}))
+	refs = nanocms_compiler.NewRefList()
+	c.Assert(refs.FindRefs(state), check.IsNil)
+	c.Assert(refs.GetExcludedJobs(), check.DeepEquals, []string{"base-os/install-firewall"})
+	c.Assert(refs.GetRequiredJobs(), check.DeepEquals, []string{"install-firewall"})
+}
+
+/*
+Test syntax of the exclusions.
+*/
+func (s *ExclusionTestSuite) TestSyntax(c *check.C) {
+	expr, err := nanocms_compiler.ParseCDL("~base-os -base-os/install-firewall:install-selinux ~tools")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Inclusions[0].Exclude, check.DeepEquals, []string{"install-firewall", "install-selinux"})
+	c.Assert(len(expr.Inclusions[1].Exclude), check.Equals, 0)
+	c.Assert(expr.Inclusions[0].String(), check.Equals, "~base-os/!install-firewall:!install-selinux")
+
+	// Negative numbers are still arguments
+	expr, err = nanocms_compiler.ParseCDL("~base-os ?has_offset(1, -1)")
+	c.Assert(err, check.IsNil)
+	c.Assert(expr.Condition.Call.Args(), check.DeepEquals, []interface{}{int64(1), int64(-1)})
+
+	for line, msg := range map[string]string{
+		"~base-os/install-tools -base-os/install-firewall": ".*exclusion is allowed only for the entire state 'base-os'",
+		"~base-os -tools/install-vim":                      ".*exclusion of the state 'tools', which is not included",
+		"~base-os/install-tools:!install-firewall":         ".*inclusion cannot have both included and excluded blocks",
+		"~base-os -base-os":                                ".*exclusion should only list the blocks of the state",
+		"deploy &base-os/!install-firewall":                ".*dependency should not include the entire state",
+		"~base-os/!":                                       ".*expected block name after '!'",
+	} {
+		_, err := nanocms_compiler.ParseCDL(line)
+		c.Assert(err, check.ErrorMatches, msg, check.Commentf("Line: %s", line))
+	}
+}
+
+/*
+Test excluded blocks are not compiled, so their conditions and loops are not called.
+*/
+func (s *ExclusionTestSuite) TestExcludedNotCompiled(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadSource("test", []byte(`id: test
+description: Only the tools of the desktop
+state:
+  ~desktop -desktop/install-desktop:configure-desktop:
+`), nil), check.IsNil)
+	c.Assert(cmp.LoadFile("states/exclusion/desktop.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	c.Assert(tree.GetBranch("state").Keys(), check.DeepEquals, []interface{}{"install-tools"})
+}
+
+/*
+Test state, included with and without the exclusions, is compiled for each of them.
+*/
+func (s *ExclusionTestSuite) TestExcludedAndIncluded(c *check.C) {
+	for _, blocks := range [][]string{
+		{"~base-os -base-os/install-firewall:", "install-firewall ~base-os/install-firewall:"},
+		{"install-firewall ~base-os/install-firewall:", "~base-os -base-os/install-firewall:"},
+	} {
+		tree := s.compile(c, func(cmp *nanocms_compiler.NstCompiler) error {
+			return cmp.LoadSource("test", []byte("id: test\ndescription: Firewall included separately\nstate:\n  "+
+				blocks[0]+"\n  "+blocks[1]+"\n"), nil)
+		})
+		c.Assert(tree.GetBranch("state").Exists("install-firewall"), check.Equals, true, check.Commentf("%v", blocks))
+		c.Assert(tree.GetBranch("state").Exists("install-tools"), check.Equals, true, check.Commentf("%v", blocks))
+	}
+}
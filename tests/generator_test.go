@@ -0,0 +1,205 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/infra-whizz/wzcmslib/nanostate"
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type GeneratorTestSuite struct{}
+
+var _ = check.Suite(&GeneratorTestSuite{})
+
+// Compile the state with the generators of the web state. Generators fail when the state is loaded.
+func (s *GeneratorTestSuite) compile(c *check.C, src string) (*nanocms_compiler.OTree, error) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	if err := cmp.LoadSource("test", []byte(src), []byte(`def is_web():
+    return True
+
+def broken():
+    return {"not": "a list"}
+
+def unnamed():
+    return [("", [])]
+
+def strings():
+    return [("configure", ["system.file"])]
+
+def duplicate():
+    return [("install", None)]
+`)); err != nil {
+		return nil, err
+	}
+	return cmp.Tree()
+}
+
+/*
+Test generated blocks are spliced into the state in place of the generator.
+*/
+func (s *GeneratorTestSuite) TestBlocks(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/generators/web.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+
+	state := tree.GetBranch("state")
+	c.Assert(state.Keys(), check.DeepEquals, []interface{}{
+		"install-nginx",
+		"configure-example.com",
+		"configure-example.org",
+		"certificate-example.org",
+		"reload-nginx",
+	})
+
+	module := state.GetList("configure-example.org")[0].(*nanocms_compiler.OTree)
+	args := module.GetBranch("system.file")
+	c.Assert(args.Keys(), check.DeepEquals, []interface{}{"path", "owner"})
+	c.Assert(args.GetString("path"), check.Equals, "/etc/nginx/sites/example.org")
+}
+
+/*
+Test requisites of the generated blocks are handled as of the written blocks.
+*/
+func (s *GeneratorTestSuite) TestRequisites(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/generators/web.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	c.Assert(tree.GetBranch("requisites").GetBranch("certificate-example.org").GetList("require"),
+		check.DeepEquals, []interface{}{"install-nginx"})
+}
+
+/*
+Test generators and their blocks are traced.
+*/
+func (s *GeneratorTestSuite) TestTrace(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/generators/web.st"), check.IsNil)
+	_, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+
+	events := make([]string, 0)
+	for _, event := range cmp.Trace().Events {
+		if event.Kind == nanocms_compiler.TRACE_GENERATOR || event.Block == "[]backends ?is_proxy" {
+			events = append(events, event.String())
+		}
+	}
+	c.Assert(events, check.DeepEquals, []string{
+		"states/generators/web.st:8:3: state 'web', block '[]vhosts ?is_web': generator []vhosts ?is_web expanded: 3 blocks",
+		"states/generators/web.st:10:3: state 'web', block '[]backends ?is_proxy': condition ?is_proxy() failed",
+	})
+}
+
+/*
+Test generators, that return unexpected values, fail the compilation.
+*/
+func (s *GeneratorTestSuite) TestErrors(c *check.C) {
+	for generator, msg := range map[string]string{
+		"broken":    ".*Function 'broken' returns 'dict', but is expected to return a list.*",
+		"unnamed":   ".*Function 'unnamed' returns '\"\"' as block ID of element 0.*",
+		"strings":   ".*Function 'strings' returns 'string' as module 0 of block 'configure'.*",
+		"duplicate": ".*Generated block 'install' is already defined.*",
+	} {
+		_, err := s.compile(c, `id: test
+description: Generator errors
+state:
+  install:
+    - system.file:
+        path: /tmp/test
+
+  "[]`+generator+` ?is_web":
+`)
+		c.Assert(err, check.ErrorMatches, msg)
+	}
+}
+
+/*
+Test generator cannot have its own name and modules.
+*/
+func (s *GeneratorTestSuite) TestNameAndModules(c *check.C) {
+	_, err := s.compile(c, `id: test
+description: Named generator
+state:
+  configure []is_web:
+`)
+	c.Assert(err, check.ErrorMatches, ".*Generator '\\[\\]is_web' cannot have a name.*")
+
+	_, err = s.compile(c, `id: test
+description: Generator with modules
+state:
+  "[]is_web":
+    - system.file:
+        path: /tmp/test
+`)
+	c.Assert(err, check.ErrorMatches, ".*Generator '\\[\\]is_web' cannot have modules.*")
+}
+
+/*
+Test states, referenced by the generated blocks, are loaded from the index.
+*/
+func (s *GeneratorTestSuite) TestReferences(c *check.C) {
+	cmp := nanocms_state.NewStateCompiler().Index("states/generators")
+	_, err := cmp.Compile("states/generators/sites.st")
+	c.Assert(err, check.IsNil)
+
+	ids := make([]string, 0)
+	for _, group := range cmp.GetState().OrderedGroups() {
+		ids = append(ids, group.Id)
+		if group.Id == "configure-app" {
+			c.Assert(group.Requires, check.DeepEquals, []string{"sitedb/configure-db"})
+		}
+	}
+	c.Assert(ids, check.DeepEquals, []string{"install-db", "sitedb/configure-db", "configure-app"})
+}
+
+/*
+Test generator, run when the state is loaded, is not run again by the compilation.
+*/
+func (s *GeneratorTestSuite) TestRunOnce(c *check.C) {
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	c.Assert(err, check.IsNil)
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	cmp := nanocms_compiler.NewNstCompiler()
+	err = cmp.LoadSource("test", []byte(`id: test
+description: Generator with a side effect
+state:
+  "[]sites ?is_web":
+`), []byte(`def is_web():
+    print("condition")
+    return True
+
+def sites():
+    print("generator")
+    return [("configure-site", [{"system.file": {"path": "/etc/site"}}])]
+`))
+	c.Assert(err, check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	c.Assert(tree.GetBranch("state").Keys(), check.DeepEquals, []interface{}{"configure-site"})
+	c.Assert(cmp.Trace().Block("test", "[]sites ?is_web"), check.HasLen, 2)
+
+	os.Stderr = stderr
+	w.Close()
+	out, err := ioutil.ReadAll(r)
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Fields(string(out)), check.DeepEquals, []string{"condition", "generator"})
+}
+
+/*
+Test generator error is reported at its block, when the state is loaded.
+*/
+func (s *GeneratorTestSuite) TestErrorPosition(c *check.C) {
+	_, err := s.compile(c, `id: test
+description: Generator error
+state:
+  "[]broken":
+`)
+	c.Assert(err, check.ErrorMatches, "test:4:3, state 'test', directive '\\[\\]broken': Function 'broken' returns 'dict'.*")
+}
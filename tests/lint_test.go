@@ -0,0 +1,191 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate"
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type LintTestSuite struct {
+	linter *nanocms_state.NanoStateLinter
+}
+
+var _ = check.Suite(&LintTestSuite{})
+
+func (s *LintTestSuite) SetUpTest(c *check.C) {
+	index := nanocms_state.NewNanoStateIndex().AddStateRoot("states/lint").Index()
+	s.linter = nanocms_state.NewNanoStateLinter(index)
+}
+
+/*
+Test findings of all states in the index, sorted by their position.
+*/
+func (s *LintTestSuite) TestLint(c *check.C) {
+	findings := make([]string, 0)
+	for _, finding := range s.linter.Lint() {
+		findings = append(findings, finding.String())
+	}
+	c.Assert(findings, check.DeepEquals, []string{
+		"states/lint/states/args.st:8:9: error: Module 'system.user': Argument 'uid' should be int: got 'john' [argument-type]",
+		"states/lint/states/args.st:9:9: error: Module 'system.user': Unknown argument 'shell' [unknown-argument]",
+		"states/lint/states/args.st:10:9: error: Module 'system.user': Argument 'state' should be one of absent, present, but got 'gone' [argument-choice]",
+		"states/lint/states/args.st:13:7: error: Module 'ansible.system.user': Missing required argument 'name' [missing-argument]",
+		"states/lint/states/args.st:15:9: error: Module 'ansible.system.user': Element 1 of the argument 'groups' should be str: got a collection [argument-type]",
+		"states/lint/states/args.st:22:9: error: Module 'packaging.os.apt': Argument 'update_cache' should be bool: got 'maybe' [argument-type]",
+		"states/lint/states/db.st:1:1: error: State has no 'description' [missing-header]",
+		"states/lint/states/db.st:7:3: error: Block 'configure-db' is defined more than once [duplicate-block]",
+		"states/lint/states/loop.st:6:7: error: Function 'users' returns 'string', but is expected to return a list of dicts. [compile]",
+		"states/lint/states/web.fn:7:5: warning: Function 'forgotten' is never used [unused-function]",
+		"states/lint/states/web.st:10:7: error: Module 'sysem.user' is not found in the module roots [unknown-module]",
+		"states/lint/states/web.st:14:7: error: Function 'admins' is not defined in 'states/lint/states/web.fn' [missing-function]",
+		"states/lint/states/web.st:17:3: error: State 'db' has no block 'migrate-db' [missing-reference]",
+		"states/lint/states/web.st:19:3: error: State 'cache' is not found [missing-reference]",
+		"states/lint/states/web.st:21:3: error: Requisite '@onchanges' refers to unknown block 'configure-ngnix' [missing-reference]",
+		"states/lint/states/web.st:26:3: warning: Block 'add-user ?has_nginx' has the same name as 'add-user', only one of them is compiled [duplicate-block]",
+	})
+}
+
+/*
+Test findings are typed and carry the severity.
+*/
+func (s *LintTestSuite) TestLintState(c *check.C) {
+	findings := s.linter.LintState("web")
+	c.Assert(len(findings), check.Equals, 7)
+	c.Assert(findings[0].Kind, check.Equals, nanocms_state.LINT_UNUSED_FUNCTION)
+	c.Assert(findings[0].Severity, check.Equals, nanocms_state.LINT_WARNING)
+	c.Assert(findings[1].Kind, check.Equals, nanocms_state.LINT_UNKNOWN_MODULE)
+	c.Assert(findings[1].Severity, check.Equals, nanocms_state.LINT_ERROR)
+	c.Assert(findings[1].StateId, check.Equals, "web")
+	c.Assert(findings[1].Position.String(), check.Equals, "states/lint/states/web.st:10:7")
+
+	c.Assert(s.linter.LintState("app"), check.HasLen, 0)
+}
+
+/*
+Test modules of the compiled tree are checked.
+*/
+func (s *LintTestSuite) TestLintTree(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/definition.st"), check.IsNil)
+	c.Assert(cmp.LoadFile("states/pgsql.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+
+	unknown := make(map[string]bool)
+	for _, finding := range s.linter.LintTree(tree) {
+		if finding.Kind == nanocms_state.LINT_UNKNOWN_MODULE {
+			unknown[finding.Message] = true
+		}
+	}
+	c.Assert(unknown["Module 'system.user' is not found in the module roots"], check.Equals, false)
+	c.Assert(unknown["Module 'system.service' is not found in the module roots"], check.Equals, true)
+}
+
+/*
+Test arguments of the modules are checked against their specs.
+*/
+func (s *LintTestSuite) TestModuleArguments(c *check.C) {
+	findings := s.linter.LintState("args")
+	c.Assert(len(findings), check.Equals, 6)
+	for idx, kind := range []nanocms_state.LintKind{
+		nanocms_state.LINT_ARGUMENT_TYPE,
+		nanocms_state.LINT_UNKNOWN_ARGUMENT,
+		nanocms_state.LINT_ARGUMENT_CHOICE,
+		nanocms_state.LINT_MISSING_ARGUMENT,
+		nanocms_state.LINT_ARGUMENT_TYPE,
+		nanocms_state.LINT_ARGUMENT_TYPE,
+	} {
+		c.Assert(findings[idx].Kind, check.Equals, kind)
+	}
+	c.Assert(findings[2].String(), check.Equals, "states/lint/states/args.st:10:9: error: Module 'system.user': "+
+		"Argument 'state' should be one of absent, present, but got 'gone' [argument-choice]")
+	c.Assert(findings[3].Position.String(), check.Equals, "states/lint/states/args.st:13:7")
+	c.Assert(findings[5].Message, check.Equals, "Module 'packaging.os.apt': Argument 'update_cache' should be bool: got 'maybe'")
+}
+
+/*
+Test arguments of the compiled Nanostate are checked before it runs.
+*/
+func (s *LintTestSuite) TestLintNanostate(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/lint/states/args.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	state := nanocms_state.NewNanostate()
+	c.Assert(state.Load(tree), check.IsNil)
+
+	findings := s.linter.LintNanostate(state)
+	c.Assert(len(findings), check.Equals, 6)
+	c.Assert(findings[3].Position, check.IsNil)
+	c.Assert(findings[3].Message, check.Equals, "Block 'add-admin', Module 'ansible.system.user': Missing required argument 'name'")
+}
+
+/*
+Test argument spec is taken from the DOCUMENTATION block of the module.
+*/
+func (s *LintTestSuite) TestModuleDocumentation(c *check.C) {
+	spec, err := nanocms_state.ParseModuleDocumentation("example", []byte(`#!/usr/bin/python3
+DOCUMENTATION = """
+options:
+  ports:
+    type: list
+    elements: dict
+    suboptions:
+      port:
+        type: int
+        required: true
+      proto:
+        choices: [ tcp, udp ]
+"""
+
+EXAMPLES = "DOCUMENTATION = 'not this one'"
+`))
+	c.Assert(err, check.IsNil)
+	c.Assert(spec.Options[0].Name, check.Equals, "ports")
+	c.Assert(spec.Options[0].Options[1].Type, check.Equals, "str")
+
+	messages := make([]string, 0)
+	for _, problem := range spec.Check(map[string]interface{}{
+		"ports": []interface{}{
+			map[string]interface{}{"port": "80", "proto": "tcp"},
+			map[string]interface{}{"proto": "icmp"},
+		},
+	}) {
+		messages = append(messages, problem.Message)
+	}
+	c.Assert(messages, check.DeepEquals, []string{
+		"Missing required argument 'ports.port'",
+		"Argument 'ports.proto' should be one of tcp, udp, but got 'icmp'",
+	})
+
+	_, err = nanocms_state.ParseModuleDocumentation("example", []byte("print('no docs')"))
+	c.Assert(err, check.ErrorMatches, "Module has no DOCUMENTATION")
+}
+
+/*
+Test state, shadowed by the same state of the other root, is reported.
+*/
+func (s *LintTestSuite) TestShadowedState(c *check.C) {
+	index := nanocms_state.NewNanoStateIndex().AddStateRoots("states/shadow/first", "states/shadow/second").Index()
+	findings := make([]string, 0)
+	for _, finding := range nanocms_state.NewNanoStateLinter(index).Lint() {
+		findings = append(findings, finding.String())
+	}
+	c.Assert(findings, check.DeepEquals, []string{
+		"state 'tools': warning: State 'tools@1' at 'states/shadow/first/tools.st' is shadowed by the same state at " +
+			"'states/shadow/second/tools.st' [duplicate-state]",
+	})
+}
+
+/*
+Test states are compiled with the data of the context, as they are at run time.
+*/
+func (s *LintTestSuite) TestDataContext(c *check.C) {
+	index := nanocms_state.NewNanoStateIndex().AddStateRoot("states/lintdata").Index()
+	findings := nanocms_state.NewNanoStateLinter(index).Lint()
+	c.Assert(findings, check.HasLen, 1)
+	c.Assert(findings[0].String(), check.Matches, ".*Data 'app.port' is not found.*")
+
+	findings = nanocms_state.NewNanoStateLinter(index).SetDataContext(&nanocms_state.DataContext{Environment: "production"}).Lint()
+	c.Assert(findings, check.HasLen, 0)
+}
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"os"
+	"testing/fstest"
+
+	"github.com/infra-whizz/wzcmslib/nanostate"
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type LoaderTestSuite struct {
+	fsys fstest.MapFS
+}
+
+var _ = check.Suite(&LoaderTestSuite{})
+
+func (s *LoaderTestSuite) SetUpTest(c *check.C) {
+	s.fsys = fstest.MapFS{
+		"bundle/web.st": {Data: []byte(`id: web
+description: Web server from the bundle
+state:
+  install-nginx &database/install-db ?has_nginx:
+    - packaging.os.apt:
+        present: nginx
+`)},
+		"bundle/web.fn": {Data: []byte(`
+def has_nginx():
+    return True
+`)},
+		"bundle/db/database.st": {Data: []byte(`id: database
+description: Database from the bundle
+state:
+  install-db:
+    - packaging.os.apt:
+        present: "{{ db_package() }}"
+`)},
+		"bundle/db/database.fn": {Data: []byte(`
+def db_package():
+    return "postgresql"
+`)},
+	}
+}
+
+/*
+Test state and its functions are loaded from the memory.
+*/
+func (s *LoaderTestSuite) TestLoadSource(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	err := cmp.LoadSource("db:database", s.fsys["bundle/db/database.st"].Data, s.fsys["bundle/db/database.fn"].Data)
+	c.Assert(err, check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	module := tree.GetBranch("state").GetList("install-db")[0].(*nanocms_compiler.OTree)
+	c.Assert(module.GetBranch("packaging.os.apt").Get("present", nil), check.Equals, "postgresql")
+	c.Assert(tree.GetBranch("state").KeyPosition("install-db").String(), check.Equals, "db:database:4:3")
+}
+
+/*
+Test state without functions is loaded from the memory, and errors are named by the source ID.
+*/
+func (s *LoaderTestSuite) TestLoadSourceWithoutFunctions(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadSource("db:web", s.fsys["bundle/web.st"].Data, nil), check.IsNil)
+	id, err := cmp.Cycle()
+	c.Assert(err, check.IsNil)
+	c.Assert(id, check.Equals, "database")
+	c.Assert(cmp.LoadSource("db:database", s.fsys["bundle/db/database.st"].Data, nil), check.IsNil)
+
+	_, err = cmp.Tree()
+	c.Assert(err, check.ErrorMatches, "db:web:4:3, state 'web', block 'install-nginx'.*web.fn.*")
+}
+
+/*
+Test state and its functions are loaded from the file system.
+*/
+func (s *LoaderTestSuite) TestLoadFS(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFS(os.DirFS("states"), "definition.st"), check.IsNil)
+	c.Assert(cmp.LoadFS(os.DirFS("states"), "pgsql.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	c.Assert(tree.GetBranch("state").Exists("install-emacs-apt"), check.Equals, true)
+	c.Assert(tree.GetBranch("state").KeyPosition("install-emacs-apt").File, check.Equals, "definition.st")
+}
+
+/*
+Test states are indexed and compiled from the file system.
+*/
+func (s *LoaderTestSuite) TestStateCompilerFS(c *check.C) {
+	cmp := nanocms_state.NewStateCompiler().IndexFS(s.fsys, "bundle")
+	meta, err := cmp.GetStateIndex().GetStateById("database")
+	c.Assert(err, check.IsNil)
+	c.Assert(meta.Path, check.Equals, "bundle/db/database.st")
+
+	_, err = cmp.CompileFS(s.fsys, "bundle/web.st")
+	c.Assert(err, check.IsNil)
+	groups := cmp.GetState().OrderedGroups()
+	c.Assert(len(groups), check.Equals, 2)
+	c.Assert(groups[0].Id, check.Equals, "database/install-db")
+	c.Assert(groups[0].Group[0].Args["present"], check.Equals, "postgresql")
+	c.Assert(groups[1].Id, check.Equals, "install-nginx")
+	c.Assert(groups[1].Requires, check.DeepEquals, []string{"database/install-db"})
+}
+
+/*
+Test missing root of the file system is skipped, and the other roots are still indexed.
+*/
+func (s *LoaderTestSuite) TestMissingFSRoot(c *check.C) {
+	index := nanocms_state.NewNanoStateIndex().AddStateFS(s.fsys, "missing", "bundle").Index()
+	meta, err := index.GetStateById("database")
+	c.Assert(err, check.IsNil)
+	c.Assert(meta.Path, check.Equals, "bundle/db/database.st")
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate"
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type MultiDocTestSuite struct{}
+
+var _ = check.Suite(&MultiDocTestSuite{})
+
+// Ids of the compiled groups
+func (s *MultiDocTestSuite) groups(state *nanocms_state.Nanostate) []string {
+	ids := make([]string, 0)
+	for _, group := range state.OrderedGroups() {
+		ids = append(ids, group.Id)
+	}
+	return ids
+}
+
+/*
+Test each document of the file is indexed by its ID and document index.
+*/
+func (s *MultiDocTestSuite) TestIndex(c *check.C) {
+	index := nanocms_state.NewNanoStateIndex().AddStateRoot("states/multidoc").Index()
+	for _, ref := range [][]interface{}{
+		{"nginx", "", 0}, {"nginx-config", "1", 1}, {"nginx-config", "2", 3}, {"web", "", 0},
+	} {
+		meta, err := index.GetStateByVersion(ref[0].(string), ref[1].(string))
+		c.Assert(err, check.IsNil)
+		c.Assert(meta.Version, check.Equals, ref[1])
+		c.Assert(meta.Document, check.Equals, ref[2])
+	}
+	meta, err := index.GetStateByFileName("nginx.st")
+	c.Assert(err, check.IsNil)
+	c.Assert(meta.Id, check.Equals, "nginx")
+}
+
+/*
+Test states of the same file are referenced and share the functions.
+*/
+func (s *MultiDocTestSuite) TestReferences(c *check.C) {
+	cmp := nanocms_state.NewStateCompiler().Index("states/multidoc")
+	_, err := cmp.Compile("states/multidoc/web.st")
+	c.Assert(err, check.IsNil)
+	c.Assert(s.groups(cmp.GetState()), check.DeepEquals, []string{"install-nginx", "configure-nginx", "restart-nginx"})
+	c.Assert(cmp.GetState().OrderedGroups()[1].Group[0].Args["path"], check.Equals, "/etc/nginx/nginx.conf")
+}
+
+/*
+Test any state of the file can be the root state.
+*/
+func (s *MultiDocTestSuite) TestRootState(c *check.C) {
+	cmp := nanocms_state.NewStateCompiler().Index("states/multidoc")
+	_, err := cmp.CompileState("nginx-config")
+	c.Assert(err, check.IsNil)
+	c.Assert(s.groups(cmp.GetState()), check.DeepEquals, []string{"configure-sites"})
+
+	cmp = nanocms_state.NewStateCompiler().Index("states/multidoc")
+	_, err = cmp.CompileState("nginx-config@1")
+	c.Assert(err, check.IsNil)
+	c.Assert(s.groups(cmp.GetState()), check.DeepEquals, []string{"configure-nginx", "restart-nginx"})
+}
+
+/*
+Test the same state cannot be defined twice in the same file.
+*/
+func (s *MultiDocTestSuite) TestDuplicate(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	err := cmp.LoadSource("test", []byte(`id: test
+description: First
+state:
+  first:
+---
+id: test
+description: Second
+state:
+  second:
+`), nil)
+	c.Assert(err, check.ErrorMatches, "test:6:1, state 'test': State 'test' is defined several times")
+}
+
+/*
+Test functions, used by any state of the file, are not reported as unused.
+*/
+func (s *MultiDocTestSuite) TestLint(c *check.C) {
+	index := nanocms_state.NewNanoStateIndex().AddStateRoot("states/multidoc").Index()
+	findings := make([]string, 0)
+	for _, finding := range nanocms_state.NewNanoStateLinter(index).Lint() {
+		if finding.Kind != nanocms_state.LINT_UNKNOWN_MODULE {
+			findings = append(findings, finding.String())
+		}
+	}
+	c.Assert(findings, check.DeepEquals, []string{})
+}
@@ -0,0 +1,159 @@
+package tests
+
+import (
+	"encoding/json"
+
+	yamlv2 "github.com/go-yaml/yaml"
+	"github.com/infra-whizz/wzcmslib/nanostate"
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+	"gopkg.in/yaml.v3"
+)
+
+type OTreeTestSuite struct{}
+
+var _ = check.Suite(&OTreeTestSuite{})
+
+const otreeYAML = `id: ordered
+description: Keys are not sorted
+state:
+  zzz-first:
+    - shell:
+        - b-cmd: uname -a
+        - a-cmd: cat /etc/hosts
+  aaa-second:
+    - system.service:
+        state: started
+        name: httpd
+        ports:
+          - 80
+          - 443
+`
+
+const otreeJSON = `{"id":"ordered","description":"Keys are not sorted","state":{"zzz-first":[{"shell":[{"b-cmd":"uname -a"},{"a-cmd":"cat /etc/hosts"}]}],"aaa-second":[{"system.service":{"state":"started","name":"httpd","ports":[80,443]}}]}}`
+
+// Ordered tree from the YAML source
+func (s *OTreeTestSuite) load(c *check.C) *nanocms_compiler.OTree {
+	tree := nanocms_compiler.NewOTree()
+	c.Assert(yaml.Unmarshal([]byte(otreeYAML), tree), check.IsNil)
+	return tree
+}
+
+/*
+Test YAML is loaded and emitted in the order of the source.
+*/
+func (s *OTreeTestSuite) TestYAMLRoundTrip(c *check.C) {
+	tree := s.load(c)
+	c.Assert(tree.GetBranch("state").Keys(), check.DeepEquals, []interface{}{"zzz-first", "aaa-second"})
+	c.Assert(tree.ToYAML(), check.Equals, otreeYAML)
+
+	data, err := yaml.Marshal(tree)
+	c.Assert(err, check.IsNil)
+	other := nanocms_compiler.NewOTree()
+	c.Assert(yaml.Unmarshal(data, other), check.IsNil)
+	c.Assert(other.ToYAML(), check.Equals, tree.ToYAML())
+}
+
+/*
+Test JSON is emitted and loaded in the order of the tree.
+*/
+func (s *OTreeTestSuite) TestJSONRoundTrip(c *check.C) {
+	tree := s.load(c)
+	data, err := json.Marshal(tree)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, otreeJSON)
+	c.Assert(tree.ToJSON(), check.Equals, otreeJSON)
+
+	other := nanocms_compiler.NewOTree()
+	c.Assert(json.Unmarshal(data, other), check.IsNil)
+	c.Assert(other.GetBranch("state").Keys(), check.DeepEquals, []interface{}{"zzz-first", "aaa-second"})
+	c.Assert(other.ToJSON(), check.Equals, otreeJSON)
+	c.Assert(json.Unmarshal([]byte("id: not-json"), other), check.NotNil)
+}
+
+/*
+Test state is loaded in the order of the compiled tree.
+*/
+func (s *OTreeTestSuite) TestNanostateLoadOrder(c *check.C) {
+	state := nanocms_state.NewNanostate()
+	c.Assert(state.Load(s.load(c)), check.IsNil)
+	c.Assert(state.Id, check.Equals, "ordered")
+	c.Assert(state.GroupIndex, check.DeepEquals, []string{"zzz-first", "aaa-second"})
+	c.Assert(state.Groups[0].Id, check.Equals, "zzz-first")
+	c.Assert(state.Groups[0].Group[0].Instructions, check.DeepEquals, []interface{}{
+		map[string]interface{}{"b-cmd": "uname -a"},
+		map[string]interface{}{"a-cmd": "cat /etc/hosts"},
+	})
+	c.Assert(state.Groups[1].Group[0].Args["name"], check.Equals, "httpd")
+}
+
+// Module arguments of the compiled "types.st"
+func (s *OTreeTestSuite) types(c *check.C, block string) *nanocms_compiler.OTree {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/types.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	return tree.GetBranch("state").GetList(block)[0].(*nanocms_compiler.OTree).GetBranch("system.service")
+}
+
+/*
+Test scalars of all types, nulls and nested lists keep their types.
+*/
+func (s *OTreeTestSuite) TestScalarTypes(c *check.C) {
+	args := s.types(c, "configure-service")
+	c.Assert(args.Get("port", nil), check.Equals, 5432)
+	c.Assert(args.Get("mode", nil), check.Equals, 0644)
+	c.Assert(args.Get("ratio", nil), check.Equals, 0.75)
+	c.Assert(args.Get("nothing", "missing"), check.IsNil)
+	c.Assert(args.Get("sizes", nil), check.DeepEquals, []interface{}{1, 2.5, nil, true, "text"})
+	c.Assert(args.Get("matrix", nil), check.DeepEquals, []interface{}{
+		[]interface{}{1, 2},
+		[]interface{}{3, []interface{}{4, 5}},
+	})
+}
+
+/*
+Test merge keys with aliases, where explicit keys take precedence.
+*/
+func (s *OTreeTestSuite) TestMergeKeys(c *check.C) {
+	args := s.types(c, "configure-service")
+	c.Assert(args.Keys()[:6], check.DeepEquals, []interface{}{"state", "enabled", "restart", "nofile", "nproc", "name"})
+	c.Assert(args.Get("state", nil), check.Equals, "started")
+	c.Assert(args.Get("enabled", nil), check.Equals, false)
+	c.Assert(args.Get("restart", "missing"), check.IsNil)
+	c.Assert(args.Get("nofile", nil), check.Equals, 65536)
+
+	other := s.types(c, "copy-service")
+	c.Assert(other.Keys(), check.DeepEquals, []interface{}{"state", "enabled", "restart", "name"})
+	c.Assert(other.Get("enabled", nil), check.Equals, true)
+}
+
+/*
+Test all types come out the same in YAML and in the serialised map.
+*/
+func (s *OTreeTestSuite) TestTypesExport(c *check.C) {
+	args := s.types(c, "configure-service")
+	other := nanocms_compiler.NewOTree()
+	c.Assert(yaml.Unmarshal([]byte(args.ToYAML()), other), check.IsNil)
+	c.Assert(other.ToYAML(), check.Equals, args.ToYAML())
+	c.Assert(other.Get("mode", nil), check.Equals, 0644)
+	c.Assert(other.Get("matrix", nil), check.DeepEquals, args.Get("matrix", nil))
+
+	plain := args.Serialise()
+	c.Assert(plain["port"], check.Equals, 5432)
+	c.Assert(plain["ratio"], check.Equals, 0.75)
+	c.Assert(plain["sizes"], check.DeepEquals, []interface{}{1, 2.5, nil, true, "text"})
+	c.Assert(plain["nothing"], check.IsNil)
+}
+
+/*
+Test deprecated loader of the ordered YAML v2 mapping keeps the order.
+*/
+func (s *OTreeTestSuite) TestLoadMapSlice(c *check.C) {
+	var data yamlv2.MapSlice
+	c.Assert(yamlv2.Unmarshal([]byte(otreeYAML), &data), check.IsNil)
+	tree := nanocms_compiler.NewOTree().LoadMapSlice(data)
+	out, err := json.Marshal(tree)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(out), check.Equals, otreeJSON)
+}
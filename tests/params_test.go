@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"fmt"
+
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type ParamsTestSuite struct{}
+
+var _ = check.Suite(&ParamsTestSuite{})
+
+// Compile the state with the parameterised PostgreSQL
+func (s *ParamsTestSuite) compile(c *check.C, src string) (*nanocms_compiler.OTree, error) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadSource("test", []byte(src), nil), check.IsNil)
+	c.Assert(cmp.LoadFile("states/params/pgsql.st"), check.IsNil)
+	return cmp.Tree()
+}
+
+/*
+Test each set of the parameters is a separate instance of the state.
+*/
+func (s *ParamsTestSuite) TestInstances(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/params/app.st"), check.IsNil)
+	c.Assert(cmp.LoadFile("states/params/pgsql.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+
+	state := tree.GetBranch("state")
+	jobs := make([]string, 0)
+	for _, block := range state.Keys() {
+		for _, job := range state.GetList(block) {
+			module := job.(*nanocms_compiler.OTree)
+			args := module.GetBranch(module.Keys()[0].(string))
+			for _, arg := range []string{"present", "name", "port"} {
+				if args.Exists(arg) {
+					jobs = append(jobs, fmt.Sprintf("%s %s=%v", block, arg, args.Get(arg, nil)))
+				}
+			}
+		}
+	}
+	c.Assert(jobs, check.DeepEquals, []string{
+		"install present=postgresql-13",
+		"configure name=postgresql@13",
+		"configure port=5433",
+		"pgsql/install present=postgresql-12",
+		`pgsql(port=5434, version="14")/install present=postgresql-14`,
+		"deploy-app name=app",
+	})
+	c.Assert(tree.GetBranch("graph").GetList("deploy-app"), check.DeepEquals, []interface{}{`pgsql(port=5434, version="14")/install`})
+}
+
+/*
+Test state with the declared parameters does not accept the others.
+*/
+func (s *ParamsTestSuite) TestUnknownParameter(c *check.C) {
+	_, err := s.compile(c, `id: test
+description: Unknown parameter
+state:
+  install-db ~pgsql/install(release="13"):
+`)
+	c.Assert(err, check.ErrorMatches, ".*block 'install-db'.*State 'pgsql' has no parameter 'release'.*")
+}
+
+/*
+Test state without the declared parameters accepts any of them.
+*/
+func (s *ParamsTestSuite) TestUndeclaredParameters(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadSource("test", []byte(`id: test
+description: Any parameters
+state:
+  greet ~hello(name="world"):
+`), nil), check.IsNil)
+	c.Assert(cmp.LoadSource("hello", []byte(`id: hello
+description: Greeting
+state:
+  greet:
+    - shell:
+        - greet: echo Hello, {{ params.name }}
+`), nil), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	shell := tree.GetBranch("state").GetList("greet")[0].(*nanocms_compiler.OTree).GetList("shell")
+	c.Assert(shell[0].(*nanocms_compiler.OTree).Get("greet", nil), check.Equals, "echo Hello, world")
+}
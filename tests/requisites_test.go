@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanorunners"
+	"github.com/infra-whizz/wzcmslib/nanostate"
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type RequisitesTestSuite struct {
+	tree *nanocms_compiler.OTree
+}
+
+var _ = check.Suite(&RequisitesTestSuite{})
+
+func (s *RequisitesTestSuite) SetUpTest(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/requisites/requisites.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	s.tree = tree
+}
+
+/*
+Test requisites are compiled into their own section and order the blocks.
+*/
+func (s *RequisitesTestSuite) TestCompiled(c *check.C) {
+	c.Assert(s.tree.GetBranch("state").Keys(), check.DeepEquals, []interface{}{
+		"configure", "broken", "restart", "cleanup", "notify", "deploy", "report",
+	})
+	requisites := s.tree.GetBranch("requisites")
+	c.Assert(requisites.Keys(), check.DeepEquals, []interface{}{"restart", "cleanup", "notify", "deploy", "report"})
+	c.Assert(requisites.GetBranch("deploy").GetList("require"), check.DeepEquals, []interface{}{"configure", "broken"})
+	c.Assert(requisites.GetBranch("report").GetList("onfail"), check.DeepEquals, []interface{}{"requisites/optional"})
+	c.Assert(s.tree.GetBranch("graph").GetList("notify"), check.DeepEquals, []interface{}{"cleanup"})
+
+	state := nanocms_state.NewNanostate()
+	c.Assert(state.Load(s.tree), check.IsNil)
+	for _, group := range state.Groups {
+		if group.Id == "report" {
+			c.Assert(group.Requisites, check.DeepEquals, map[string][]string{
+				"require": {"configure"},
+				"onfail":  {"requisites/optional"},
+			})
+		}
+	}
+}
+
+/*
+Test blocks are skipped at run time, if their requisites are not met.
+*/
+func (s *RequisitesTestSuite) TestRun(c *check.C) {
+	state := nanocms_state.NewNanostate()
+	c.Assert(state.Load(s.tree), check.IsNil)
+	runner := nanocms_runners.NewLocalRunner()
+	runner.Run(state)
+
+	skipped := make(map[string]string)
+	for _, group := range runner.Response().Groups {
+		if group.Skipped {
+			c.Assert(group.Errcode, check.Equals, nanocms_runners.ERR_SKIPPED)
+			skipped[group.GroupId] = group.Reason
+		}
+	}
+	c.Assert(skipped, check.DeepEquals, map[string]string{
+		"deploy": "required group 'broken' failed",
+		"report": "no failures in groups 'requisites/optional'",
+	})
+
+	groups := runner.Response().Groups
+	c.Assert(groups[1].Failed(), check.Equals, true)
+	c.Assert(groups[2].Changed(), check.Equals, true)
+}
+
+/*
+Test requisite on a block, which is not defined in the state.
+*/
+func (s *RequisitesTestSuite) TestUnknownBlock(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/broken/requisites.st"), check.IsNil)
+	_, err := cmp.Tree()
+	c.Assert(err, check.ErrorMatches, "states/broken/requisites.st:5:3, state 'requisites', block 'restart', "+
+		"directive 'restart @onchanges:configure-ngnix': Requisite '@onchanges' refers to unknown block 'configure-ngnix'")
+}
@@ -0,0 +1,58 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type SharedStateTestSuite struct {
+	tree *nanocms_compiler.OTree
+}
+
+var _ = check.Suite(&SharedStateTestSuite{})
+
+func (s *SharedStateTestSuite) SetUpTest(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/shared/app.st"), check.IsNil)
+	c.Assert(cmp.LoadFile("states/shared/base.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	s.tree = tree
+}
+
+/*
+Test block, referenced several times, is compiled into the state once.
+*/
+func (s *SharedStateTestSuite) TestReferencesAreMerged(c *check.C) {
+	state := s.tree.GetBranch("state")
+	c.Assert(state.Keys(), check.DeepEquals, []interface{}{"base/install-base", "web", "db", "configure-base"})
+	c.Assert(len(state.GetList("base/install-base")), check.Equals, 1)
+
+	graph := s.tree.GetBranch("graph")
+	c.Assert(graph.GetList("web"), check.DeepEquals, []interface{}{"base/install-base"})
+	c.Assert(graph.GetList("db"), check.DeepEquals, []interface{}{"base/install-base"})
+}
+
+/*
+Test copies keep the positions of the original source.
+*/
+func (s *SharedStateTestSuite) TestCopiesKeepPositions(c *check.C) {
+	state := s.tree.GetBranch("state")
+	c.Assert(state.ElementPosition("base/install-base", 0).String(), check.Equals, "states/shared/base.st:5:7")
+	c.Assert(state.ElementPosition("web", 0).String(), check.Equals, "states/shared/app.st:5:7")
+	c.Assert(state.KeyPosition("configure-base").String(), check.Equals, "states/shared/base.st:8:3")
+}
+
+/*
+Test deep copy of the tree.
+*/
+func (s *SharedStateTestSuite) TestCopy(c *check.C) {
+	state := s.tree.GetBranch("state")
+	other := state.Copy()
+	c.Assert(other.Keys(), check.DeepEquals, state.Keys())
+	c.Assert(other.KeyPosition("web"), check.DeepEquals, state.KeyPosition("web"))
+
+	other.GetList("configure-base")[0].(*nanocms_compiler.OTree).GetBranch("system.user").Set("name", "root")
+	user := state.GetList("configure-base")[0].(*nanocms_compiler.OTree).GetBranch("system.user")
+	c.Assert(user.Get("name", nil), check.Equals, "admin")
+}
@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate"
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type StarStateTestSuite struct{}
+
+var _ = check.Suite(&StarStateTestSuite{})
+
+/*
+Test Starlark state is compiled into the same tree as the YAML state.
+*/
+func (s *StarStateTestSuite) TestTree(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/star/web.star"), check.IsNil)
+	c.Assert(cmp.LoadFile("states/star/db.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+
+	c.Assert(tree.GetString("id"), check.Equals, "web")
+	state := tree.GetBranch("state")
+	c.Assert(state.Keys(), check.DeepEquals, []interface{}{
+		"install-db", "install-nginx", "db/configure-db", "configure-example.com", "configure-example.org",
+	})
+	module := state.GetList("configure-example.org")[0].(*nanocms_compiler.OTree).GetBranch("system.file")
+	c.Assert(module.Keys(), check.DeepEquals, []interface{}{"path", "port"})
+	c.Assert(module.Get("port", nil), check.Equals, int64(8080))
+
+	c.Assert(tree.GetBranch("requisites").GetBranch("configure-example.com").GetList("require"),
+		check.DeepEquals, []interface{}{"install-nginx"})
+	c.Assert(tree.GetBranch("graph").GetList("configure-example.com"), check.DeepEquals, []interface{}{"db/configure-db", "install-nginx"})
+}
+
+/*
+Test Starlark states are indexed and included from YAML states, and include them.
+*/
+func (s *StarStateTestSuite) TestIndex(c *check.C) {
+	cmp := nanocms_state.NewStateCompiler().Index("states/star")
+	meta, err := cmp.GetStateIndex().GetStateById("web")
+	c.Assert(err, check.IsNil)
+	c.Assert(meta.Path, check.Equals, "states/star/web.star")
+
+	_, err = cmp.Compile("states/star/app.st")
+	c.Assert(err, check.IsNil)
+	ids := make([]string, 0)
+	for _, group := range cmp.GetState().OrderedGroups() {
+		ids = append(ids, group.Id)
+	}
+	c.Assert(ids, check.DeepEquals, []string{
+		"install-db", "install-nginx", "db/configure-db", "configure-example.com", "configure-example.org", "deploy-app",
+	})
+}
+
+/*
+Test ID of the state is found in the script without running it.
+*/
+func (s *StarStateTestSuite) TestStateId(c *check.C) {
+	id, version, err := nanocms_compiler.ParseStarStateId("test.star", []byte(`
+def helper():
+    return "x"
+
+state("test", version=2, description="Test")
+`))
+	c.Assert(err, check.IsNil)
+	c.Assert(id, check.Equals, "test")
+	c.Assert(version, check.Equals, "2")
+
+	_, _, err = nanocms_compiler.ParseStarStateId("test.star", []byte(`state(id="test-" + "x", description="Test")`))
+	c.Assert(err, check.ErrorMatches, "State in 'test.star' has no literal ID")
+
+	_, _, err = nanocms_compiler.ParseStarStateId("test.star", []byte(`state("test", version=1.10, description="Test")`))
+	c.Assert(err, check.ErrorMatches, `State in 'test.star' should have a string version, e.g. version="1.10"`)
+	_, err = nanocms_compiler.LoadStarState("test.star", []byte(`state("test", version=1.10, description="Test")`))
+	c.Assert(err, check.ErrorMatches, `.*State version should be a string, but got the number 1.1.*`)
+}
+
+/*
+Test errors of the state definitions point to the script.
+*/
+func (s *StarStateTestSuite) TestErrors(c *check.C) {
+	for src, msg := range map[string]string{
+		`block("install")`: ".*State is not defined, call state.*",
+		`state(id="a", description="A")` + "\n" + `state(id="b", description="B")`:               ".*test:2:6: State is already defined as 'a'.*",
+		`state(id="a", description="A")` + "\n" + `block("install", modules=["system.file"])`:    ".*Module 0 of block 'install' should be a dict, but got 'string'.*",
+		`state(id="a", description="A")` + "\n" + `block("install")` + "\n" + `block("install")`: ".*Block 'install' is already defined.*",
+	} {
+		err := nanocms_compiler.NewNstCompiler().LoadStarSource("test", []byte(src))
+		c.Assert(err, check.ErrorMatches, msg)
+	}
+}
+
+/*
+Test Starlark states are linted with the script as their functions.
+*/
+func (s *StarStateTestSuite) TestLint(c *check.C) {
+	index := nanocms_state.NewNanoStateIndex().AddStateRoot("states/star").Index()
+	findings := make([]string, 0)
+	for _, finding := range nanocms_state.NewNanoStateLinter(index).Lint() {
+		if finding.Kind != nanocms_state.LINT_UNKNOWN_MODULE {
+			findings = append(findings, finding.String())
+		}
+	}
+	c.Assert(findings, check.DeepEquals, []string{})
+}
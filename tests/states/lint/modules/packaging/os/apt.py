@@ -0,0 +1,2 @@
+#!/usr/bin/python3
+# Stub of the module for the linter tests
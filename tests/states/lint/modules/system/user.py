@@ -0,0 +1,25 @@
+#!/usr/bin/python3
+# Stub of the module for the linter tests
+
+DOCUMENTATION = r'''
+module: user
+short_description: Manage user accounts
+options:
+    name:
+        description: Name of the user
+        type: str
+        required: true
+        aliases: [ user ]
+    uid:
+        description: User ID
+        type: int
+    groups:
+        description: Groups of the user
+        type: list
+        elements: str
+    state:
+        description: Whether the account should exist
+        type: str
+        choices: [ absent, present ]
+        default: present
+'''
@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type TemplateTestSuite struct {
+	tree *nanocms_compiler.OTree
+}
+
+var _ = check.Suite(&TemplateTestSuite{})
+
+func (s *TemplateTestSuite) SetUpTest(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/templates.st"), check.IsNil)
+	tree, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	s.tree = tree
+}
+
+// Arguments of the n-th module of the block
+func (s *TemplateTestSuite) args(block string, idx int, module string) interface{} {
+	return s.tree.GetBranch("state").GetList(block)[idx].(*nanocms_compiler.OTree).Get(module, nil)
+}
+
+/*
+Test templates are rendered with the state functions and variables.
+*/
+func (s *TemplateTestSuite) TestFunctionsAndVars(c *check.C) {
+	service := s.args("configure-pgsql", 0, "system.service").(*nanocms_compiler.OTree)
+	c.Assert(service.Get("name", nil), check.Equals, "postgresql-13")
+	c.Assert(service.Get("options", nil), check.DeepEquals, []interface{}{
+		"--data=/var/lib/pgsql/13/data",
+		"--shared-buffers=128MB",
+	})
+}
+
+/*
+Test value, which is only a template, keeps its type.
+*/
+func (s *TemplateTestSuite) TestValueType(c *check.C) {
+	service := s.args("configure-pgsql", 0, "system.service").(*nanocms_compiler.OTree)
+	c.Assert(service.Get("port", nil), check.Equals, int64(5432))
+}
+
+/*
+Test templates in shell commands with builtins.
+*/
+func (s *TemplateTestSuite) TestShellBuiltins(c *check.C) {
+	commands := s.args("configure-pgsql", 1, "shell").([]interface{})
+	c.Assert(commands[0].(*nanocms_compiler.OTree).Get("show-kernel", nil), check.Equals, "echo Linux 4.4.0-109-generic")
+	c.Assert(commands[1].(*nanocms_compiler.OTree).Get("literal", nil), check.Equals, "echo '{ not a template }'")
+}
+
+/*
+Test escaped "{{" is rendered as it is.
+*/
+func (s *TemplateTestSuite) TestEscape(c *check.C) {
+	commands := s.args("configure-pgsql", 1, "shell").([]interface{})
+	c.Assert(commands[2].(*nanocms_compiler.OTree).Get("escaped", nil), check.Equals, "docker ps --format '{{.Names}}'")
+	c.Assert(commands[3].(*nanocms_compiler.OTree).Get("quoted", nil), check.Equals, "docker ps --format '{{.Names}}'")
+}
+
+/*
+Test escaped backslash is kept before the rendered template.
+*/
+func (s *TemplateTestSuite) TestEscapedBackslash(c *check.C) {
+	commands := s.args("configure-pgsql", 1, "shell").([]interface{})
+	c.Assert(commands[4].(*nanocms_compiler.OTree).Get("backslash", nil), check.Equals, "echo \\13")
+}
+
+/*
+Test items of the loop are not rendered, while the arguments of the source are.
+*/
+func (s *TemplateTestSuite) TestLoopItems(c *check.C) {
+	for idx, format := range []string{"{{.Names}}", "{{.Image}}"} {
+		ps := s.args("list-containers", idx, "docker.ps").(*nanocms_compiler.OTree)
+		c.Assert(ps.Get("format", nil), check.Equals, format)
+		c.Assert(ps.Get("name", nil), check.Equals, "postgresql-13")
+	}
+}
@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"encoding/json"
+
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type TraceTestSuite struct {
+	trace *nanocms_compiler.CompileTrace
+}
+
+var _ = check.Suite(&TraceTestSuite{})
+
+func (s *TraceTestSuite) SetUpTest(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadFile("states/definition.st"), check.IsNil)
+	c.Assert(cmp.LoadFile("states/pgsql.st"), check.IsNil)
+	_, err := cmp.Tree()
+	c.Assert(err, check.IsNil)
+	s.trace = cmp.Trace()
+}
+
+// Text of the events of the block
+func (s *TraceTestSuite) events(stateid string, block string) []string {
+	events := make([]string, 0)
+	for _, event := range s.trace.Block(stateid, block) {
+		events = append(events, event.String())
+	}
+	return events
+}
+
+/*
+Test results of the conditions are traced per block.
+*/
+func (s *TraceTestSuite) TestConditions(c *check.C) {
+	c.Assert(s.events("state-definition", "install-emacs-yum"), check.DeepEquals, []string{
+		"states/definition.st:51:3: state 'state-definition', block 'install-emacs-yum': condition ?is_redhat_family() failed",
+	})
+	c.Assert(s.events("state-definition", "install-vim"), check.DeepEquals, []string{
+		"states/definition.st:61:3: state 'state-definition', block 'install-vim': " +
+			"condition (?is_redhat_family() or ?is_ubuntu()) and not ?is_debian() passed",
+	})
+	c.Assert(s.events("pgsql", "install-pgsql"), check.DeepEquals, []string{
+		"states/pgsql.st:8:3: state 'pgsql', block 'install-pgsql': condition ?is_pgsql_needed() passed",
+	})
+	c.Assert(len(s.events("state-definition", "add-josh")), check.Equals, 0)
+}
+
+/*
+Test loops are traced with the number of their items.
+*/
+func (s *TraceTestSuite) TestLoops(c *check.C) {
+	c.Assert(s.events("state-definition", "setup-staff"), check.DeepEquals, []string{
+		`states/definition.st:97:7: state 'state-definition', block 'setup-staff': loop system.user []users_in_group("admins") expanded: 2 items`,
+		"states/definition.st:99:7: state 'state-definition', block 'setup-staff': loop []more_users expanded: 3 items",
+	})
+}
+
+/*
+Test blocks, pulled in by the dependencies, are traced.
+*/
+func (s *TraceTestSuite) TestDependencies(c *check.C) {
+	c.Assert(s.events("state-definition", "install-postgres"), check.DeepEquals, []string{
+		"states/definition.st:22:3: state 'state-definition', block 'install-postgres': dependency &pgsql/install-pgsql resolved: pgsql/install-pgsql",
+	})
+}
+
+/*
+Test skipped and missing inclusions are traced, also when the compilation fails.
+*/
+func (s *TraceTestSuite) TestInclusions(c *check.C) {
+	cmp := nanocms_compiler.NewNstCompiler()
+	c.Assert(cmp.LoadSource("test", []byte(`id: test
+description: Inclusions
+state:
+  +redis:
+
+  ~pgsql/update-pgsql:no-such-block:
+
+  ~mysql@8/install:
+`), nil), check.IsNil)
+	c.Assert(cmp.LoadFile("states/pgsql.st"), check.IsNil)
+	cmp.SquashState("redis")
+	cmp.SquashState("mysql@8")
+	_, err := cmp.Tree()
+	c.Assert(err, check.NotNil)
+
+	outcomes := make([]string, 0)
+	for _, event := range cmp.Trace().Events {
+		outcomes = append(outcomes, event.Kind+" "+event.Target+" "+event.Outcome)
+	}
+	c.Assert(outcomes, check.DeepEquals, []string{
+		"include +redis skipped",
+		"condition ?is_pgsql_needed() passed",
+		"include ~pgsql/update-pgsql:no-such-block skipped",
+		"include ~pgsql/update-pgsql:no-such-block resolved",
+		"include ~mysql@8/install missing",
+	})
+	c.Assert(cmp.Trace().Events[3].Blocks, check.DeepEquals, []string{"update-pgsql"})
+}
+
+/*
+Test trace is rendered as JSON.
+*/
+func (s *TraceTestSuite) TestJSON(c *check.C) {
+	data, err := s.trace.JSON()
+	c.Assert(err, check.IsNil)
+
+	var trace struct {
+		Events []map[string]interface{} `json:"events"`
+	}
+	c.Assert(json.Unmarshal(data, &trace), check.IsNil)
+	c.Assert(len(trace.Events), check.Equals, len(s.trace.Events))
+	for _, event := range trace.Events {
+		if event["block"] == "add-some-more-users" {
+			c.Assert(event, check.DeepEquals, map[string]interface{}{
+				"kind": "loop", "state": "state-definition", "block": "add-some-more-users", "target": "system.user []more_users",
+				"outcome": "expanded", "items": float64(3), "position": "states/definition.st:75:7",
+			})
+			return
+		}
+	}
+	c.Fail()
+}
@@ -0,0 +1,179 @@
+package tests
+
+import (
+	"github.com/infra-whizz/wzcmslib/nanostate"
+	"github.com/infra-whizz/wzcmslib/nanostate/compiler"
+	"gopkg.in/check.v1"
+)
+
+type VersionsTestSuite struct {
+	index *nanocms_state.NanoStateIndex
+}
+
+var _ = check.Suite(&VersionsTestSuite{})
+
+func (s *VersionsTestSuite) SetUpTest(c *check.C) {
+	s.index = nanocms_state.NewNanoStateIndex().AddStateRoot("states/versions").Index()
+}
+
+// Compile the state from the source with the versions index
+func (s *VersionsTestSuite) compile(src string) (*nanocms_state.Nanostate, error) {
+	cmp := nanocms_state.NewStateCompiler().Index("states/versions")
+	if _, err := cmp.CompileSource("test", []byte(src), nil); err != nil {
+		return nil, err
+	}
+	return cmp.GetState(), nil
+}
+
+/*
+Test versions are compared by their numeric parts.
+*/
+func (s *VersionsTestSuite) TestCompareVersions(c *check.C) {
+	for _, versions := range [][]string{
+		{"", "1"}, {"9.6", "12"}, {"12", "12.1"}, {"12.1", "12.10"}, {"1.0", "1.beta"}, {"1.alpha", "1.beta"},
+	} {
+		c.Assert(nanocms_compiler.CompareVersions(versions[0], versions[1]), check.Equals, -1, check.Commentf("%v", versions))
+		c.Assert(nanocms_compiler.CompareVersions(versions[1], versions[0]), check.Equals, 1, check.Commentf("%v", versions))
+	}
+	c.Assert(nanocms_compiler.CompareVersions("12.0", "12"), check.Equals, 0)
+}
+
+/*
+Test version constraints.
+*/
+func (s *VersionsTestSuite) TestConstraints(c *check.C) {
+	for constraint, matches := range map[string]map[string]bool{
+		"13":    {"13": true, "13.1": true, "130": false, "12": false, "": false},
+		"=13":   {"13": true, "13.0": true, "13.1": false},
+		"!=13":  {"13": false, "12": true},
+		">=12":  {"12": true, "14.1": true, "9.6": false},
+		"<14":   {"13.9": true, "14": false},
+		">12.1": {"12.1": false, "12.2": true},
+	} {
+		vc, err := nanocms_compiler.ParseVersionConstraint(constraint)
+		c.Assert(err, check.IsNil)
+		c.Assert(vc.String(), check.Equals, constraint)
+		for version, match := range matches {
+			c.Assert(vc.Match(version), check.Equals, match, check.Commentf("%s %s", constraint, version))
+		}
+	}
+	for _, constraint := range []string{"", ">=", "1..2", "=<1"} {
+		_, err := nanocms_compiler.ParseVersionConstraint(constraint)
+		c.Assert(err, check.NotNil, check.Commentf("%s", constraint))
+	}
+}
+
+/*
+Test index keeps all versions of the state and finds them by the constraint.
+*/
+func (s *VersionsTestSuite) TestIndex(c *check.C) {
+	versions := make([]string, 0)
+	for _, meta := range s.index.GetStateVersions("pgsql") {
+		versions = append(versions, meta.Version)
+	}
+	c.Assert(versions, check.DeepEquals, []string{"12", "13", "14.1"})
+
+	meta, err := s.index.GetStateById("pgsql")
+	c.Assert(err, check.IsNil)
+	c.Assert(meta.Version, check.Equals, "14.1")
+
+	meta, err = s.index.GetStateByVersion("pgsql", "<14")
+	c.Assert(err, check.IsNil)
+	c.Assert(meta.Version, check.Equals, "13")
+
+	_, err = s.index.GetStateByVersion("pgsql", "15")
+	c.Assert(err, check.ErrorMatches, "No state can be found by Id pgsql and version 15")
+}
+
+/*
+Test pinned references use the matching versions and the others use the highest one.
+*/
+func (s *VersionsTestSuite) TestCompile(c *check.C) {
+	cmp := nanocms_state.NewStateCompiler().Index("states/versions")
+	_, err := cmp.Compile("states/versions/app.st")
+	c.Assert(err, check.IsNil)
+
+	jobs := make([]string, 0)
+	for _, group := range cmp.GetState().OrderedGroups() {
+		for _, module := range group.Group {
+			for _, arg := range []string{"present", "name"} {
+				if value, ex := module.Args[arg]; ex {
+					jobs = append(jobs, group.Id+"="+value.(string))
+				}
+			}
+		}
+	}
+	c.Assert(jobs, check.DeepEquals, []string{
+		"install=postgresql-13",
+		"pgsql@13/configure=postgresql@13", "deploy-app=app",
+		"pgsql@14.1/configure=postgresql@14", "report-app=report",
+	})
+}
+
+/*
+Test versioned state is compiled with its version.
+*/
+func (s *VersionsTestSuite) TestCompileVersioned(c *check.C) {
+	cmp := nanocms_state.NewStateCompiler()
+	_, err := cmp.Compile("states/versions/pgsql-12/pgsql.st")
+	c.Assert(err, check.IsNil)
+	c.Assert(cmp.GetState().Id, check.Equals, "pgsql")
+	c.Assert(cmp.GetState().Version, check.Equals, "12")
+}
+
+/*
+Test reference to a missing version is not found.
+*/
+func (s *VersionsTestSuite) TestMissingVersion(c *check.C) {
+	_, err := s.compile(`id: test
+description: Missing version
+state:
+  install ~pgsql@15/install:
+`)
+	c.Assert(err, check.ErrorMatches, ".*Cannot include state 'pgsql@15': not found.*")
+
+	_, err = s.compile(`id: test
+description: Invalid version
+version: ">=1"
+state:
+  install ~pgsql/install:
+`)
+	c.Assert(err, check.ErrorMatches, ".*State has invalid version '>=1'.*")
+}
+
+/*
+Test unquoted versions keep their text, so 1.10 is not the number 1.1.
+*/
+func (s *VersionsTestSuite) TestDecimalVersions(c *check.C) {
+	index := nanocms_state.NewNanoStateIndex().AddStateRoot("states/decimal").Index()
+	versions := make([]string, 0)
+	for _, meta := range index.GetStateVersions("lib") {
+		versions = append(versions, meta.Version)
+	}
+	c.Assert(versions, check.DeepEquals, []string{"1.9", "1.10"})
+
+	for ref, pkg := range map[string]string{"lib@1.10": "lib-1.10", "lib@1.9": "lib-1.9", "lib": "lib-1.10"} {
+		cmp := nanocms_state.NewStateCompiler().Index("states/decimal")
+		_, err := cmp.CompileSource("test", []byte("id: test\ndescription: Decimal versions\nstate:\n  install ~"+ref+"/install:\n"), nil)
+		c.Assert(err, check.IsNil, check.Commentf("%s", ref))
+		groups := cmp.GetState().OrderedGroups()
+		c.Assert(groups, check.HasLen, 1)
+		c.Assert(groups[0].Group[0].Args["present"], check.Equals, pkg, check.Commentf("%s", ref))
+	}
+}
+
+/*
+Test the same version of the state in the other root shadows the previous one.
+*/
+func (s *VersionsTestSuite) TestShadowed(c *check.C) {
+	index := nanocms_state.NewNanoStateIndex().AddStateRoots("states/shadow/first", "states/shadow/second").Index()
+	meta, err := index.GetStateById("tools")
+	c.Assert(err, check.IsNil)
+	c.Assert(meta.Path, check.Equals, "states/shadow/second/tools.st")
+
+	shadowed := index.GetShadowedStates("tools")
+	c.Assert(shadowed, check.HasLen, 1)
+	c.Assert(shadowed[0].Shadowed.Path, check.Equals, "states/shadow/first/tools.st")
+	c.Assert(shadowed[0].By.Path, check.Equals, "states/shadow/second/tools.st")
+	c.Assert(index.GetShadowedStates("pgsql"), check.HasLen, 0)
+}